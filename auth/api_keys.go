@@ -0,0 +1,154 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"cloudflaretinyurl/config"
+	"cloudflaretinyurl/database"
+)
+
+// Generated keys are keyPrefix followed by 64 hex characters
+const (
+	keyPrefix    = "tk_"
+	displayChars = 8 // Leading characters of a key kept in plain text to tell keys apart
+)
+
+// Principal is the authenticated caller of a request
+type Principal struct {
+	KeyID int64
+	Owner string
+	Admin bool
+}
+
+type contextKey struct{}
+
+var cfg = config.Default().Auth
+
+// Initialize authentication settings
+func InitAuth(authConfig config.Auth) {
+	cfg = authConfig
+}
+
+// Enabled reports whether requests must carry an API key
+func Enabled() bool {
+	return cfg.Enabled
+}
+
+// HashKey is the form a key is stored and looked up in. Keys are random, so a fast hash suffices.
+func HashKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// GenerateKey stores a new random key and returns it, the only time it is available in plain text
+func GenerateKey(ctx context.Context, owner string, admin bool) (string, database.APIKey, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", database.APIKey{}, err
+	}
+	key := keyPrefix + hex.EncodeToString(buf)
+
+	stored, err := database.Keys.CreateAPIKey(ctx, database.APIKey{Owner: owner, Prefix: display(key), Admin: admin}, HashKey(key))
+	return key, stored, err
+}
+
+// EnsureAdminKey stores the configured bootstrap admin key unless it already exists
+func EnsureAdminKey(ctx context.Context) error {
+	if cfg.AdminKey == "" {
+		return nil
+	}
+	_, err := database.Keys.GetAPIKeyByHash(ctx, HashKey(cfg.AdminKey))
+	if err == nil {
+		return nil // Kept as is, even if revoked
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+	_, err = database.Keys.CreateAPIKey(ctx, database.APIKey{Owner: "admin", Prefix: display(cfg.AdminKey), Admin: true}, HashKey(cfg.AdminKey))
+	if err == nil {
+		log.Println("Stored bootstrap admin API key")
+	}
+	return err
+}
+
+func display(key string) string {
+	return key[:min(len(key), len(keyPrefix)+displayChars)]
+}
+
+// Key sent as "Authorization: Bearer <key>" or "X-API-Key: <key>"
+func keyFromRequest(r *http.Request) string {
+	if bearer, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		return strings.TrimSpace(bearer)
+	}
+	return r.Header.Get("X-API-Key")
+}
+
+// Middleware rejects requests without an active API key with 401 and adds the caller's
+// Principal to the request context. With auth disabled every caller acts as admin.
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !cfg.Enabled {
+			next.ServeHTTP(w, r.WithContext(WithPrincipal(r.Context(), Principal{Admin: true})))
+			return
+		}
+
+		key := keyFromRequest(r)
+		if key == "" {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="api"`)
+			http.Error(w, "API key required", http.StatusUnauthorized)
+			return
+		}
+
+		stored, err := database.Keys.GetAPIKeyByHash(r.Context(), HashKey(key))
+		if errors.Is(err, sql.ErrNoRows) || (err == nil && !stored.Active(time.Now())) {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="api", error="invalid_token"`)
+			http.Error(w, "Invalid or revoked API key", http.StatusUnauthorized)
+			return
+		}
+		if err != nil {
+			log.Println("Failed to look up API key:", err)
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+
+		principal := Principal{KeyID: stored.ID, Owner: stored.Owner, Admin: stored.Admin}
+		next.ServeHTTP(w, r.WithContext(WithPrincipal(r.Context(), principal)))
+	})
+}
+
+// RequireAdmin wraps Middleware and additionally rejects non-admin keys with 403
+func RequireAdmin(next http.Handler) http.Handler {
+	return Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if principal, _ := FromContext(r.Context()); !principal.Admin {
+			http.Error(w, "Admin API key required", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	}))
+}
+
+// WithPrincipal returns a context carrying the authenticated caller
+func WithPrincipal(ctx context.Context, principal Principal) context.Context {
+	return context.WithValue(ctx, contextKey{}, principal)
+}
+
+// FromContext returns the caller authenticated by Middleware
+func FromContext(ctx context.Context) (Principal, bool) {
+	principal, ok := ctx.Value(contextKey{}).(Principal)
+	return principal, ok
+}
+
+// CanManage reports whether the caller may manage resources of owner: admins manage everything,
+// other keys only what they own. Links created without auth have no owner and are admin-only.
+func (p Principal) CanManage(owner string) bool {
+	return p.Admin || (owner != "" && owner == p.Owner)
+}
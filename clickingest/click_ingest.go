@@ -0,0 +1,189 @@
+package clickingest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"cloudflaretinyurl/config"
+	"cloudflaretinyurl/database"
+	"cloudflaretinyurl/health"
+	"cloudflaretinyurl/tracing"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// Backoff between inserts of a failed batch, doubling up to the maximum
+const (
+	minFlushBackoff = 100 * time.Millisecond
+	maxFlushBackoff = 10 * time.Second
+)
+
+var (
+	ErrBufferFull = errors.New("click buffer is full")
+	ErrNotRunning = errors.New("click ingestion is not running")
+)
+
+var (
+	events    chan database.Click
+	abandoned chan struct{} // Closed when Stop gives up waiting, workers then drop failed batches
+	wg        sync.WaitGroup
+	mu        sync.RWMutex // Held for reading while sending so Stop never closes a channel mid-send
+	running   bool
+	timeout   time.Duration
+)
+
+// Start the flushing workers
+func Start(cfg config.Clicks) error {
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if running {
+		return fmt.Errorf("click ingestion already running")
+	}
+
+	events = make(chan database.Click, cfg.BufferSize)
+	abandoned = make(chan struct{})
+	timeout = cfg.EnqueueTimeout
+	running = true
+	for i := 0; i < cfg.Workers; i++ {
+		wg.Add(1)
+		go worker(fmt.Sprintf("click ingestion %d", i), events, abandoned, cfg)
+	}
+	return nil
+}
+
+// Queue a click for batched insertion, waiting up to EnqueueTimeout when the buffer is full.
+// On error the caller still owns the click and should store it another way.
+func Enqueue(click database.Click) error {
+	mu.RLock()
+	defer mu.RUnlock()
+	if !running {
+		return ErrNotRunning
+	}
+
+	select {
+	case events <- click:
+		return nil
+	default:
+	}
+
+	// Buffer full: slow the caller down instead of growing without bound
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case events <- click:
+		return nil
+	case <-timer.C:
+		return ErrBufferFull
+	}
+}
+
+// Stop accepting clicks and block until every buffered click has been flushed or ctx is done
+func Stop(ctx context.Context) error {
+	mu.Lock()
+	if !running {
+		mu.Unlock()
+		return nil
+	}
+	running = false
+	close(events)
+	giveUp := abandoned
+	mu.Unlock()
+
+	drained := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+		log.Println("Click ingestion drained")
+		return nil
+	case <-ctx.Done():
+		close(giveUp)
+		return fmt.Errorf("click ingestion not drained: %w", ctx.Err())
+	}
+}
+
+// Collect clicks into a batch and flush it when full, on every tick, and when the buffer closes
+func worker(name string, events <-chan database.Click, abandoned <-chan struct{}, cfg config.Clicks) {
+	defer wg.Done()
+	defer health.Forget(name)
+
+	// A worker stuck in a flush stops beating
+	maxAge := max(3*cfg.FlushInterval, 30*time.Second)
+	health.Beat(name, maxAge)
+
+	batch := make([]database.Click, 0, cfg.FlushSize)
+	ticker := time.NewTicker(cfg.FlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case click, ok := <-events:
+			if !ok {
+				store(name, maxAge, batch, abandoned)
+				return
+			}
+			batch = append(batch, click)
+			if len(batch) >= cfg.FlushSize {
+				if !store(name, maxAge, batch, abandoned) {
+					return
+				}
+				batch = batch[:0]
+			}
+		case <-ticker.C:
+			health.Beat(name, maxAge)
+			if len(batch) > 0 {
+				if !store(name, maxAge, batch, abandoned) {
+					return
+				}
+				batch = batch[:0]
+			}
+		}
+	}
+}
+
+// Flush a batch until it is inserted, with exponential backoff between attempts. The worker reads
+// no clicks meanwhile, so the buffer fills up and Enqueue slows callers down or turns them to
+// synchronous inserts. Returns false when Stop gave up waiting and the batch was dropped.
+func store(name string, maxAge time.Duration, batch []database.Click, abandoned <-chan struct{}) bool {
+	backoff := minFlushBackoff
+	for attempt := 1; ; attempt++ {
+		err := flush(batch)
+		if err == nil {
+			return true
+		}
+		log.Printf("Failed to insert %d click events (attempt %d), retrying in %v: %v", len(batch), attempt, backoff, err)
+
+		select {
+		case <-time.After(backoff):
+		case <-abandoned:
+			log.Printf("Dropping %d click events not inserted before shutdown", len(batch))
+			return false
+		}
+		health.Beat(name, maxAge)
+		backoff = min(2*backoff, maxFlushBackoff)
+	}
+}
+
+// Insert a batch in one attempt
+func flush(batch []database.Click) (err error) {
+	if len(batch) == 0 {
+		return nil
+	}
+
+	// Flushes must finish even during shutdown, Stop bounds how long they are awaited
+	ctx, span := tracing.Start(context.Background(), "clickingest.flush", attribute.Int("clicks.batch_size", len(batch)))
+	defer func() { tracing.End(span, err) }()
+
+	return database.Clicks.RecordClicks(ctx, batch)
+}
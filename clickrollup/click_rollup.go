@@ -0,0 +1,81 @@
+package clickrollup
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"cloudflaretinyurl/config"
+	"cloudflaretinyurl/database"
+	"cloudflaretinyurl/health"
+	"cloudflaretinyurl/redislocks"
+)
+
+// Shared across instances, only the holder rolls up. Renewed while rolling up, so only a crashed holder lets it lapse.
+const lockKey = "lock:click_rollup"
+
+const workerName = "click rollup"
+
+var cfg = config.Default().Rollups
+
+// Initialize the roll up interval, delay, batch size and lock TTL
+func InitClickRollup(rollupConfig config.Rollups) {
+	cfg = rollupConfig
+}
+
+// Periodically roll up the clicks of past hours until ctx is done, coordinated across instances by a Redis lock
+func StartClickRollup(ctx context.Context) {
+	ticker := time.NewTicker(cfg.Interval)
+	defer ticker.Stop()
+	defer health.Forget(workerName)
+
+	for {
+		health.Beat(workerName, 3*cfg.Interval)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		lock, err := redislocks.AcquireLock(ctx, lockKey, cfg.LockTTL)
+		if err == redislocks.ErrNotAcquired {
+			continue // Another instance is rolling up
+		}
+		if err != nil {
+			log.Println("Error acquiring click rollup lock:", err)
+			continue
+		}
+
+		lock.AutoRenew(ctx)
+		_, err = RollUpClicks(ctx, lock)
+		lock.Release(context.WithoutCancel(ctx)) // Release even when stopped mid-roll up
+
+		if err != nil {
+			log.Println("Error rolling up clicks:", err)
+		}
+	}
+}
+
+// Roll up every hour that ended at least rollups.delay ago, batch by batch, and return the
+// time clicks are rolled up to. With a lock, each batch first checks that no newer holder has taken over.
+func RollUpClicks(ctx context.Context, lock *redislocks.Lock) (time.Time, error) {
+	until := time.Now().Add(-cfg.Delay)
+	for {
+		if err := ctx.Err(); err != nil {
+			return time.Time{}, err
+		}
+		if lock != nil {
+			if err := lock.Check(ctx); err != nil {
+				return time.Time{}, err
+			}
+		}
+
+		rolledUpTo, err := database.Clicks.RollUpClicks(ctx, until, cfg.BatchHours)
+		if err != nil {
+			return rolledUpTo, err
+		}
+		if !rolledUpTo.Before(until.Truncate(time.Hour)) {
+			return rolledUpTo, nil
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package clientip
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net"
+	"net/http"
+	"strings"
+
+	"cloudflaretinyurl/config"
+)
+
+// Privacy modes of stored click IPs
+const (
+	PrivacyFull     = "full"     // Stored as received
+	PrivacyTruncate = "truncate" // Host bits zeroed: IPv4 to /24, IPv6 to /48
+	PrivacyHash     = "hash"     // Keyed hash, clicks of one IP still group together
+	PrivacyNone     = "none"     // Not stored
+)
+
+// Prefix lengths kept by the truncate mode
+const (
+	truncateBitsV4 = 24
+	truncateBitsV6 = 48
+)
+
+// Hex characters of the keyed hash stored by the hash mode
+const hashLength = 32
+
+var (
+	cfg     = config.Default().ClientIP
+	trusted = parseNetworks(cfg.TrustedProxies)
+)
+
+// Initialize the trusted proxies and the privacy mode, the config is validated beforehand
+func InitClientIP(clientIPConfig config.ClientIP) {
+	cfg = clientIPConfig
+	trusted = parseNetworks(cfg.TrustedProxies)
+}
+
+// Comma-separated IPs and CIDRs, single IPs become /32 or /128 networks
+func parseNetworks(list string) []*net.IPNet {
+	var networks []*net.IPNet
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				continue
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		if _, network, err := net.ParseCIDR(entry); err == nil {
+			networks = append(networks, network)
+		}
+	}
+	return networks
+}
+
+func isTrusted(ip net.IP) bool {
+	for _, network := range trusted {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// FromRequest returns the client IP of a request. Connections from a trusted proxy are attributed to the
+// nearest X-Forwarded-For hop that is not a trusted proxy itself, so clients cannot spoof it by sending
+// their own header. Without trusted proxies X-Forwarded-For is ignored.
+func FromRequest(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return host
+	}
+
+	if isTrusted(ip) {
+		hops := forwardedFor(r)
+		for i := len(hops) - 1; i >= 0; i-- {
+			hop := parseHop(hops[i])
+			if hop == nil {
+				break // Anything further left was written by someone we cannot vouch for
+			}
+			ip = hop
+			if !isTrusted(hop) {
+				break
+			}
+		}
+	}
+	return ip.String()
+}
+
+// Every X-Forwarded-For entry, leftmost (the original client) first
+func forwardedFor(r *http.Request) []string {
+	var hops []string
+	for _, header := range r.Header.Values("X-Forwarded-For") {
+		for _, hop := range strings.Split(header, ",") {
+			hops = append(hops, strings.TrimSpace(hop))
+		}
+	}
+	return hops
+}
+
+// An X-Forwarded-For entry, some proxies append the port
+func parseHop(hop string) net.IP {
+	if ip := net.ParseIP(hop); ip != nil {
+		return ip
+	}
+	if host, _, err := net.SplitHostPort(hop); err == nil {
+		return net.ParseIP(host)
+	}
+	return nil
+}
+
+// Anonymize returns the form of a client IP that is stored with its clicks under the privacy mode,
+// empty when IPs are not stored
+func Anonymize(ip string) string {
+	parsed := net.ParseIP(ip)
+	if parsed == nil || cfg.Privacy == PrivacyNone {
+		return ""
+	}
+
+	switch cfg.Privacy {
+	case PrivacyTruncate:
+		if v4 := parsed.To4(); v4 != nil {
+			return v4.Mask(net.CIDRMask(truncateBitsV4, 8*net.IPv4len)).String()
+		}
+		return parsed.Mask(net.CIDRMask(truncateBitsV6, 8*net.IPv6len)).String()
+	case PrivacyHash:
+		mac := hmac.New(sha256.New, []byte(cfg.HashKey))
+		mac.Write([]byte(parsed.String()))
+		return hex.EncodeToString(mac.Sum(nil))[:hashLength]
+	}
+	return parsed.String()
+}
@@ -0,0 +1,343 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Config holds every setting of the service. Each leaf field is named by its yaml path and
+// can be overridden by the environment variable in its env tag and the flag in its flag tag.
+type Config struct {
+	Server    Server    `yaml:"server"`
+	Storage   Storage   `yaml:"storage"`
+	Postgres  Postgres  `yaml:"postgres"`
+	Redis     Redis     `yaml:"redis"`
+	Cache     Cache     `yaml:"cache"`
+	IDs       IDs       `yaml:"ids"`
+	Clicks    Clicks    `yaml:"clicks"`
+	Queue     Queue     `yaml:"queue"`
+	Sweeper   Sweeper   `yaml:"sweeper"`
+	Health    Health    `yaml:"health"`
+	Tracing   Tracing   `yaml:"tracing"`
+	Auth      Auth      `yaml:"auth"`
+	RateLimit RateLimit `yaml:"rate_limit"`
+	URLPolicy URLPolicy `yaml:"url_policy"`
+	Screening Screening `yaml:"screening"`
+	Dedup     Dedup     `yaml:"dedup"`
+	ClientIP  ClientIP  `yaml:"client_ip"`
+	GeoIP     GeoIP     `yaml:"geoip"`
+	Rollups   Rollups   `yaml:"rollups"`
+}
+
+type Server struct {
+	Addr            string        `yaml:"addr" env:"SERVER_ADDR" flag:"addr"`
+	BaseURL         string        `yaml:"base_url" env:"BASE_URL" flag:"base-url"` // Prefix of returned short URLs
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout" env:"SHUTDOWN_TIMEOUT" flag:"shutdown-timeout"`
+}
+
+type Storage struct {
+	Backend string `yaml:"backend" env:"STORAGE_BACKEND" flag:"storage-backend"` // postgres or memory
+}
+
+type Postgres struct {
+	URL string `yaml:"url" env:"DATABASE_URL" flag:"database-url" secret:"true"`
+}
+
+type Redis struct {
+	Addr     string `yaml:"addr" env:"REDIS_URL" flag:"redis-addr"`
+	Password string `yaml:"password" env:"REDIS_PASSWORD" flag:"redis-password" secret:"true"`
+	DB       int    `yaml:"db" env:"REDIS_DB" flag:"redis-db"`
+}
+
+type Cache struct {
+	MaxTTL time.Duration `yaml:"max_ttl" env:"CACHE_MAX_TTL" flag:"cache-max-ttl"` // Links expiring sooner are cached until their expiry
+}
+
+type IDs struct {
+	CounterOffset   int64 `yaml:"counter_offset" env:"COUNTER_OFFSET" flag:"counter-offset"`          // Added to the global counter before base62 encoding
+	SnowflakeNodeID int64 `yaml:"snowflake_node_id" env:"SNOWFLAKE_NODE_ID" flag:"snowflake-node-id"` // -1 leases a node ID from Redis
+}
+
+type Clicks struct {
+	BufferSize     int           `yaml:"buffer_size" env:"CLICK_BUFFER_SIZE" flag:"click-buffer-size"`             // Clicks held in memory before Enqueue applies backpressure
+	FlushSize      int           `yaml:"flush_size" env:"CLICK_FLUSH_SIZE" flag:"click-flush-size"`                // A worker flushes once its batch reaches this many clicks
+	FlushInterval  time.Duration `yaml:"flush_interval" env:"CLICK_FLUSH_INTERVAL" flag:"click-flush-interval"`    // ... or once this much time has passed
+	Workers        int           `yaml:"workers" env:"CLICK_WORKERS" flag:"click-workers"`                         // Concurrent flushing workers
+	EnqueueTimeout time.Duration `yaml:"enqueue_timeout" env:"CLICK_ENQUEUE_TIMEOUT" flag:"click-enqueue-timeout"` // How long Enqueue waits for room in a full buffer
+}
+
+type Queue struct {
+	LockTTL     time.Duration `yaml:"lock_ttl" env:"QUEUE_LOCK_TTL" flag:"queue-lock-ttl"` // Per-event lock while decrementing counters
+	MaxAttempts int           `yaml:"max_attempts" env:"QUEUE_MAX_ATTEMPTS" flag:"queue-max-attempts"`
+}
+
+type Sweeper struct {
+	Interval  time.Duration `yaml:"interval" env:"SWEEP_INTERVAL" flag:"sweep-interval"`
+	BatchSize int           `yaml:"batch_size" env:"SWEEP_BATCH_SIZE" flag:"sweep-batch-size"`
+	LockTTL   time.Duration `yaml:"lock_ttl" env:"SWEEP_LOCK_TTL" flag:"sweep-lock-ttl"`
+}
+
+type Health struct {
+	CheckTimeout time.Duration `yaml:"check_timeout" env:"HEALTH_CHECK_TIMEOUT" flag:"health-check-timeout"` // Per readiness check
+}
+
+type Tracing struct {
+	Exporter     string  `yaml:"exporter" env:"TRACING_EXPORTER" flag:"tracing-exporter"`                // none, otlp or file
+	OTLPEndpoint string  `yaml:"otlp_endpoint" env:"TRACING_OTLP_ENDPOINT" flag:"tracing-otlp-endpoint"` // host:port of an OTLP/HTTP collector
+	OTLPInsecure bool    `yaml:"otlp_insecure" env:"TRACING_OTLP_INSECURE" flag:"tracing-otlp-insecure"` // Plain HTTP instead of HTTPS
+	File         string  `yaml:"file" env:"TRACING_FILE" flag:"tracing-file"`                            // Spans appended as JSON, for offline testing
+	SampleRatio  float64 `yaml:"sample_ratio" env:"TRACING_SAMPLE_RATIO" flag:"tracing-sample-ratio"`    // Of new traces, incoming traceparent decides otherwise
+	ServiceName  string  `yaml:"service_name" env:"TRACING_SERVICE_NAME" flag:"tracing-service-name"`
+}
+
+type Auth struct {
+	Enabled  bool   `yaml:"enabled" env:"AUTH_ENABLED" flag:"auth-enabled"`                   // Require API keys to create, delete and read stats of links
+	AdminKey string `yaml:"admin_key" env:"ADMIN_API_KEY" flag:"admin-api-key" secret:"true"` // Stored as an admin key at startup, to create the first keys
+}
+
+// Rates are requests per second refilling a bucket of Burst requests, a zero rate disables the policy
+type RateLimit struct {
+	Enabled        bool    `yaml:"enabled" env:"RATE_LIMIT_ENABLED" flag:"rate-limit-enabled"`
+	APIKeyRate     float64 `yaml:"api_key_rate" env:"RATE_LIMIT_API_KEY_RATE" flag:"rate-limit-api-key-rate"` // Link creations per API key
+	APIKeyBurst    int     `yaml:"api_key_burst" env:"RATE_LIMIT_API_KEY_BURST" flag:"rate-limit-api-key-burst"`
+	IPRate         float64 `yaml:"ip_rate" env:"RATE_LIMIT_IP_RATE" flag:"rate-limit-ip-rate"` // Creations and redirects per client IP
+	IPBurst        int     `yaml:"ip_burst" env:"RATE_LIMIT_IP_BURST" flag:"rate-limit-ip-burst"`
+	ShortCodeRate  float64 `yaml:"short_code_rate" env:"RATE_LIMIT_SHORT_CODE_RATE" flag:"rate-limit-short-code-rate"` // Redirects per short code
+	ShortCodeBurst int     `yaml:"short_code_burst" env:"RATE_LIMIT_SHORT_CODE_BURST" flag:"rate-limit-short-code-burst"`
+}
+
+type URLPolicy struct {
+	AllowedSchemes string `yaml:"allowed_schemes" env:"URL_ALLOWED_SCHEMES" flag:"url-allowed-schemes"` // Comma-separated
+	MaxLength      int    `yaml:"max_length" env:"URL_MAX_LENGTH" flag:"url-max-length"`
+	StripFragment  bool   `yaml:"strip_fragment" env:"URL_STRIP_FRAGMENT" flag:"url-strip-fragment"` // Drop #fragments, browsers keep them across redirects
+}
+
+type Screening struct {
+	ListsDir       string        `yaml:"lists_dir" env:"SCREENING_LISTS_DIR" flag:"screening-lists-dir"` // Blocklist files, empty disables screening
+	ReloadInterval time.Duration `yaml:"reload_interval" env:"SCREENING_RELOAD_INTERVAL" flag:"screening-reload-interval"`
+	Action         string        `yaml:"action" env:"SCREENING_ACTION" flag:"screening-action"` // For listed links on redirect: flag or disable
+}
+
+type Dedup struct {
+	Scope string `yaml:"scope" env:"DEDUP_SCOPE" flag:"dedup-scope"` // Return the existing short URL for a long URL: global, owner (per API key owner) or off
+}
+
+type ClientIP struct {
+	TrustedProxies string `yaml:"trusted_proxies" env:"TRUSTED_PROXIES" flag:"trusted-proxies"` // Comma-separated IPs or CIDRs whose X-Forwarded-For is believed
+	Privacy        string `yaml:"privacy" env:"IP_PRIVACY" flag:"ip-privacy"`                   // How click IPs are stored: full, truncate (/24 and /48), hash or none
+	HashKey        string `yaml:"hash_key" env:"IP_HASH_KEY" flag:"ip-hash-key" secret:"true"`  // HMAC key of the hash privacy mode
+}
+
+// Both databases are MaxMind DB (.mmdb) files, re-read on SIGHUP
+type GeoIP struct {
+	Database    string `yaml:"database" env:"GEOIP_DATABASE" flag:"geoip-database"`             // City or country database (GeoIP2/GeoLite2 or compatible)
+	ASNDatabase string `yaml:"asn_database" env:"GEOIP_ASN_DATABASE" flag:"geoip-asn-database"` // ASN database, with neither set clicks are not geolocated
+	CacheSize   int    `yaml:"cache_size" env:"GEOIP_CACHE_SIZE" flag:"geoip-cache-size"`       // Looked up IPs kept in memory
+}
+
+// Hourly click rollups answer time series over whole hours without scanning url_clicks
+type Rollups struct {
+	Interval   time.Duration `yaml:"interval" env:"ROLLUP_INTERVAL" flag:"rollup-interval"`
+	Delay      time.Duration `yaml:"delay" env:"ROLLUP_DELAY" flag:"rollup-delay"`                   // Hours are rolled up once they ended this long ago, clicks stored later are left out
+	BatchHours int           `yaml:"batch_hours" env:"ROLLUP_BATCH_HOURS" flag:"rollup-batch-hours"` // Hours rolled up per transaction while catching up
+	LockTTL    time.Duration `yaml:"lock_ttl" env:"ROLLUP_LOCK_TTL" flag:"rollup-lock-ttl"`
+}
+
+// Shortest accepted bootstrap admin key, generated keys are much longer
+const minAPIKeyLength = 16
+
+// Shortest accepted HMAC key for hashed click IPs
+const minHashKeyLength = 16
+
+// RFC 3986 scheme syntax
+var schemePattern = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9+.-]*$`)
+
+// Snowflake supports 10-bit node IDs
+const maxNodeID = 1023
+
+// Default returns the settings used when neither a file, the environment nor flags override them
+func Default() Config {
+	return Config{
+		Server: Server{
+			Addr:            ":8080",
+			BaseURL:         "http://localhost:8080/api/v1/",
+			ShutdownTimeout: 20 * time.Second,
+		},
+		Storage: Storage{Backend: "postgres"},
+		Redis:   Redis{Addr: "cloudflaretinyurl_redis:6379"},
+		Cache:   Cache{MaxTTL: 24 * time.Hour},
+		IDs:     IDs{CounterOffset: 10000, SnowflakeNodeID: -1},
+		Clicks: Clicks{
+			BufferSize:     10000,
+			FlushSize:      500,
+			FlushInterval:  time.Second,
+			Workers:        4,
+			EnqueueTimeout: 50 * time.Millisecond,
+		},
+		Queue:   Queue{LockTTL: 2 * time.Second, MaxAttempts: 5},
+		Sweeper: Sweeper{Interval: time.Minute, BatchSize: 500, LockTTL: 30 * time.Second},
+		Health:  Health{CheckTimeout: 2 * time.Second},
+		Tracing: Tracing{
+			Exporter:     "none",
+			OTLPEndpoint: "localhost:4318",
+			File:         "traces.jsonl",
+			SampleRatio:  1,
+			ServiceName:  "cloudflaretinyurl",
+		},
+		Auth: Auth{Enabled: true},
+		RateLimit: RateLimit{
+			Enabled:        true,
+			APIKeyRate:     10,
+			APIKeyBurst:    100,
+			IPRate:         50,
+			IPBurst:        200,
+			ShortCodeRate:  500,
+			ShortCodeBurst: 1000,
+		},
+		URLPolicy: URLPolicy{AllowedSchemes: "http,https", MaxLength: 2048},
+		Screening: Screening{ReloadInterval: 30 * time.Second, Action: "flag"},
+		Dedup:     Dedup{Scope: "global"},
+		ClientIP:  ClientIP{Privacy: "truncate"},
+		GeoIP:     GeoIP{CacheSize: 10000},
+		Rollups:   Rollups{Interval: time.Minute, Delay: 5 * time.Minute, BatchHours: 24, LockTTL: 30 * time.Second},
+	}
+}
+
+// Validate rejects settings the service cannot run with, reporting every problem at once
+func (c Config) Validate() error {
+	var problems []string
+	check := func(ok bool, format string, args ...any) {
+		if !ok {
+			problems = append(problems, fmt.Sprintf(format, args...))
+		}
+	}
+
+	check(c.Server.Addr != "", "server.addr must be set")
+	base, err := url.Parse(c.Server.BaseURL)
+	check(err == nil && (base.Scheme == "http" || base.Scheme == "https") && base.Host != "" && strings.HasSuffix(base.Path, "/"),
+		"server.base_url must be an http(s) URL ending in /")
+	check(c.Server.ShutdownTimeout > 0, "server.shutdown_timeout must be positive")
+
+	check(c.Storage.Backend == "postgres" || c.Storage.Backend == "memory", "storage.backend must be postgres or memory")
+	if c.Storage.Backend == "postgres" {
+		check(c.Postgres.URL != "", "postgres.url must be set (DATABASE_URL)")
+		check(c.Redis.Addr != "", "redis.addr must be set")
+	}
+	check(c.Redis.DB >= 0, "redis.db must not be negative")
+
+	check(c.Cache.MaxTTL > 0, "cache.max_ttl must be positive")
+	check(c.IDs.CounterOffset >= 0, "ids.counter_offset must not be negative")
+	check(c.IDs.SnowflakeNodeID >= -1 && c.IDs.SnowflakeNodeID <= maxNodeID, "ids.snowflake_node_id must be between 0 and %d, or -1 to lease one", maxNodeID)
+
+	if err := c.Clicks.Validate(); err != nil {
+		problems = append(problems, err.Error())
+	}
+
+	check(c.Queue.LockTTL > 0, "queue.lock_ttl must be positive")
+	check(c.Queue.MaxAttempts > 0, "queue.max_attempts must be positive")
+	check(c.Sweeper.Interval > 0, "sweeper.interval must be positive")
+	check(c.Sweeper.BatchSize > 0, "sweeper.batch_size must be positive")
+	check(c.Sweeper.LockTTL > 0, "sweeper.lock_ttl must be positive")
+	check(c.Health.CheckTimeout > 0, "health.check_timeout must be positive")
+
+	switch c.Tracing.Exporter {
+	case "none":
+	case "otlp":
+		check(c.Tracing.OTLPEndpoint != "", "tracing.otlp_endpoint must be set for the otlp exporter")
+	case "file":
+		check(c.Tracing.File != "", "tracing.file must be set for the file exporter")
+	default:
+		check(false, "tracing.exporter must be none, otlp or file")
+	}
+	check(c.Tracing.SampleRatio >= 0 && c.Tracing.SampleRatio <= 1, "tracing.sample_ratio must be between 0 and 1")
+	check(c.Tracing.ServiceName != "", "tracing.service_name must be set")
+	for _, policy := range []struct {
+		name  string
+		rate  float64
+		burst int
+	}{
+		{"api_key", c.RateLimit.APIKeyRate, c.RateLimit.APIKeyBurst},
+		{"ip", c.RateLimit.IPRate, c.RateLimit.IPBurst},
+		{"short_code", c.RateLimit.ShortCodeRate, c.RateLimit.ShortCodeBurst},
+	} {
+		check(policy.rate >= 0, "rate_limit.%s_rate must not be negative", policy.name)
+		check(policy.rate == 0 || policy.burst >= 1, "rate_limit.%s_burst must be positive", policy.name)
+	}
+	check(c.URLPolicy.MaxLength > 0, "url_policy.max_length must be positive")
+	check(strings.Trim(c.URLPolicy.AllowedSchemes, ", ") != "", "url_policy.allowed_schemes must list at least one scheme")
+	for _, scheme := range strings.Split(c.URLPolicy.AllowedSchemes, ",") {
+		scheme = strings.TrimSpace(scheme)
+		check(scheme == "" || schemePattern.MatchString(scheme), "url_policy.allowed_schemes has invalid scheme %q", scheme)
+	}
+	check(c.Screening.ReloadInterval > 0, "screening.reload_interval must be positive")
+	check(c.Screening.Action == "flag" || c.Screening.Action == "disable", "screening.action must be flag or disable")
+	check(c.Dedup.Scope == "global" || c.Dedup.Scope == "owner" || c.Dedup.Scope == "off", "dedup.scope must be global, owner or off")
+	for _, proxy := range strings.Split(c.ClientIP.TrustedProxies, ",") {
+		proxy = strings.TrimSpace(proxy)
+		_, _, cidrErr := net.ParseCIDR(proxy)
+		check(proxy == "" || cidrErr == nil || net.ParseIP(proxy) != nil, "client_ip.trusted_proxies has invalid IP or CIDR %q", proxy)
+	}
+	switch c.ClientIP.Privacy {
+	case "full", "truncate", "none":
+	case "hash":
+		check(len(c.ClientIP.HashKey) >= minHashKeyLength, "client_ip.hash_key must be at least %d characters for the hash privacy mode", minHashKeyLength)
+	default:
+		check(false, "client_ip.privacy must be full, truncate, hash or none")
+	}
+	check(c.GeoIP.CacheSize > 0, "geoip.cache_size must be positive")
+	check(c.Rollups.Interval > 0, "rollups.interval must be positive")
+	check(c.Rollups.Delay >= 0, "rollups.delay must not be negative")
+	check(c.Rollups.BatchHours > 0, "rollups.batch_hours must be positive")
+	check(c.Rollups.LockTTL > 0, "rollups.lock_ttl must be positive")
+	check(c.Auth.AdminKey == "" || len(c.Auth.AdminKey) >= minAPIKeyLength, "auth.admin_key must be at least %d characters", minAPIKeyLength)
+
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid config: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// Validate rejects click ingestion settings the pipeline cannot run with
+func (c Clicks) Validate() error {
+	switch {
+	case c.BufferSize < 1:
+		return fmt.Errorf("clicks.buffer_size must be positive")
+	case c.FlushSize < 1:
+		return fmt.Errorf("clicks.flush_size must be positive")
+	case c.FlushInterval <= 0:
+		return fmt.Errorf("clicks.flush_interval must be positive")
+	case c.Workers < 1:
+		return fmt.Errorf("clicks.workers must be positive")
+	case c.EnqueueTimeout < 0:
+		return fmt.Errorf("clicks.enqueue_timeout must not be negative")
+	}
+	return nil
+}
+
+// String lists the effective settings one per line, with secrets redacted
+func (c Config) String() string {
+	var b strings.Builder
+	for _, f := range fields(&c) {
+		value := f.String()
+		if f.secret {
+			value = Redact(value)
+		}
+		fmt.Fprintf(&b, "%s = %s\n", f.path, value)
+	}
+	return b.String()
+}
+
+// Redact keeps a URL readable but hides its password, any other secret is hidden entirely
+func Redact(value string) string {
+	if value == "" {
+		return value
+	}
+	if u, err := url.Parse(value); err == nil && u.Scheme != "" && u.Host != "" {
+		return u.Redacted()
+	}
+	return "[REDACTED]"
+}
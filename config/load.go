@@ -0,0 +1,167 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Load builds the effective config from, in increasing precedence: defaults, the YAML file
+// named by -config or CONFIG_FILE, environment variables and command-line flags.
+// The result is validated.
+func Load(args []string) (Config, error) {
+	cfg := Default()
+	leaves := fields(&cfg)
+
+	// Flags are applied last but parsed first, since -config names the file to read
+	fs := flag.NewFlagSet("cloudflaretinyurl", flag.ContinueOnError)
+	configFile := fs.String("config", os.Getenv("CONFIG_FILE"), "YAML config file (env CONFIG_FILE)")
+	flagValues := map[string]string{}
+	for _, f := range leaves {
+		name := f.flag
+		record := func(value string) error {
+			flagValues[name] = value
+			return nil
+		}
+		usage := fmt.Sprintf("%s (env %s)", f.path, f.env)
+		if f.value.Kind() == reflect.Bool {
+			fs.BoolFunc(name, usage, record) // -name alone means true
+		} else {
+			fs.Func(name, usage, record)
+		}
+	}
+	if err := fs.Parse(args); err != nil {
+		return cfg, err
+	}
+	if fs.NArg() > 0 {
+		return cfg, fmt.Errorf("unexpected arguments: %v", fs.Args())
+	}
+
+	if *configFile != "" {
+		if err := loadFile(&cfg, *configFile); err != nil {
+			return cfg, err
+		}
+	}
+
+	for _, f := range leaves {
+		if value, ok := os.LookupEnv(f.env); ok && value != "" {
+			if err := f.Set(value); err != nil {
+				return cfg, fmt.Errorf("%s: %w", f.env, err)
+			}
+		}
+	}
+
+	for _, f := range leaves {
+		if value, ok := flagValues[f.flag]; ok {
+			if err := f.Set(value); err != nil {
+				return cfg, fmt.Errorf("-%s: %w", f.flag, err)
+			}
+		}
+	}
+
+	return cfg, cfg.Validate()
+}
+
+// Overlay the settings present in a YAML file, rejecting unknown keys so typos do not go unnoticed
+func loadFile(cfg *Config, path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("reading config file: %w", err)
+	}
+
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(cfg); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("parsing config file %s: %w", path, err)
+	}
+	return nil
+}
+
+// field is one leaf setting, addressable so it can be overridden
+type field struct {
+	path   string // Dotted yaml path, e.g. server.addr
+	env    string
+	flag   string
+	secret bool
+	value  reflect.Value
+}
+
+// Collect the leaf settings of cfg in declaration order
+func fields(cfg *Config) []field {
+	var out []field
+	var walk func(v reflect.Value, prefix string)
+	walk = func(v reflect.Value, prefix string) {
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			sf := t.Field(i)
+			path := prefix + sf.Tag.Get("yaml")
+			if sf.Type.Kind() == reflect.Struct {
+				walk(v.Field(i), path+".")
+				continue
+			}
+			out = append(out, field{
+				path:   path,
+				env:    sf.Tag.Get("env"),
+				flag:   sf.Tag.Get("flag"),
+				secret: sf.Tag.Get("secret") == "true",
+				value:  v.Field(i),
+			})
+		}
+	}
+	walk(reflect.ValueOf(cfg).Elem(), "")
+	return out
+}
+
+// Set parses value into the field according to its type
+func (f field) Set(value string) error {
+	if f.value.Type() == reflect.TypeOf(time.Duration(0)) {
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		f.value.SetInt(int64(d))
+		return nil
+	}
+
+	switch f.value.Kind() {
+	case reflect.String:
+		f.value.SetString(value)
+	case reflect.Int, reflect.Int64:
+		n, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid integer %q", value)
+		}
+		f.value.SetInt(n)
+	case reflect.Float64:
+		n, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+		if err != nil {
+			return fmt.Errorf("invalid number %q", value)
+		}
+		f.value.SetFloat(n)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("invalid boolean %q", value)
+		}
+		f.value.SetBool(b)
+	default:
+		return fmt.Errorf("unsupported setting type %s", f.value.Type())
+	}
+	return nil
+}
+
+func (f field) String() string {
+	if d, ok := f.value.Interface().(time.Duration); ok {
+		return d.String()
+	}
+	return fmt.Sprint(f.value.Interface())
+}
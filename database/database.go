@@ -3,12 +3,16 @@ package database
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"log"
-	"os"
-	"time"
 
+	"cloudflaretinyurl/config"
+
+	"github.com/XSAM/otelsql"
 	_ "github.com/lib/pq"
+	"github.com/redis/go-redis/extra/redisotel/v9"
 	"github.com/redis/go-redis/v9"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
 )
 
 var (
@@ -17,114 +21,71 @@ var (
 )
 
 // Initialize Database Connections
-func InitDB() error {
-	postgresURL := os.Getenv("DATABASE_URL")
-	if postgresURL == "" {
-		log.Fatal("DATABASE_URL environment variable is not set")
-	}
-
-	log.Println("Connecting to PostgreSQL at:", postgresURL)
+func InitDB(ctx context.Context, pgConfig config.Postgres, redisConfig config.Redis, cacheConfig config.Cache) error {
+	log.Println("Connecting to PostgreSQL at:", config.Redact(pgConfig.URL))
 
+	// Every query, exec and transaction becomes a span under the caller's context
 	var err error
-	DB, err = sql.Open("postgres", postgresURL)
+	DB, err = otelsql.Open("postgres", pgConfig.URL, otelsql.WithAttributes(semconv.DBSystemPostgreSQL))
 	if err != nil {
 		log.Fatalf("Failed to open PostgreSQL connection: %v", err)
 	}
 
 	// Verify Database Connection
-	// err = DB.Ping()
-	// if err != nil {
-	// 	log.Fatalf("Failed to ping PostgreSQL: %v", err)
-	// }
-	// log.Println("✅ Connected to PostgreSQL successfully!")
+	if err := PingDB(ctx); err != nil {
+		log.Fatalf("Failed to ping PostgreSQL: %v", err)
+	}
+	log.Println("✅ Connected to PostgreSQL successfully!")
 
 	// Initialize Redis
-	redisURL := os.Getenv("REDIS_URL")
-	if redisURL == "" {
-		redisURL = "cloudflaretinyurl_redis:6379"
+	RDB = redis.NewClient(&redis.Options{
+		Addr:     redisConfig.Addr,
+		Password: redisConfig.Password,
+		DB:       redisConfig.DB,
+	})
+	// Every command and pipeline becomes a span under the caller's context
+	if err := redisotel.InstrumentTracing(RDB); err != nil {
+		log.Fatalf("Failed to instrument Redis tracing: %v", err)
 	}
-
-	RDB = redis.NewClient(&redis.Options{Addr: redisURL})
-	if _, err := RDB.Ping(context.Background()).Result(); err != nil {
+	if err := PingRedis(ctx); err != nil {
 		log.Fatalf("Failed to connect to Redis: %v", err)
 	}
 	log.Println("✅ Connected to Redis successfully!")
 
-	return nil
-}
+	store := &pgStore{db: DB, rdb: RDB, cfg: cacheConfig}
+	URLs, Clicks, URLCache, Keys = store, store, store, store
 
-// Generate Global Counter for Unique Short URLs
-func IncrementGlobalCounter() (int64, error) {
-	return RDB.Incr(context.Background(), "url_global_counter").Result()
+	return nil
 }
 
-func StoreURL(shortURL, longURL string, expiresAt *time.Time) error {
-	_, err := DB.Exec("INSERT INTO urls (short_url, long_url, created_at, expires_at) VALUES ($1, $2, NOW(), $3)",
-		shortURL, longURL, expiresAt)
-	if err != nil {
-		log.Printf("Database insertion error: %v", err)
+// PingDB checks that PostgreSQL answers, for startup and readiness
+func PingDB(ctx context.Context) error {
+	if DB == nil {
+		return errors.New("PostgreSQL is not initialized")
 	}
-	return err
-}
-
-// Fetch URL from PostgreSQL
-func GetURL(shortURL string) (string, error) {
-	var longURL string
-	err := DB.QueryRow("SELECT long_url FROM urls WHERE short_url=$1", shortURL).Scan(&longURL)
-	return longURL, err
-}
-
-// Cache URL in Redis
-func CacheURL(shortURL, longURL string) {
-	RDB.Set(context.Background(), shortURL, longURL, 24*time.Hour)
-}
-
-// Fetch URL from Redis
-func GetCachedURL(shortURL string) (string, error) {
-	return RDB.Get(context.Background(), shortURL).Result()
+	return DB.PingContext(ctx)
 }
 
-// Get click counts from PostgreSQL
-func GetClickCounts(shortURL string) (int, int, int, error) {
-	var allTime, last24h, lastWeek int
-
-	// Get all-time clicks
-	err := DB.QueryRow("SELECT COUNT(*) FROM url_clicks WHERE short_url=$1", shortURL).Scan(&allTime)
-	if err != nil {
-		return 0, 0, 0, err
-	}
-
-	// Get last 24 hours clicks
-	err = DB.QueryRow("SELECT COUNT(*) FROM url_clicks WHERE short_url=$1 AND accessed_at >= NOW() - INTERVAL '24 hours'", shortURL).Scan(&last24h)
-	if err != nil {
-		return 0, 0, 0, err
-	}
-
-	// Get last week clicks
-	err = DB.QueryRow("SELECT COUNT(*) FROM url_clicks WHERE short_url=$1 AND accessed_at >= NOW() - INTERVAL '7 days'", shortURL).Scan(&lastWeek)
-	if err != nil {
-		return 0, 0, 0, err
+// PingRedis checks that Redis answers, for startup and readiness
+func PingRedis(ctx context.Context) error {
+	if RDB == nil {
+		return errors.New("Redis is not initialized")
 	}
-
-	return allTime, last24h, lastWeek, nil
+	return RDB.Ping(ctx).Err()
 }
 
-// GetShortURLByLongURL checks if a long URL already exists and returns its short URL & expiry date
-func GetShortURLByLongURL(longURL string) (string, *time.Time, error) {
-	var shortURL string
-	var expiresAt sql.NullTime
-
-	err := DB.QueryRow("SELECT short_url, expires_at FROM urls WHERE long_url = $1", longURL).
-		Scan(&shortURL, &expiresAt)
-
-	if err != nil {
-		return "", nil, err
+// Close PostgreSQL connections, once nothing writes to the database anymore
+func CloseDB() error {
+	if DB == nil {
+		return nil
 	}
+	return DB.Close()
+}
 
-	// Convert sql.NullTime to *time.Time
-	if expiresAt.Valid {
-		return shortURL, &expiresAt.Time, nil
+// Close Redis connections, last because locks and leases are released through them
+func CloseRedis() error {
+	if RDB == nil {
+		return nil
 	}
-
-	return shortURL, nil, nil
+	return RDB.Close()
 }
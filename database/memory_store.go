@@ -0,0 +1,566 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"cloudflaretinyurl/config"
+	"cloudflaretinyurl/utils"
+)
+
+// memoryStore keeps everything in process memory, for unit tests and local development
+type memoryStore struct {
+	mu      sync.RWMutex
+	cfg     config.Cache
+	counter int64
+	urls    map[string]memoryURL
+	byDedup map[string]string  // Dedup key to short URL
+	clicks  map[string][]Click // Ascending by AccessedAt
+	cache   map[string]memoryCacheEntry
+	hits    map[counterKey][]time.Time
+	allTime map[counterKey]int
+
+	archivedURLs   []memoryURL
+	archivedClicks map[string][]Click
+
+	keys      []memoryAPIKey
+	keyByHash map[string]int // Index into keys
+
+	revisions map[string][]URLRevision
+}
+
+// Rolling counters are kept apart for bots and other clicks
+type counterKey struct {
+	shortURL string
+	bot      bool
+}
+
+type memoryURL struct {
+	shortURL   string
+	longURL    string
+	createdAt  time.Time
+	expiresAt  *time.Time
+	owner      string
+	dedupKey   string
+	disabled   bool
+	flagged    bool
+	flagReason string
+	revision   int
+}
+
+type memoryAPIKey struct {
+	APIKey
+	hash string
+}
+
+type memoryCacheEntry struct {
+	mapping    URLMapping
+	deleted    bool // Tombstone of a deleted link
+	cachedTill time.Time
+}
+
+// InitMemory selects the in-memory backend, no PostgreSQL or Redis required
+func InitMemory(cacheConfig config.Cache) {
+	store := newMemoryStore(cacheConfig)
+	URLs, Clicks, URLCache, Keys = store, store, store, store
+}
+
+func newMemoryStore(cacheConfig config.Cache) *memoryStore {
+	return &memoryStore{
+		cfg:     cacheConfig,
+		urls:    make(map[string]memoryURL),
+		byDedup: make(map[string]string),
+		clicks:  make(map[string][]Click),
+		cache:   make(map[string]memoryCacheEntry),
+		hits:    make(map[counterKey][]time.Time),
+		allTime: make(map[counterKey]int),
+
+		archivedClicks: make(map[string][]Click),
+		keyByHash:      make(map[string]int),
+		revisions:      make(map[string][]URLRevision),
+	}
+}
+
+func (s *memoryStore) IncrementGlobalCounter(ctx context.Context) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.counter++
+	return s.counter, nil
+}
+
+func (s *memoryStore) StoreURL(ctx context.Context, u URLRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Mirror the dedup_key index and PRIMARY KEY of the urls table
+	if existing, ok := s.byDedup[u.DedupKey]; ok && u.DedupKey != "" {
+		if live(s.urls[existing], time.Now()) {
+			return &DuplicateError{ShortURL: existing, ExpiresAt: s.urls[existing].expiresAt}
+		}
+		delete(s.byDedup, u.DedupKey)
+	}
+	if _, exists := s.urls[u.ShortURL]; exists {
+		return ErrShortURLExists
+	}
+
+	s.urls[u.ShortURL] = memoryURL{shortURL: u.ShortURL, longURL: u.LongURL, createdAt: time.Now(), expiresAt: u.ExpiresAt, owner: u.Owner, dedupKey: u.DedupKey, revision: 1}
+	if u.DedupKey != "" {
+		s.byDedup[u.DedupKey] = u.ShortURL
+	}
+	s.revisions[u.ShortURL] = []URLRevision{{Revision: 1, LongURL: u.LongURL, ExpiresAt: u.ExpiresAt, Enabled: true, ChangedBy: u.Owner, ChangedAt: time.Now()}}
+	return nil
+}
+
+func live(u memoryURL, now time.Time) bool {
+	return u.expiresAt == nil || u.expiresAt.After(now)
+}
+
+// Remove a mapping and its dedup key, if the key still points at it
+func (s *memoryStore) removeURL(u memoryURL) {
+	if s.byDedup[u.dedupKey] == u.shortURL {
+		delete(s.byDedup, u.dedupKey)
+	}
+	delete(s.urls, u.shortURL)
+	delete(s.clicks, u.shortURL)
+	delete(s.revisions, u.shortURL)
+}
+
+func (s *memoryStore) GetURL(ctx context.Context, shortURL string) (URLMapping, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	u, ok := s.urls[shortURL]
+	if !ok {
+		return URLMapping{}, sql.ErrNoRows
+	}
+	return URLMapping{LongURL: u.longURL, ExpiresAt: u.expiresAt, Disabled: u.disabled, Flagged: u.flagged, FlagReason: u.flagReason, Revision: u.revision}, nil
+}
+
+func (s *memoryStore) GetURLOwner(ctx context.Context, shortURL string) (string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	u, ok := s.urls[shortURL]
+	if !ok {
+		return "", sql.ErrNoRows
+	}
+	return u.owner, nil
+}
+
+func (s *memoryStore) GetURLRecord(ctx context.Context, shortURL string) (URLRecord, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	u, ok := s.urls[shortURL]
+	if !ok {
+		return URLRecord{}, sql.ErrNoRows
+	}
+	return URLRecord{ShortURL: shortURL, LongURL: u.longURL, Owner: u.owner, ExpiresAt: u.expiresAt, DedupKey: u.dedupKey, Disabled: u.disabled, Flagged: u.flagged, FlagReason: u.flagReason, Revision: u.revision}, nil
+}
+
+func (s *memoryStore) UpdateURL(ctx context.Context, u URLRecord, changedBy string) (URLRevision, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	current, ok := s.urls[u.ShortURL]
+	if !ok {
+		return URLRevision{}, sql.ErrNoRows
+	}
+	if current.revision != u.Revision {
+		return URLRevision{}, ErrRevisionConflict
+	}
+	if holder, ok := s.byDedup[u.DedupKey]; ok && u.DedupKey != "" && holder != u.ShortURL && live(s.urls[holder], time.Now()) {
+		return URLRevision{}, ErrLongURLExists
+	}
+
+	if s.byDedup[current.dedupKey] == u.ShortURL {
+		delete(s.byDedup, current.dedupKey)
+	}
+	if u.DedupKey != "" {
+		s.byDedup[u.DedupKey] = u.ShortURL
+	}
+	current.longURL, current.expiresAt, current.disabled, current.dedupKey = u.LongURL, u.ExpiresAt, u.Disabled, u.DedupKey
+	current.flagged, current.flagReason = u.Flagged, u.FlagReason
+	current.revision++
+	s.urls[u.ShortURL] = current
+
+	revision := URLRevision{Revision: current.revision, LongURL: u.LongURL, ExpiresAt: u.ExpiresAt, Enabled: !u.Disabled, Flagged: u.Flagged, FlagReason: u.FlagReason, ChangedBy: changedBy, ChangedAt: time.Now()}
+	s.revisions[u.ShortURL] = append(s.revisions[u.ShortURL], revision)
+	return revision, nil
+}
+
+func (s *memoryStore) GetURLHistory(ctx context.Context, shortURL string) ([]URLRevision, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return append([]URLRevision{}, s.revisions[shortURL]...), nil
+}
+
+func (s *memoryStore) GetShortURLByDedupKey(ctx context.Context, dedupKey string) (string, *time.Time, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	shortURL, ok := s.byDedup[dedupKey]
+	if !ok || !live(s.urls[shortURL], time.Now()) {
+		return "", nil, sql.ErrNoRows
+	}
+	return shortURL, s.urls[shortURL].expiresAt, nil
+}
+
+func (s *memoryStore) DeleteURL(ctx context.Context, shortURL string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if u, ok := s.urls[shortURL]; ok {
+		s.removeURL(u)
+	}
+	return nil
+}
+
+func (s *memoryStore) ArchiveExpiredURLs(ctx context.Context, limit int) (ArchiveResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var result ArchiveResult
+	now := time.Now()
+	for shortURL, u := range s.urls {
+		if len(result.ShortURLs) >= limit {
+			break
+		}
+		if u.expiresAt == nil || u.expiresAt.After(now) {
+			continue
+		}
+
+		s.archivedURLs = append(s.archivedURLs, u)
+		s.archivedClicks[shortURL] = append(s.archivedClicks[shortURL], s.clicks[shortURL]...)
+		result.ShortURLs = append(result.ShortURLs, shortURL)
+		result.Clicks += int64(len(s.clicks[shortURL]))
+
+		s.removeURL(u)
+	}
+	return result, nil
+}
+
+func (s *memoryStore) RecordClick(ctx context.Context, click Click) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Mirror the url_clicks foreign key
+	if _, ok := s.urls[click.ShortURL]; !ok {
+		return sql.ErrNoRows
+	}
+	s.clicks[click.ShortURL] = insertSorted(s.clicks[click.ShortURL], click)
+	return nil
+}
+
+func (s *memoryStore) RecordClicks(ctx context.Context, clicks []Click) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, click := range clicks {
+		if _, ok := s.urls[click.ShortURL]; !ok {
+			continue // Deleted meanwhile, same as the PostgreSQL batch insert
+		}
+		s.clicks[click.ShortURL] = insertSorted(s.clicks[click.ShortURL], click)
+	}
+	return nil
+}
+
+func (s *memoryStore) GetClickCounts(ctx context.Context, shortURL string, includeBots bool) (int, int, int, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	now := time.Now()
+	count := func(clicks []Click) int {
+		n := 0
+		for _, click := range clicks {
+			if includeBots || !click.Bot {
+				n++
+			}
+		}
+		return n
+	}
+	clicks := s.clicks[shortURL]
+	return count(clicks), count(clicksSince(clicks, now.Add(-24*time.Hour))), count(clicksSince(clicks, now.Add(-7*24*time.Hour))), nil
+}
+
+func (s *memoryStore) GetClickBreakdown(ctx context.Context, q BreakdownQuery) ([]BreakdownRow, int, error) {
+	value, ok := dimensionValues[q.Dimension]
+	if !ok {
+		return nil, 0, fmt.Errorf("unknown dimension %q", q.Dimension)
+	}
+
+	s.mu.RLock()
+	counts := map[string]int{}
+	total := 0
+	for _, click := range clicksSince(s.clicks[q.ShortURL], q.From) {
+		if !click.AccessedAt.Before(q.To) {
+			break
+		}
+		if q.IncludeBots || !click.Bot {
+			counts[value(click)]++
+			total++
+		}
+	}
+	s.mu.RUnlock()
+
+	breakdown := []BreakdownRow{}
+	for v, n := range counts {
+		breakdown = append(breakdown, BreakdownRow{Value: v, Clicks: n})
+	}
+	sort.Slice(breakdown, func(i, j int) bool {
+		if breakdown[i].Clicks != breakdown[j].Clicks {
+			return breakdown[i].Clicks > breakdown[j].Clicks
+		}
+		return breakdown[i].Value < breakdown[j].Value
+	})
+	if len(breakdown) > q.Limit {
+		breakdown = breakdown[:q.Limit]
+	}
+	return breakdown, total, nil
+}
+
+func (s *memoryStore) GetClickSeries(ctx context.Context, shortURL string, bounds []time.Time, includeBots bool) ([]int, error) {
+	if len(bounds) < 2 {
+		return []int{}, nil
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	counts := make([]int, len(bounds)-1)
+	for _, click := range clicksSince(s.clicks[shortURL], bounds[0]) {
+		if !click.AccessedAt.Before(bounds[len(bounds)-1]) {
+			break
+		}
+		if includeBots || !click.Bot {
+			// Bucket of the last bound at or before the click
+			counts[sort.Search(len(bounds), func(i int) bool { return bounds[i].After(click.AccessedAt) })-1]++
+		}
+	}
+	return counts, nil
+}
+
+// Clicks are counted from memory directly, there is nothing to roll up
+func (s *memoryStore) RollUpClicks(ctx context.Context, until time.Time, maxHours int) (time.Time, error) {
+	return until.Truncate(time.Hour), nil
+}
+
+// Value of each breakdown dimension of a click, as the url_clicks query selects it
+var dimensionValues = map[string]func(Click) string{
+	DimensionReferrer: func(c Click) string { return c.ReferrerHost },
+	DimensionCountry:  func(c Click) string { return c.Country },
+	DimensionRegion:   func(c Click) string { return c.Region },
+	DimensionCity:     func(c Click) string { return c.City },
+	DimensionDevice:   func(c Click) string { return c.DeviceType },
+	DimensionBrowser:  func(c Click) string { return c.BrowserFamily },
+	DimensionOS:       func(c Click) string { return c.OSFamily },
+	DimensionASN: func(c Click) string {
+		if c.ASN == 0 {
+			return ""
+		}
+		return strconv.FormatUint(uint64(c.ASN), 10)
+	},
+}
+
+func (s *memoryStore) CacheURL(ctx context.Context, shortURL string, m URLMapping) {
+	ttl := cacheTTL(m.ExpiresAt, s.cfg.MaxTTL)
+	if ttl == 0 {
+		ttl = tombstoneTTL
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	if entry, ok := s.cache[shortURL]; ok && now.Before(entry.cachedTill) && entry.mapping.Revision > m.Revision {
+		return
+	}
+	s.cache[shortURL] = memoryCacheEntry{mapping: m, cachedTill: now.Add(ttl)}
+}
+
+func (s *memoryStore) GetCachedURL(ctx context.Context, shortURL string) (URLMapping, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	entry, ok := s.cache[shortURL]
+	if !ok || entry.deleted || !time.Now().Before(entry.cachedTill) {
+		return URLMapping{}, ErrCacheMiss
+	}
+	return entry.mapping, nil
+}
+
+func (s *memoryStore) PurgeURL(ctx context.Context, shortURL string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tombstone := URLMapping{Revision: math.MaxInt32}
+	s.cache[shortURL] = memoryCacheEntry{mapping: tombstone, deleted: true, cachedTill: time.Now().Add(tombstoneTTL)}
+	for _, bot := range []bool{false, true} {
+		delete(s.hits, counterKey{shortURL, bot})
+		delete(s.allTime, counterKey{shortURL, bot})
+	}
+}
+
+func (s *memoryStore) IncrementCounters(ctx context.Context, clickEventKey string, bot bool) {
+	shortURL, err := utils.DecodeShortURLFromSnowflakeID(clickEventKey)
+	if err != nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Only a week of timestamps is ever needed for the rolling windows
+	now := time.Now()
+	key := counterKey{shortURL, bot}
+	hits := s.hits[key]
+	for len(hits) > 0 && hits[0].Before(now.Add(-7*24*time.Hour)) {
+		hits = hits[1:]
+	}
+	s.hits[key] = append(hits, now)
+	s.allTime[key]++
+}
+
+func (s *memoryStore) GetCounters(ctx context.Context, shortURL string, includeBots bool) (int, int, int, int, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	now := time.Now()
+	var allTime, last24h, lastWeek, last1min int
+	keys := []counterKey{{shortURL, false}}
+	if includeBots {
+		keys = append(keys, counterKey{shortURL, true})
+	}
+	for _, key := range keys {
+		allTime += s.allTime[key]
+		last24h += countSince(s.hits[key], now.Add(-24*time.Hour))
+		lastWeek += countSince(s.hits[key], now.Add(-7*24*time.Hour))
+		last1min += countSince(s.hits[key], now.Add(-time.Minute))
+	}
+	return allTime, last24h, lastWeek, last1min, nil
+}
+
+func (s *memoryStore) GetTopURLs(ctx context.Context, hours, limit int) ([]RankedURL, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	since := time.Now().Truncate(time.Hour).Add(-time.Duration(hours-1) * time.Hour)
+	var ranked []RankedURL
+	for key, hits := range s.hits {
+		if n := countSince(hits, since); !key.bot && n > 0 {
+			ranked = append(ranked, RankedURL{ShortURL: key.shortURL, Clicks: n})
+		}
+	}
+	// Ties in the Redis sorted sets go to the greater member first
+	sort.Slice(ranked, func(i, j int) bool {
+		if ranked[i].Clicks != ranked[j].Clicks {
+			return ranked[i].Clicks > ranked[j].Clicks
+		}
+		return ranked[i].ShortURL > ranked[j].ShortURL
+	})
+	if len(ranked) > limit {
+		ranked = ranked[:limit]
+	}
+	return ranked, nil
+}
+
+// insertSorted inserts a click into a slice ascending by AccessedAt, batches may arrive slightly out of order
+func insertSorted(clicks []Click, click Click) []Click {
+	i := len(clicks)
+	for i > 0 && clicks[i-1].AccessedAt.After(click.AccessedAt) {
+		i--
+	}
+	clicks = append(clicks, Click{})
+	copy(clicks[i+1:], clicks[i:])
+	clicks[i] = click
+	return clicks
+}
+
+// clicksSince returns the clicks of an ascending slice at or after since
+func clicksSince(clicks []Click, since time.Time) []Click {
+	for i, click := range clicks {
+		if !click.AccessedAt.Before(since) {
+			return clicks[i:]
+		}
+	}
+	return nil
+}
+
+// countSince counts the timestamps in an ascending slice that fall at or after since
+func countSince(times []time.Time, since time.Time) int {
+	for i, t := range times {
+		if !t.Before(since) {
+			return len(times) - i
+		}
+	}
+	return 0
+}
+
+func (s *memoryStore) CreateAPIKey(ctx context.Context, key APIKey, hash string) (APIKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Mirror the UNIQUE constraint on key_hash
+	if _, exists := s.keyByHash[hash]; exists {
+		return APIKey{}, errors.New("duplicate API key hash")
+	}
+	key.ID = int64(len(s.keys) + 1)
+	key.CreatedAt = time.Now()
+	key.RevokedAt = nil
+	s.keyByHash[hash] = len(s.keys)
+	s.keys = append(s.keys, memoryAPIKey{APIKey: key, hash: hash})
+	return key, nil
+}
+
+func (s *memoryStore) GetAPIKeyByHash(ctx context.Context, hash string) (APIKey, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	i, ok := s.keyByHash[hash]
+	if !ok {
+		return APIKey{}, sql.ErrNoRows
+	}
+	return s.keys[i].APIKey, nil
+}
+
+func (s *memoryStore) GetAPIKey(ctx context.Context, id int64) (APIKey, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if id < 1 || id > int64(len(s.keys)) {
+		return APIKey{}, sql.ErrNoRows
+	}
+	return s.keys[id-1].APIKey, nil
+}
+
+func (s *memoryStore) ListAPIKeys(ctx context.Context, owner string) ([]APIKey, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	keys := []APIKey{}
+	for _, key := range s.keys {
+		if owner == "" || key.Owner == owner {
+			keys = append(keys, key.APIKey)
+		}
+	}
+	return keys, nil
+}
+
+func (s *memoryStore) RevokeAPIKey(ctx context.Context, id int64, at time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if id < 1 || id > int64(len(s.keys)) {
+		return sql.ErrNoRows
+	}
+	key := &s.keys[id-1]
+	if key.RevokedAt == nil || at.Before(*key.RevokedAt) {
+		key.RevokedAt = &at
+	}
+	return nil
+}
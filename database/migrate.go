@@ -0,0 +1,108 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+)
+
+// Advisory lock held while migrating, so instances starting together migrate one at a time
+const migrationLockID = 0x74696e79 // "tiny"
+
+// Rows read per query by data migrations that walk a whole table
+const migrationBatchSize = 1000
+
+// DedupKeyFunc is the dedup key of a stored long URL of an owner under the current dedup policy,
+// empty when the link is not deduplicated
+type DedupKeyFunc func(longURL, owner string) string
+
+// dataMigration changes existing rows once, recorded in schema_migrations by name
+type dataMigration struct {
+	name  string
+	apply func(ctx context.Context, tx *sql.Tx, dedupKey DedupKeyFunc) error
+}
+
+// Applied in order after the schema, append new ones at the end
+var dataMigrations = []dataMigration{
+	{name: "backfill_dedup_keys", apply: backfillDedupKeys},
+}
+
+// Links stored while long_url was unique have no dedup key, so their long URL would be shortened
+// again. Live, enabled links get the key of their normalized long URL, the first link in short URL
+// order keeps it when several normalize to the same URL.
+func backfillDedupKeys(ctx context.Context, tx *sql.Tx, dedupKey DedupKeyFunc) error {
+	type legacyURL struct{ shortURL, longURL, owner string }
+
+	after := ""
+	for {
+		rows, err := tx.QueryContext(ctx, `SELECT short_url, long_url, COALESCE(owner, '') FROM urls
+			WHERE short_url > $1 AND dedup_key IS NULL AND NOT disabled AND (expires_at IS NULL OR expires_at > NOW())
+			ORDER BY short_url LIMIT $2`, after, migrationBatchSize)
+		if err != nil {
+			return err
+		}
+		var batch []legacyURL
+		for rows.Next() {
+			var u legacyURL
+			if err := rows.Scan(&u.shortURL, &u.longURL, &u.owner); err != nil {
+				rows.Close()
+				return err
+			}
+			batch = append(batch, u)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		if len(batch) == 0 {
+			return nil
+		}
+
+		for _, u := range batch {
+			key := dedupKey(u.longURL, u.owner)
+			if key == "" {
+				continue
+			}
+			_, err := tx.ExecContext(ctx, `UPDATE urls SET dedup_key = $1
+				WHERE short_url = $2 AND NOT EXISTS (SELECT 1 FROM urls WHERE dedup_key = $1)`, key, u.shortURL)
+			if err != nil {
+				return err
+			}
+		}
+		after = batch[len(batch)-1].shortURL
+	}
+}
+
+// Migrate applies schema, the idempotent statements of init-db.sql, to PostgreSQL and then every
+// data migration not recorded yet, all in one transaction. Databases created by an older version
+// gain the columns, tables and indexes added since, before the service reads or writes them.
+func Migrate(ctx context.Context, schema string, dedupKey DedupKeyFunc) error {
+	tx, err := DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, "SELECT pg_advisory_xact_lock($1)", migrationLockID); err != nil {
+		return fmt.Errorf("locking migrations: %w", err)
+	}
+	if _, err := tx.ExecContext(ctx, schema); err != nil {
+		return fmt.Errorf("applying schema: %w", err)
+	}
+
+	for _, m := range dataMigrations {
+		result, err := tx.ExecContext(ctx, "INSERT INTO schema_migrations (name) VALUES ($1) ON CONFLICT (name) DO NOTHING", m.name)
+		if err != nil {
+			return fmt.Errorf("recording migration %s: %w", m.name, err)
+		}
+		if applied, _ := result.RowsAffected(); applied == 0 {
+			continue // Recorded by an earlier start
+		}
+		if err := m.apply(ctx, tx, dedupKey); err != nil {
+			return fmt.Errorf("migration %s: %w", m.name, err)
+		}
+		log.Println("Applied migration:", m.name)
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,768 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"strings"
+	"time"
+
+	"cloudflaretinyurl/config"
+	"cloudflaretinyurl/rediscounter"
+
+	"github.com/lib/pq"
+	"github.com/redis/go-redis/v9"
+)
+
+// pgStore is the production backend: PostgreSQL for URLs and clicks, Redis for caching and counters
+type pgStore struct {
+	db  *sql.DB
+	rdb *redis.Client
+	cfg config.Cache
+}
+
+// Generate Global Counter for Unique Short URLs
+func (s *pgStore) IncrementGlobalCounter(ctx context.Context) (int64, error) {
+	return s.rdb.Incr(ctx, "url_global_counter").Result()
+}
+
+// Insert a mapping. The unique dedup_key index makes concurrent creates of one long URL race-free:
+// the loser waits for the winner to commit, inserts nothing and reads the winner's row.
+func (s *pgStore) StoreURL(ctx context.Context, u URLRecord) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if u.DedupKey != "" {
+		// Expired mappings, not yet archived by the sweeper, must not block re-creation
+		if _, err := tx.ExecContext(ctx, "UPDATE urls SET dedup_key = NULL WHERE dedup_key = $1 AND expires_at <= NOW()", u.DedupKey); err != nil {
+			return err
+		}
+	}
+
+	res, err := tx.ExecContext(ctx, `INSERT INTO urls (short_url, long_url, created_at, expires_at, owner, dedup_key)
+		VALUES ($1, $2, NOW(), $3, NULLIF($4, ''), NULLIF($5, ''))
+		ON CONFLICT (dedup_key) DO NOTHING`,
+		u.ShortURL, u.LongURL, u.ExpiresAt, u.Owner, u.DedupKey)
+	if err != nil {
+		log.Printf("Database insertion error: %v", err)
+		return uniqueViolation(err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		duplicate := &DuplicateError{}
+		var expiresAt sql.NullTime
+		err := tx.QueryRowContext(ctx, "SELECT short_url, expires_at FROM urls WHERE dedup_key = $1", u.DedupKey).Scan(&duplicate.ShortURL, &expiresAt)
+		if err != nil {
+			return err
+		}
+		if expiresAt.Valid {
+			duplicate.ExpiresAt = &expiresAt.Time
+		}
+		return duplicate
+	}
+
+	if err := insertRevision(ctx, tx, u, u.Owner, new(time.Time)); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Record the state of u as revision u.Revision (creation when 0), returning when it was recorded in changedAt
+func insertRevision(ctx context.Context, tx *sql.Tx, u URLRecord, changedBy string, changedAt *time.Time) error {
+	return tx.QueryRowContext(ctx, `INSERT INTO url_revisions (short_url, revision, long_url, expires_at, enabled, flagged, flag_reason, changed_by)
+		VALUES ($1, $2, $3, $4, $5, $6, NULLIF($7, ''), NULLIF($8, '')) RETURNING changed_at`,
+		u.ShortURL, max(u.Revision, 1), u.LongURL, u.ExpiresAt, !u.Disabled, u.Flagged, u.FlagReason, changedBy).Scan(changedAt)
+}
+
+// uniqueViolation maps unique constraint violations on the urls table to store errors
+func uniqueViolation(err error) error {
+	var pqErr *pq.Error
+	if !errors.As(err, &pqErr) || pqErr.Code != "23505" {
+		return err
+	}
+	switch pqErr.Constraint {
+	case "urls_pkey":
+		return ErrShortURLExists
+	case "idx_urls_dedup_key":
+		return ErrLongURLExists
+	}
+	return err
+}
+
+// Fetch URL, its expiry, disabled and flagged state and revision from PostgreSQL
+func (s *pgStore) GetURL(ctx context.Context, shortURL string) (URLMapping, error) {
+	var m URLMapping
+	var expiresAt sql.NullTime
+	var flagReason sql.NullString
+	err := s.db.QueryRowContext(ctx, "SELECT long_url, expires_at, disabled, flagged, flag_reason, revision FROM urls WHERE short_url=$1", shortURL).
+		Scan(&m.LongURL, &expiresAt, &m.Disabled, &m.Flagged, &flagReason, &m.Revision)
+	if err != nil {
+		return URLMapping{}, err
+	}
+	m.FlagReason = flagReason.String
+	if expiresAt.Valid {
+		m.ExpiresAt = &expiresAt.Time
+	}
+	return m, nil
+}
+
+// Owner of a short URL, empty for links created without an API key
+func (s *pgStore) GetURLOwner(ctx context.Context, shortURL string) (string, error) {
+	var owner sql.NullString
+	err := s.db.QueryRowContext(ctx, "SELECT owner FROM urls WHERE short_url=$1", shortURL).Scan(&owner)
+	return owner.String, err
+}
+
+// Current state of a short URL, to be changed with UpdateURL
+func (s *pgStore) GetURLRecord(ctx context.Context, shortURL string) (URLRecord, error) {
+	u := URLRecord{ShortURL: shortURL}
+	var owner, dedupKey, flagReason sql.NullString
+	var expiresAt sql.NullTime
+	err := s.db.QueryRowContext(ctx, "SELECT long_url, owner, expires_at, dedup_key, disabled, flagged, flag_reason, revision FROM urls WHERE short_url=$1", shortURL).
+		Scan(&u.LongURL, &owner, &expiresAt, &dedupKey, &u.Disabled, &u.Flagged, &flagReason, &u.Revision)
+	if err != nil {
+		return u, err
+	}
+	u.Owner, u.DedupKey, u.FlagReason = owner.String, dedupKey.String, flagReason.String
+	if expiresAt.Valid {
+		u.ExpiresAt = &expiresAt.Time
+	}
+	return u, nil
+}
+
+// Update a link if it is still at the revision it was read at, the row lock serializes concurrent updates
+func (s *pgStore) UpdateURL(ctx context.Context, u URLRecord, changedBy string) (URLRevision, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return URLRevision{}, err
+	}
+	defer tx.Rollback()
+
+	if u.DedupKey != "" {
+		if _, err := tx.ExecContext(ctx, "UPDATE urls SET dedup_key = NULL WHERE dedup_key = $1 AND expires_at <= NOW() AND short_url <> $2", u.DedupKey, u.ShortURL); err != nil {
+			return URLRevision{}, err
+		}
+	}
+
+	err = tx.QueryRowContext(ctx, `UPDATE urls SET long_url = $3, expires_at = $4, disabled = $5, flagged = $6, flag_reason = NULLIF($7, ''),
+		dedup_key = NULLIF($8, ''), revision = revision + 1
+		WHERE short_url = $1 AND revision = $2 RETURNING revision`,
+		u.ShortURL, u.Revision, u.LongURL, u.ExpiresAt, u.Disabled, u.Flagged, u.FlagReason, u.DedupKey).Scan(&u.Revision)
+	if err == sql.ErrNoRows {
+		if err := tx.QueryRowContext(ctx, "SELECT 1 FROM urls WHERE short_url = $1", u.ShortURL).Scan(new(int)); err != nil {
+			return URLRevision{}, err
+		}
+		return URLRevision{}, ErrRevisionConflict
+	}
+	if err != nil {
+		return URLRevision{}, uniqueViolation(err)
+	}
+
+	revision := URLRevision{Revision: u.Revision, LongURL: u.LongURL, ExpiresAt: u.ExpiresAt, Enabled: !u.Disabled, Flagged: u.Flagged, FlagReason: u.FlagReason, ChangedBy: changedBy}
+	if err := insertRevision(ctx, tx, u, changedBy, &revision.ChangedAt); err != nil {
+		return URLRevision{}, err
+	}
+	return revision, tx.Commit()
+}
+
+// Every recorded revision of a short URL, oldest first
+func (s *pgStore) GetURLHistory(ctx context.Context, shortURL string) ([]URLRevision, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT revision, long_url, expires_at, enabled, flagged, flag_reason, changed_by, changed_at
+		FROM url_revisions WHERE short_url = $1 ORDER BY revision`, shortURL)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	revisions := []URLRevision{}
+	for rows.Next() {
+		var revision URLRevision
+		var expiresAt sql.NullTime
+		var flagReason, changedBy sql.NullString
+		if err := rows.Scan(&revision.Revision, &revision.LongURL, &expiresAt, &revision.Enabled, &revision.Flagged, &flagReason, &changedBy, &revision.ChangedAt); err != nil {
+			return nil, err
+		}
+		if expiresAt.Valid {
+			revision.ExpiresAt = &expiresAt.Time
+		}
+		revision.FlagReason, revision.ChangedBy = flagReason.String, changedBy.String
+		revisions = append(revisions, revision)
+	}
+	return revisions, rows.Err()
+}
+
+// GetShortURLByDedupKey returns the live short URL & expiry date deduplicating a long URL
+func (s *pgStore) GetShortURLByDedupKey(ctx context.Context, dedupKey string) (string, *time.Time, error) {
+	var shortURL string
+	var expiresAt sql.NullTime
+
+	err := s.db.QueryRowContext(ctx, "SELECT short_url, expires_at FROM urls WHERE dedup_key = $1 AND (expires_at IS NULL OR expires_at > NOW())", dedupKey).
+		Scan(&shortURL, &expiresAt)
+
+	if err != nil {
+		return "", nil, err
+	}
+
+	// Convert sql.NullTime to *time.Time
+	if expiresAt.Valid {
+		return shortURL, &expiresAt.Time, nil
+	}
+
+	return shortURL, nil, nil
+}
+
+// Delete URL from PostgreSQL (clicks are removed by ON DELETE CASCADE)
+func (s *pgStore) DeleteURL(ctx context.Context, shortURL string) error {
+	_, err := s.db.ExecContext(ctx, "DELETE FROM urls WHERE short_url=$1", shortURL)
+	return err
+}
+
+// Move up to limit expired URLs and their clicks into the archive tables
+func (s *pgStore) ArchiveExpiredURLs(ctx context.Context, limit int) (ArchiveResult, error) {
+	var result ArchiveResult
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return result, err
+	}
+	defer tx.Rollback()
+
+	// SKIP LOCKED lets a concurrent delete or sweep proceed without blocking this batch
+	rows, err := tx.QueryContext(ctx, `SELECT short_url FROM urls WHERE expires_at <= NOW()
+		ORDER BY expires_at LIMIT $1 FOR UPDATE SKIP LOCKED`, limit)
+	if err != nil {
+		return result, err
+	}
+	for rows.Next() {
+		var shortURL string
+		if err := rows.Scan(&shortURL); err != nil {
+			rows.Close()
+			return result, err
+		}
+		result.ShortURLs = append(result.ShortURLs, shortURL)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return result, err
+	}
+	if len(result.ShortURLs) == 0 {
+		return result, nil
+	}
+
+	// Clicks must be copied before the urls rows go, ON DELETE CASCADE removes them
+	names, _ := clickColumnSQL()
+	res, err := tx.ExecContext(ctx, `INSERT INTO url_clicks_archive (id, `+names+`)
+		SELECT id, `+names+` FROM url_clicks WHERE short_url = ANY($1)`, pq.Array(result.ShortURLs))
+	if err != nil {
+		return result, err
+	}
+	result.Clicks, _ = res.RowsAffected()
+
+	_, err = tx.ExecContext(ctx, `INSERT INTO urls_archive (short_url, long_url, created_at, expires_at, archived_at, owner)
+		SELECT short_url, long_url, created_at, expires_at, NOW(), owner FROM urls WHERE short_url = ANY($1)`, pq.Array(result.ShortURLs))
+	if err != nil {
+		return result, err
+	}
+
+	if _, err = tx.ExecContext(ctx, "DELETE FROM urls WHERE short_url = ANY($1)", pq.Array(result.ShortURLs)); err != nil {
+		return result, err
+	}
+
+	return result, tx.Commit()
+}
+
+// url_clicks columns written per click and the types their values are bound as
+var clickColumns = []struct {
+	name, cast string
+	nullIf     string // Value stored as NULL, none if empty
+}{
+	{"short_url", "VARCHAR", ""},
+	{"accessed_at", "TIMESTAMPTZ", ""},
+	{"referrer_host", "VARCHAR", "''"},
+	{"user_agent", "TEXT", "''"},
+	{"ip", "VARCHAR", "''"},
+	{"language", "VARCHAR", "''"},
+	{"host", "VARCHAR", "''"},
+	{"device_type", "VARCHAR", "''"},
+	{"os_family", "VARCHAR", "''"},
+	{"os_version", "VARCHAR", "''"},
+	{"browser_family", "VARCHAR", "''"},
+	{"browser_version", "VARCHAR", "''"},
+	{"is_bot", "BOOLEAN", ""},
+	{"country", "VARCHAR", "''"},
+	{"region", "VARCHAR", "''"},
+	{"city", "VARCHAR", "''"},
+	{"asn", "BIGINT", "0"},
+}
+
+// Values of a click in clickColumns order
+func clickValues(click Click) []interface{} {
+	return []interface{}{click.ShortURL, click.AccessedAt, click.ReferrerHost, click.UserAgent, click.IP, click.Language, click.Host,
+		click.DeviceType, click.OSFamily, click.OSVersion, click.BrowserFamily, click.BrowserVersion, click.Bot,
+		click.Country, click.Region, click.City, int64(click.ASN)}
+}
+
+// Column list and, per column, the expression selecting it from a row named v
+func clickColumnSQL() (string, string) {
+	names := make([]string, len(clickColumns))
+	selects := make([]string, len(clickColumns))
+	for i, column := range clickColumns {
+		names[i] = column.name
+		selects[i] = "v." + column.name
+		if column.nullIf != "" {
+			selects[i] = "NULLIF(v." + column.name + ", " + column.nullIf + ")"
+		}
+	}
+	return strings.Join(names, ", "), strings.Join(selects, ", ")
+}
+
+// Store one click in PostgreSQL, failing if its URL no longer exists
+func (s *pgStore) RecordClick(ctx context.Context, click Click) error {
+	names, selects := clickColumnSQL()
+	placeholders := make([]string, len(clickColumns))
+	for i, column := range clickColumns {
+		placeholders[i] = fmt.Sprintf("$%d::%s", i+1, column.cast)
+	}
+	query := `INSERT INTO url_clicks (` + names + `)
+		SELECT ` + selects + ` FROM (VALUES (` + strings.Join(placeholders, ", ") + `)) AS v(` + names + `)`
+	_, err := s.db.ExecContext(ctx, markLateClickHours(query), clickValues(click)...)
+	return err
+}
+
+// PostgreSQL accepts at most 65535 bind parameters per statement
+const maxBindParams = 65535
+
+// Store a batch of clicks with multi-row INSERTs, skipping clicks of URLs deleted meanwhile.
+// Batches beyond the bind parameter limit are split, and inserted in one transaction.
+func (s *pgStore) RecordClicks(ctx context.Context, clicks []Click) error {
+	perInsert := maxBindParams / len(clickColumns)
+	if len(clicks) <= perInsert {
+		return insertClicks(ctx, s.db, clicks)
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for len(clicks) > 0 {
+		n := min(perInsert, len(clicks))
+		if err := insertClicks(ctx, tx, clicks[:n]); err != nil {
+			return err
+		}
+		clicks = clicks[n:]
+	}
+	return tx.Commit()
+}
+
+// execer is a database or a transaction
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+// Insert clicks with one multi-row INSERT
+func insertClicks(ctx context.Context, db execer, clicks []Click) error {
+	if len(clicks) == 0 {
+		return nil
+	}
+
+	values := make([]string, 0, len(clicks))
+	args := make([]interface{}, 0, len(clickColumns)*len(clicks))
+	placeholders := make([]string, len(clickColumns))
+	for _, click := range clicks {
+		for i, column := range clickColumns {
+			placeholders[i] = fmt.Sprintf("$%d::%s", len(args)+i+1, column.cast)
+		}
+		values = append(values, "("+strings.Join(placeholders, ", ")+")")
+		args = append(args, clickValues(click)...)
+	}
+
+	names, selects := clickColumnSQL()
+	query := `INSERT INTO url_clicks (` + names + `)
+		SELECT ` + selects + ` FROM (VALUES ` + strings.Join(values, ", ") + `) AS v(` + names + `)
+		WHERE EXISTS (SELECT 1 FROM urls WHERE urls.short_url = v.short_url)`
+	_, err := db.ExecContext(ctx, markLateClickHours(query), args...)
+	return err
+}
+
+// Extend an INSERT INTO url_clicks to mark the hours of inserted clicks before the watermark as
+// dirty, for the next roll up to count them again. The watermark row is locked for share, so a
+// roll up either waits for the insert to commit and counts its clicks, or commits first and the
+// insert sees its new watermark.
+func markLateClickHours(insert string) string {
+	return `WITH inserted AS (` + insert + ` RETURNING short_url, accessed_at)
+		INSERT INTO url_click_rollup_dirty (short_url, hour)
+		SELECT DISTINCT i.short_url, date_trunc('hour', i.accessed_at AT TIME ZONE 'UTC') AT TIME ZONE 'UTC'
+		FROM inserted AS i, (SELECT rolled_up_to FROM click_rollup_watermark WHERE id = 1 FOR SHARE) AS w
+		WHERE i.accessed_at < w.rolled_up_to
+		ON CONFLICT (short_url, hour) DO NOTHING`
+}
+
+// Get click counts from PostgreSQL
+func (s *pgStore) GetClickCounts(ctx context.Context, shortURL string, includeBots bool) (int, int, int, error) {
+	var allTime, last24h, lastWeek int
+
+	// Bot clicks count only when asked for ($2 = TRUE)
+	const clicksOf = "SELECT COUNT(*) FROM url_clicks WHERE short_url=$1 AND ($2 OR NOT is_bot)"
+
+	// Get all-time clicks
+	err := s.db.QueryRowContext(ctx, clicksOf, shortURL, includeBots).Scan(&allTime)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+
+	// Get last 24 hours clicks
+	err = s.db.QueryRowContext(ctx, clicksOf+" AND accessed_at >= NOW() - INTERVAL '24 hours'", shortURL, includeBots).Scan(&last24h)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+
+	// Get last week clicks
+	err = s.db.QueryRowContext(ctx, clicksOf+" AND accessed_at >= NOW() - INTERVAL '7 days'", shortURL, includeBots).Scan(&lastWeek)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+
+	return allTime, last24h, lastWeek, nil
+}
+
+// url_clicks expression selecting each breakdown dimension as text
+var dimensionColumns = map[string]string{
+	DimensionReferrer: "referrer_host",
+	DimensionCountry:  "country",
+	DimensionRegion:   "region",
+	DimensionCity:     "city",
+	DimensionASN:      "asn::TEXT",
+	DimensionDevice:   "device_type",
+	DimensionBrowser:  "browser_family",
+	DimensionOS:       "os_family",
+}
+
+// Count clicks per dimension value in PostgreSQL, the total is summed before the limit applies
+func (s *pgStore) GetClickBreakdown(ctx context.Context, q BreakdownQuery) ([]BreakdownRow, int, error) {
+	column, ok := dimensionColumns[q.Dimension]
+	if !ok {
+		return nil, 0, fmt.Errorf("unknown dimension %q", q.Dimension)
+	}
+
+	rows, err := s.db.QueryContext(ctx, `SELECT value, clicks, CAST(SUM(clicks) OVER () AS BIGINT) FROM (
+			SELECT COALESCE(`+column+`, '') AS value, COUNT(*) AS clicks FROM url_clicks
+			WHERE short_url = $1 AND ($2 OR NOT is_bot) AND accessed_at >= $3 AND accessed_at < $4 GROUP BY value
+		) AS counts ORDER BY clicks DESC, value LIMIT $5`, q.ShortURL, q.IncludeBots, q.From, q.To, q.Limit)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	breakdown := []BreakdownRow{}
+	total := 0
+	for rows.Next() {
+		var row BreakdownRow
+		if err := rows.Scan(&row.Value, &row.Clicks, &total); err != nil {
+			return nil, 0, err
+		}
+		breakdown = append(breakdown, row)
+	}
+	return breakdown, total, rows.Err()
+}
+
+// Count clicks per bucket in PostgreSQL. When every bound is a whole UTC hour, the hours already
+// rolled up are read from url_click_rollups and only the rest, and the dirty hours that got clicks
+// since their roll up, from url_clicks.
+func (s *pgStore) GetClickSeries(ctx context.Context, shortURL string, bounds []time.Time, includeBots bool) ([]int, error) {
+	if len(bounds) < 2 {
+		return []int{}, nil
+	}
+	start, end := bounds[0], bounds[len(bounds)-1]
+
+	split := start
+	if hourAligned(bounds) {
+		var rolledUpTo sql.NullTime
+		err := s.db.QueryRowContext(ctx, "SELECT rolled_up_to FROM click_rollup_watermark WHERE id = 1").Scan(&rolledUpTo)
+		if err != nil && err != sql.ErrNoRows {
+			return nil, err
+		}
+		if rolledUpTo.Valid && rolledUpTo.Time.After(start) {
+			split = rolledUpTo.Time
+			if split.After(end) {
+				split = end
+			}
+		}
+	}
+
+	thresholds := make([]string, len(bounds))
+	for i, bound := range bounds {
+		thresholds[i] = bound.UTC().Format(time.RFC3339Nano)
+	}
+
+	// width_bucket numbers the buckets from 1, rollups cover [start, split) but for dirty hours,
+	// raw clicks the dirty hours and [split, end)
+	rows, err := s.db.QueryContext(ctx, `SELECT bucket, SUM(clicks)::BIGINT FROM (
+			SELECT width_bucket(r.hour, $2::TIMESTAMPTZ[]) AS bucket, SUM(r.clicks + CASE WHEN $3 THEN r.bot_clicks ELSE 0 END) AS clicks
+			FROM url_click_rollups AS r WHERE r.short_url = $1 AND r.hour >= $4 AND r.hour < $5
+				AND NOT EXISTS (SELECT 1 FROM url_click_rollup_dirty AS d WHERE d.short_url = r.short_url AND d.hour = r.hour)
+			GROUP BY 1
+			UNION ALL
+			SELECT width_bucket(c.accessed_at, $2::TIMESTAMPTZ[]), COUNT(*)
+			FROM url_click_rollup_dirty AS d JOIN url_clicks AS c
+				ON c.short_url = d.short_url AND c.accessed_at >= d.hour AND c.accessed_at < d.hour + INTERVAL '1 hour'
+			WHERE d.short_url = $1 AND d.hour >= $4 AND d.hour < $5 AND ($3 OR NOT c.is_bot) GROUP BY 1
+			UNION ALL
+			SELECT width_bucket(accessed_at, $2::TIMESTAMPTZ[]), COUNT(*) FROM url_clicks
+			WHERE short_url = $1 AND ($3 OR NOT is_bot) AND accessed_at >= $5 AND accessed_at < $6 GROUP BY 1
+		) AS buckets GROUP BY bucket`, shortURL, pq.Array(thresholds), includeBots, start, split, end)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := make([]int, len(bounds)-1)
+	for rows.Next() {
+		var bucket, clicks int
+		if err := rows.Scan(&bucket, &clicks); err != nil {
+			return nil, err
+		}
+		if bucket >= 1 && bucket < len(bounds) {
+			counts[bucket-1] += clicks
+		}
+	}
+	return counts, rows.Err()
+}
+
+// Whether every bound falls on a whole hour in UTC, as the rollup buckets do
+func hourAligned(bounds []time.Time) bool {
+	for _, bound := range bounds {
+		if !bound.Truncate(time.Hour).Equal(bound) {
+			return false
+		}
+	}
+	return true
+}
+
+// Roll up clicks per short URL and UTC hour, from the watermark onwards, after rolling up the dirty
+// hours again. Rolling up an hour again recounts it, so a roll up interrupted before its commit is
+// simply repeated.
+func (s *pgStore) RollUpClicks(ctx context.Context, until time.Time, maxHours int) (time.Time, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer tx.Rollback()
+
+	// Locking the watermark makes concurrent roll ups wait for this one and continue after it
+	var from sql.NullTime
+	err = tx.QueryRowContext(ctx, "SELECT rolled_up_to FROM click_rollup_watermark WHERE id = 1 FOR UPDATE").Scan(&from)
+	if err != nil && err != sql.ErrNoRows {
+		return time.Time{}, err
+	}
+
+	// Recount the hours that got clicks after they were rolled up
+	_, err = tx.ExecContext(ctx, `WITH dirty AS (DELETE FROM url_click_rollup_dirty RETURNING short_url, hour)
+		INSERT INTO url_click_rollups (short_url, hour, clicks, bot_clicks)
+		SELECT d.short_url, d.hour, COUNT(*) FILTER (WHERE NOT c.is_bot), COUNT(*) FILTER (WHERE c.is_bot)
+		FROM dirty AS d JOIN url_clicks AS c
+			ON c.short_url = d.short_url AND c.accessed_at >= d.hour AND c.accessed_at < d.hour + INTERVAL '1 hour'
+		GROUP BY d.short_url, d.hour
+		ON CONFLICT (short_url, hour) DO UPDATE SET clicks = EXCLUDED.clicks, bot_clicks = EXCLUDED.bot_clicks`)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	if !from.Valid {
+		// The first roll up starts at the oldest click
+		if err := tx.QueryRowContext(ctx, "SELECT MIN(accessed_at) FROM url_clicks").Scan(&from); err != nil {
+			return time.Time{}, err
+		}
+	}
+
+	to := until.Truncate(time.Hour)
+	if !from.Valid {
+		from.Time = to // No clicks yet
+	}
+	from.Time = from.Time.Truncate(time.Hour)
+	if limit := from.Time.Add(time.Duration(maxHours) * time.Hour); to.After(limit) {
+		to = limit
+	}
+	if to.Before(from.Time) {
+		return from.Time, tx.Commit() // Keeps the dirty hours rolled up
+	}
+
+	_, err = tx.ExecContext(ctx, `INSERT INTO url_click_rollups (short_url, hour, clicks, bot_clicks)
+		SELECT short_url, date_trunc('hour', accessed_at AT TIME ZONE 'UTC') AT TIME ZONE 'UTC',
+			COUNT(*) FILTER (WHERE NOT is_bot), COUNT(*) FILTER (WHERE is_bot)
+		FROM url_clicks WHERE accessed_at >= $1 AND accessed_at < $2 GROUP BY 1, 2
+		ON CONFLICT (short_url, hour) DO UPDATE SET clicks = EXCLUDED.clicks, bot_clicks = EXCLUDED.bot_clicks`, from.Time, to)
+	if err != nil {
+		return time.Time{}, err
+	}
+	_, err = tx.ExecContext(ctx, `INSERT INTO click_rollup_watermark (id, rolled_up_to) VALUES (1, $1)
+		ON CONFLICT (id) DO UPDATE SET rolled_up_to = EXCLUDED.rolled_up_to`, to)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return to, tx.Commit()
+}
+
+// cachedURL is the value stored under a short URL key in Redis
+type cachedURL struct {
+	URLMapping
+	Deleted bool `json:"deleted,omitempty"` // Tombstone of a deleted link
+}
+
+// Set the cached mapping unless the cached one has a newer revision. Entries cached before
+// revisions have none and count as revision 0, plain string entries from before expiry
+// tracking are always replaced.
+// ARGV: encoded mapping, its revision, TTL in ms.
+var cacheURLScript = redis.NewScript(`
+local cached = redis.call('GET', KEYS[1])
+if cached then
+	local ok, entry = pcall(cjson.decode, cached)
+	if ok and type(entry) == 'table' and (tonumber(entry['revision']) or 0) > tonumber(ARGV[2]) then
+		return 0
+	end
+end
+redis.call('SET', KEYS[1], ARGV[1], 'PX', ARGV[3])
+return 1
+`)
+
+// Cache URL in Redis, never beyond its own expiry. Expired links are cached for tombstoneTTL
+// instead of not at all, so the mapping from before they expired cannot be cached again.
+func (s *pgStore) CacheURL(ctx context.Context, shortURL string, m URLMapping) {
+	ttl := cacheTTL(m.ExpiresAt, s.cfg.MaxTTL)
+	if ttl == 0 {
+		ttl = tombstoneTTL
+	}
+	value, err := json.Marshal(cachedURL{URLMapping: m})
+	if err != nil {
+		log.Println("Failed to encode cached URL:", err)
+		return
+	}
+	err = cacheURLScript.Run(ctx, s.rdb, []string{shortURL}, value, m.Revision, ttl.Milliseconds()).Err()
+	if err != nil {
+		log.Println("Failed to cache URL", shortURL, ":", err)
+	}
+}
+
+// Fetch URL, its expiry, disabled state and revision from Redis
+func (s *pgStore) GetCachedURL(ctx context.Context, shortURL string) (URLMapping, error) {
+	value, err := s.rdb.Get(ctx, shortURL).Bytes()
+	if err == redis.Nil {
+		return URLMapping{}, ErrCacheMiss
+	}
+	if err != nil {
+		return URLMapping{}, err
+	}
+
+	// Entries cached before expiry tracking are plain strings, treat them as a miss
+	var cached cachedURL
+	if err := json.Unmarshal(value, &cached); err != nil || cached.Deleted {
+		return URLMapping{}, ErrCacheMiss
+	}
+	return cached.URLMapping, nil
+}
+
+// Replace a short URL in Redis with a tombstone and remove its counters
+func (s *pgStore) PurgeURL(ctx context.Context, shortURL string) {
+	value, err := json.Marshal(cachedURL{URLMapping: URLMapping{Revision: math.MaxInt32}, Deleted: true})
+	if err != nil {
+		log.Println("Failed to encode URL tombstone:", err)
+		return
+	}
+	if err := s.rdb.Set(ctx, shortURL, value, tombstoneTTL).Err(); err != nil {
+		log.Println("Failed to store tombstone for:", shortURL, err)
+	}
+	if err := rediscounter.DeleteURLCounters(ctx, shortURL); err != nil {
+		log.Println("Failed to delete counters for:", shortURL, err)
+	}
+}
+
+// Update the rolling click counters in Redis
+func (s *pgStore) IncrementCounters(ctx context.Context, clickEventKey string, bot bool) {
+	rediscounter.UpdateGlobalCounter(ctx, clickEventKey, bot)
+}
+
+// Read the rolling click counters from Redis
+func (s *pgStore) GetCounters(ctx context.Context, shortURL string, includeBots bool) (int, int, int, int, error) {
+	return rediscounter.GetURLCounter(ctx, shortURL, includeBots)
+}
+
+// Rank short URLs by the hourly top sorted sets in Redis
+func (s *pgStore) GetTopURLs(ctx context.Context, hours, limit int) ([]RankedURL, error) {
+	top, err := rediscounter.GetTopURLs(ctx, hours, limit)
+	if err != nil {
+		return nil, err
+	}
+	ranked := make([]RankedURL, len(top))
+	for i, u := range top {
+		ranked[i] = RankedURL{ShortURL: u.ShortURL, Clicks: u.Clicks}
+	}
+	return ranked, nil
+}
+
+const apiKeyColumns = "id, owner, key_prefix, is_admin, created_at, revoked_at"
+
+// Scan one api_keys row selected with apiKeyColumns
+func scanAPIKey(row interface{ Scan(...any) error }) (APIKey, error) {
+	var key APIKey
+	var revokedAt sql.NullTime
+	if err := row.Scan(&key.ID, &key.Owner, &key.Prefix, &key.Admin, &key.CreatedAt, &revokedAt); err != nil {
+		return key, err
+	}
+	if revokedAt.Valid {
+		key.RevokedAt = &revokedAt.Time
+	}
+	return key, nil
+}
+
+// Store a new API key under the hash of its secret
+func (s *pgStore) CreateAPIKey(ctx context.Context, key APIKey, hash string) (APIKey, error) {
+	row := s.db.QueryRowContext(ctx, `INSERT INTO api_keys (owner, key_prefix, key_hash, is_admin) VALUES ($1, $2, $3, $4)
+		RETURNING `+apiKeyColumns, key.Owner, key.Prefix, hash, key.Admin)
+	return scanAPIKey(row)
+}
+
+func (s *pgStore) GetAPIKeyByHash(ctx context.Context, hash string) (APIKey, error) {
+	return scanAPIKey(s.db.QueryRowContext(ctx, "SELECT "+apiKeyColumns+" FROM api_keys WHERE key_hash=$1", hash))
+}
+
+func (s *pgStore) GetAPIKey(ctx context.Context, id int64) (APIKey, error) {
+	return scanAPIKey(s.db.QueryRowContext(ctx, "SELECT "+apiKeyColumns+" FROM api_keys WHERE id=$1", id))
+}
+
+// List API keys, oldest first
+func (s *pgStore) ListAPIKeys(ctx context.Context, owner string) ([]APIKey, error) {
+	rows, err := s.db.QueryContext(ctx, "SELECT "+apiKeyColumns+" FROM api_keys WHERE $1 = '' OR owner = $1 ORDER BY id", owner)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []APIKey{}
+	for rows.Next() {
+		key, err := scanAPIKey(rows)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
+
+// Make a key stop working at the given time, keeping an earlier revocation
+func (s *pgStore) RevokeAPIKey(ctx context.Context, id int64, at time.Time) error {
+	res, err := s.db.ExecContext(ctx, "UPDATE api_keys SET revoked_at = LEAST(COALESCE(revoked_at, $2), $2) WHERE id=$1", id, at)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
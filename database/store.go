@@ -0,0 +1,238 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// ErrCacheMiss is returned by Cache.GetCachedURL when the short URL is not cached
+var ErrCacheMiss = errors.New("cache miss")
+
+// ErrRevisionConflict is returned by URLStore.UpdateURL when the link changed since it was read
+var ErrRevisionConflict = errors.New("short URL was changed concurrently")
+
+// Returned by URLStore.StoreURL when the short URL or the long URL is already mapped
+var (
+	ErrShortURLExists = errors.New("short URL already exists")
+	ErrLongURLExists  = errors.New("long URL already exists")
+)
+
+// DuplicateError is returned by URLStore.StoreURL when a live mapping has the same dedup key.
+// It matches ErrLongURLExists.
+type DuplicateError struct {
+	ShortURL  string
+	ExpiresAt *time.Time
+}
+
+func (e *DuplicateError) Error() string {
+	return "long URL already shortened as " + e.ShortURL
+}
+
+func (e *DuplicateError) Is(target error) bool {
+	return target == ErrLongURLExists
+}
+
+// URLRecord is a short URL mapping to store
+type URLRecord struct {
+	ShortURL   string
+	LongURL    string
+	Owner      string // Empty for links created without an API key
+	ExpiresAt  *time.Time
+	DedupKey   string // Live mappings with the same non-empty key are deduplicated
+	Disabled   bool
+	Flagged    bool   // Matched a screening list on redirect
+	FlagReason string // List rule the long URL matched, empty unless flagged
+	Revision   int    // Incremented by every update, creation is revision 1
+}
+
+// URLMapping is what a redirect needs to know about a short URL, cached with the revision it was read at
+type URLMapping struct {
+	LongURL    string     `json:"long_url"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+	Disabled   bool       `json:"disabled,omitempty"`
+	Flagged    bool       `json:"flagged,omitempty"`
+	FlagReason string     `json:"flag_reason,omitempty"`
+	Revision   int        `json:"revision"` // 0 in entries cached before revisions were
+}
+
+// URLRevision is one recorded state of a short URL
+type URLRevision struct {
+	Revision   int        `json:"revision"`
+	LongURL    string     `json:"long_url"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+	Enabled    bool       `json:"enabled"`
+	Flagged    bool       `json:"flagged"`
+	FlagReason string     `json:"flag_reason,omitempty"`
+	ChangedBy  string     `json:"changed_by,omitempty"` // Owner of the API key that made the change
+	ChangedAt  time.Time  `json:"changed_at"`
+}
+
+// URLStore persists short URL → long URL mappings
+type URLStore interface {
+	IncrementGlobalCounter(ctx context.Context) (int64, error)
+	// StoreURL fails with *DuplicateError while a live mapping has the same dedup key,
+	// expired mappings give up their key
+	StoreURL(ctx context.Context, u URLRecord) error
+	GetURL(ctx context.Context, shortURL string) (URLMapping, error)
+	GetURLOwner(ctx context.Context, shortURL string) (string, error)
+	GetURLRecord(ctx context.Context, shortURL string) (URLRecord, error)
+	// UpdateURL replaces the long URL, expiry, disabled and flagged state and dedup key of the link at u.Revision,
+	// records the result as the next revision and returns it. ErrRevisionConflict if u.Revision is outdated.
+	UpdateURL(ctx context.Context, u URLRecord, changedBy string) (URLRevision, error)
+	GetURLHistory(ctx context.Context, shortURL string) ([]URLRevision, error) // Oldest revision first
+	// GetShortURLByDedupKey returns the live mapping with the key, sql.ErrNoRows if there is none
+	GetShortURLByDedupKey(ctx context.Context, dedupKey string) (string, *time.Time, error)
+	DeleteURL(ctx context.Context, shortURL string) error
+	ArchiveExpiredURLs(ctx context.Context, limit int) (ArchiveResult, error)
+}
+
+// ArchiveResult reports what one ArchiveExpiredURLs batch moved into the archive tables
+type ArchiveResult struct {
+	ShortURLs []string
+	Clicks    int64
+}
+
+// ClickStore persists click events and answers click count queries
+type ClickStore interface {
+	RecordClick(ctx context.Context, click Click) error
+	RecordClicks(ctx context.Context, clicks []Click) error
+	GetClickCounts(ctx context.Context, shortURL string, includeBots bool) (int, int, int, error)
+	// GetClickBreakdown counts the clicks per value of a dimension, returning the most common values
+	// first and the number of clicks q selected
+	GetClickBreakdown(ctx context.Context, q BreakdownQuery) ([]BreakdownRow, int, error)
+	// GetClickSeries counts the clicks in each bucket [bounds[i], bounds[i+1]) of ascending bounds
+	GetClickSeries(ctx context.Context, shortURL string, bounds []time.Time, includeBots bool) ([]int, error)
+	// RollUpClicks adds the clicks of up to maxHours whole hours before until to the hourly rollups
+	// and returns the time clicks are now rolled up to
+	RollUpClicks(ctx context.Context, until time.Time, maxHours int) (time.Time, error)
+}
+
+// Click fields GetClickBreakdown groups by
+const (
+	DimensionReferrer = "referrer"
+	DimensionCountry  = "country"
+	DimensionRegion   = "region"
+	DimensionCity     = "city"
+	DimensionASN      = "asn"
+	DimensionDevice   = "device"
+	DimensionBrowser  = "browser"
+	DimensionOS       = "os"
+)
+
+// Dimensions lists every dimension GetClickBreakdown accepts
+var Dimensions = []string{DimensionReferrer, DimensionCountry, DimensionRegion, DimensionCity, DimensionASN, DimensionDevice, DimensionBrowser, DimensionOS}
+
+// BreakdownQuery selects the clicks of a short URL to break down and how many values to return
+type BreakdownQuery struct {
+	ShortURL    string
+	Dimension   string
+	From, To    time.Time // Clicks at or after From and before To
+	Limit       int
+	IncludeBots bool
+}
+
+// BreakdownRow counts the clicks with one value of a dimension, Value is empty for clicks without one
+type BreakdownRow struct {
+	Value  string `json:"value"`
+	Clicks int    `json:"clicks"`
+}
+
+// Click is a single redirect event waiting to be persisted, empty fields are stored as NULL
+type Click struct {
+	ShortURL     string
+	AccessedAt   time.Time
+	ReferrerHost string // Host of the Referer header
+	UserAgent    string
+	IP           string // Client IP after anonymization
+	Language     string // Preferred Accept-Language tag
+	Host         string // Host the short URL was requested on
+
+	// Classified from UserAgent
+	DeviceType     string
+	OSFamily       string
+	OSVersion      string
+	BrowserFamily  string // Name of the bot for bots
+	BrowserVersion string
+	Bot            bool
+
+	// Looked up from the client IP before anonymization
+	Country string // ISO 3166-1 alpha-2 code
+	Region  string
+	City    string
+	ASN     uint // Zero when unknown
+}
+
+// Cache is the fast lookup path in front of URLStore, including the rolling click counters
+type Cache interface {
+	// CacheURL caches a mapping unless a newer revision of it is cached, so a redirect that read the
+	// link before an update cannot replace the mapping the update cached
+	CacheURL(ctx context.Context, shortURL string, m URLMapping)
+	GetCachedURL(ctx context.Context, shortURL string) (URLMapping, error)
+	// PurgeURL drops the counters and replaces the cached mapping with a short-lived tombstone,
+	// which mappings read before the link was deleted cannot replace
+	PurgeURL(ctx context.Context, shortURL string)
+	// IncrementCounters counts bot clicks apart, GetCounters adds them only with includeBots
+	IncrementCounters(ctx context.Context, clickEventKey string, bot bool)
+	GetCounters(ctx context.Context, shortURL string, includeBots bool) (int, int, int, int, error)
+	// GetTopURLs ranks short URLs by their clicks, bots left out, in the current UTC hour and the
+	// hours-1 hours before it, at most MaxTopHours
+	GetTopURLs(ctx context.Context, hours, limit int) ([]RankedURL, error)
+}
+
+// Longest window of GetTopURLs, as long as clicks are kept in the rolling counters
+const MaxTopHours = 7 * 24
+
+// RankedURL is a short URL with its clicks in a top ranking window
+type RankedURL struct {
+	ShortURL string
+	Clicks   int
+}
+
+// APIKey is a stored API key. The key itself is never stored, only its SHA-256 hash.
+type APIKey struct {
+	ID        int64      `json:"id"`
+	Owner     string     `json:"owner"`
+	Prefix    string     `json:"prefix"`
+	Admin     bool       `json:"admin"`
+	CreatedAt time.Time  `json:"created_at"`
+	RevokedAt *time.Time `json:"revoked_at,omitempty"` // The key stops working at this time
+}
+
+// Active reports whether the key still authenticates at the given time
+func (k APIKey) Active(at time.Time) bool {
+	return k.RevokedAt == nil || k.RevokedAt.After(at)
+}
+
+// KeyStore persists API keys, lookups of unknown keys return sql.ErrNoRows
+type KeyStore interface {
+	CreateAPIKey(ctx context.Context, key APIKey, hash string) (APIKey, error)
+	GetAPIKeyByHash(ctx context.Context, hash string) (APIKey, error)
+	GetAPIKey(ctx context.Context, id int64) (APIKey, error)
+	ListAPIKeys(ctx context.Context, owner string) ([]APIKey, error) // Empty owner lists every key
+	RevokeAPIKey(ctx context.Context, id int64, at time.Time) error  // Never extends an earlier revocation
+}
+
+// Active storage backends, selected by InitDB or InitMemory
+var (
+	URLs     URLStore
+	Clicks   ClickStore
+	URLCache Cache
+	Keys     KeyStore
+)
+
+// How long deleted and expired links stay cached, longer than a redirect takes between reading
+// a link and caching it, so the mapping it read cannot be cached after the link is gone
+const tombstoneTTL = time.Minute
+
+// cacheTTL caps the cache lifetime of a URL at maxCacheTTL and its own expiry, zero means it expired
+func cacheTTL(expiresAt *time.Time, maxCacheTTL time.Duration) time.Duration {
+	if expiresAt == nil {
+		return maxCacheTTL
+	}
+	ttl := time.Until(*expiresAt)
+	if ttl <= 0 {
+		return 0
+	}
+	return min(ttl, maxCacheTTL)
+}
@@ -0,0 +1,178 @@
+package geoip
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+
+	"cloudflaretinyurl/config"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// Location is what the databases know about an IP, empty fields are unknown
+type Location struct {
+	Country string // ISO 3166-1 alpha-2 code
+	Region  string // English name of the largest subdivision
+	City    string // English name
+	ASN     uint   // Autonomous system number
+}
+
+// Fields read from city and country databases
+type locationRecord struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	Subdivisions []struct {
+		Names map[string]string `maxminddb:"names"`
+	} `maxminddb:"subdivisions"`
+	City struct {
+		Names map[string]string `maxminddb:"names"`
+	} `maxminddb:"city"`
+}
+
+// Fields read from ASN databases
+type asnRecord struct {
+	Number uint `maxminddb:"autonomous_system_number"`
+}
+
+// databases is one loaded set of readers with the lookups cached from them, replaced as a
+// whole on reload so cached results never outlive their database
+type databases struct {
+	location *maxminddb.Reader // nil without a location database
+	asn      *maxminddb.Reader // nil without an ASN database
+
+	mu    sync.Mutex
+	cache map[string]Location
+}
+
+var (
+	cfg     = config.Default().GeoIP
+	current atomic.Pointer[databases]
+)
+
+// Initialize geolocation and load the databases, with neither configured lookups find nothing
+func InitGeoIP(geoConfig config.GeoIP) error {
+	cfg = geoConfig
+	current.Store(nil)
+	if !Enabled() {
+		return nil
+	}
+	return Reload()
+}
+
+// Enabled reports whether a database is configured
+func Enabled() bool {
+	return cfg.Database != "" || cfg.ASNDatabase != ""
+}
+
+// Reload re-reads the configured databases. On error the previous ones stay in effect.
+func Reload() error {
+	loaded := &databases{cache: map[string]Location{}}
+	var err error
+	if loaded.location, err = open(cfg.Database); err != nil {
+		return err
+	}
+	if loaded.asn, err = open(cfg.ASNDatabase); err != nil {
+		return err
+	}
+	current.Store(loaded)
+	return nil
+}
+
+// Read a database into memory, so a reload never unmaps one that lookups are still using
+func open(path string) (*maxminddb.Reader, error) {
+	if path == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	reader, err := maxminddb.FromBytes(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	log.Printf("Loaded GeoIP database %s (%s, built %d)", path, reader.Metadata.DatabaseType, reader.Metadata.BuildEpoch)
+	return reader, nil
+}
+
+// Lookup geolocates an IP in memory, without network calls. Unknown and invalid IPs
+// have an empty Location.
+func Lookup(ip string) Location {
+	dbs := current.Load()
+	if dbs == nil {
+		return Location{}
+	}
+
+	dbs.mu.Lock()
+	loc, ok := dbs.cache[ip]
+	dbs.mu.Unlock()
+	if ok {
+		return loc
+	}
+
+	loc = dbs.lookup(ip)
+	dbs.mu.Lock()
+	if len(dbs.cache) >= cfg.CacheSize {
+		dbs.cache = map[string]Location{}
+	}
+	dbs.cache[ip] = loc
+	dbs.mu.Unlock()
+	return loc
+}
+
+func (dbs *databases) lookup(ip string) Location {
+	var loc Location
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return loc
+	}
+
+	if dbs.location != nil {
+		var record locationRecord
+		if err := dbs.location.Lookup(parsed, &record); err != nil {
+			log.Printf("GeoIP lookup of %s failed: %v", ip, err)
+		}
+		if len(record.Country.ISOCode) == 2 {
+			loc.Country = record.Country.ISOCode
+		}
+		if len(record.Subdivisions) > 0 {
+			loc.Region = record.Subdivisions[0].Names["en"]
+		}
+		loc.City = record.City.Names["en"]
+	}
+	if dbs.asn != nil {
+		var record asnRecord
+		if err := dbs.asn.Lookup(parsed, &record); err != nil {
+			log.Printf("GeoIP ASN lookup of %s failed: %v", ip, err)
+		}
+		loc.ASN = record.Number
+	}
+	return loc
+}
+
+// Reload the databases on every SIGHUP until ctx is done, e.g. after a geoipupdate run
+func WatchReload(ctx context.Context) {
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+	defer signal.Stop(hangups)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hangups:
+		}
+
+		if err := Reload(); err != nil {
+			log.Println("Failed to reload GeoIP databases, keeping the previous ones:", err)
+		}
+	}
+}
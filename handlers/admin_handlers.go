@@ -0,0 +1,77 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+
+	"cloudflaretinyurl/redisqueue"
+)
+
+// Default number of dead letters returned by the inspect endpoint
+const defaultDeadLetterLimit = 100
+
+// Parse an optional non-negative integer query parameter
+func queryInt(r *http.Request, name string, fallback int64) (int64, error) {
+	value := r.URL.Query().Get(name)
+	if value == "" {
+		return fallback, nil
+	}
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || n < 0 {
+		return 0, errors.New("invalid " + name)
+	}
+	return n, nil
+}
+
+// List dead-lettered expired click events
+func ListDeadLettersHandler(w http.ResponseWriter, r *http.Request) {
+	limit, err := queryInt(r, "limit", defaultDeadLetterLimit)
+	if err != nil || limit == 0 {
+		http.Error(w, "Invalid limit", http.StatusBadRequest)
+		return
+	}
+
+	items, total, err := redisqueue.ListDeadLetters(r.Context(), limit)
+	if err != nil {
+		log.Println("Failed to list dead letters:", err)
+		writeQueueError(w, err)
+		return
+	}
+
+	response := map[string]interface{}{
+		"total": total,
+		"items": items,
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// Requeue dead-lettered expired click events (limit=0 or omitted replays all)
+func ReplayDeadLettersHandler(w http.ResponseWriter, r *http.Request) {
+	limit, err := queryInt(r, "limit", 0)
+	if err != nil {
+		http.Error(w, "Invalid limit", http.StatusBadRequest)
+		return
+	}
+
+	replayed, err := redisqueue.ReplayDeadLetters(r.Context(), limit)
+	if err != nil {
+		log.Println("Failed to replay dead letters:", err)
+		writeQueueError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int64{"replayed": replayed})
+}
+
+func writeQueueError(w http.ResponseWriter, err error) {
+	if errors.Is(err, redisqueue.ErrUnavailable) {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	http.Error(w, "Redis error", http.StatusInternalServerError)
+}
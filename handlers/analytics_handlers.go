@@ -0,0 +1,353 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloudflaretinyurl/database"
+
+	"github.com/gorilla/mux"
+)
+
+// Breakdowns and rankings return this many entries unless ?limit= asks for up to maxLimit
+const (
+	defaultLimit = 10
+	maxLimit     = 100
+)
+
+// BreakdownValue is one value of a breakdown with its share of the clicks in the range
+type BreakdownValue struct {
+	Value   string  `json:"value"`
+	Clicks  int     `json:"clicks"`
+	Percent float64 `json:"percent"`
+}
+
+// ClickBreakdownHandler counts the clicks of a short URL per value of the dimension in ?by=, the
+// most common values first, between from (default: the first click) and to (default: now)
+func ClickBreakdownHandler(w http.ResponseWriter, r *http.Request) {
+	shortURL := mux.Vars(r)["shortURL"]
+	query := r.URL.Query()
+
+	if !authorizeLink(w, r, shortURL) {
+		return
+	}
+	dimension := query.Get("by")
+	if !slices.Contains(database.Dimensions, dimension) {
+		http.Error(w, "by must be one of "+strings.Join(database.Dimensions, ", "), http.StatusBadRequest)
+		return
+	}
+	limit, ok := limitParam(w, query.Get("limit"))
+	if !ok {
+		return
+	}
+	loc, ok := timeZoneParam(w, query.Get("tz"))
+	if !ok {
+		return
+	}
+	to, ok := timeParam(w, query.Get("to"), "to", time.Now(), loc)
+	if !ok {
+		return
+	}
+	from, ok := timeParam(w, query.Get("from"), "from", time.Time{}, loc)
+	if !ok {
+		return
+	}
+	if !from.Before(to) {
+		http.Error(w, "from must be before to", http.StatusBadRequest)
+		return
+	}
+	includeBots, ok := includeBotsParam(w, r)
+	if !ok {
+		return
+	}
+
+	breakdown, total, err := database.Clicks.GetClickBreakdown(r.Context(), database.BreakdownQuery{
+		ShortURL:    shortURL,
+		Dimension:   dimension,
+		From:        from,
+		To:          to,
+		Limit:       limit,
+		IncludeBots: includeBots,
+	})
+	if err != nil {
+		log.Println("Failed to break down clicks:", err)
+		http.Error(w, "Failed to retrieve click breakdown", http.StatusInternalServerError)
+		return
+	}
+
+	values := make([]BreakdownValue, len(breakdown))
+	other := total
+	for i, row := range breakdown {
+		values[i] = BreakdownValue{Value: row.Value, Clicks: row.Clicks, Percent: percent(row.Clicks, total)}
+		other -= row.Clicks
+	}
+	response := map[string]any{
+		"short_url": baseURL + shortURL,
+		"by":        dimension,
+		"to":        to,
+		"total":     total,
+		"other":     other, // Clicks of the values beyond the limit
+		"values":    values,
+	}
+	if !from.IsZero() {
+		response["from"] = from
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// Share of n in total in percent, rounded to two decimals
+func percent(n, total int) float64 {
+	if total == 0 {
+		return 0
+	}
+	return math.Round(float64(n)*10000/float64(total)) / 100
+}
+
+// Window of the top ranking when ?window= is not given
+const defaultTopWindow = "24h"
+
+// TopURL is a short URL ranked by its clicks in the window
+type TopURL struct {
+	ShortURL string `json:"short_url"`
+	Clicks   int    `json:"clicks"`
+}
+
+// TopURLsHandler ranks the most clicked short URLs, bots left out, over ?window= (default 24h)
+// ending with the current hour
+func TopURLsHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	window := query.Get("window")
+	if window == "" {
+		window = defaultTopWindow
+	}
+	hours, ok := windowHours(window)
+	if !ok {
+		http.Error(w, fmt.Sprintf("window must be whole hours (e.g. 24h) or days (e.g. 7d) up to %dh", database.MaxTopHours), http.StatusBadRequest)
+		return
+	}
+	limit, ok := limitParam(w, query.Get("limit"))
+	if !ok {
+		return
+	}
+
+	ranked, err := database.URLCache.GetTopURLs(r.Context(), hours, limit)
+	if err != nil {
+		log.Println("Failed to rank short URLs:", err)
+		http.Error(w, "Failed to retrieve top short URLs", http.StatusInternalServerError)
+		return
+	}
+	top := make([]TopURL, len(ranked))
+	for i, u := range ranked {
+		top[i] = TopURL{ShortURL: baseURL + u.ShortURL, Clicks: u.Clicks}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"window": fmt.Sprintf("%dh", hours), "urls": top})
+}
+
+// Hours in a window such as 24h or 7d, false unless between 1 hour and database.MaxTopHours
+func windowHours(window string) (int, bool) {
+	hours := 0
+	if days, ok := strings.CutSuffix(window, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil {
+			return 0, false
+		}
+		hours = 24 * n
+	} else {
+		d, err := time.ParseDuration(window)
+		if err != nil || d%time.Hour != 0 {
+			return 0, false
+		}
+		hours = int(d / time.Hour)
+	}
+	return hours, hours >= 1 && hours <= database.MaxTopHours
+}
+
+// Time series intervals and the range covered when from is not given
+var seriesRanges = map[string]time.Duration{
+	"minute": time.Hour,
+	"hour":   24 * time.Hour,
+	"day":    30 * 24 * time.Hour,
+	"week":   12 * 7 * 24 * time.Hour,
+}
+
+// Most buckets one time series may have
+const maxSeriesBuckets = 10000
+
+// SeriesBucket is the number of clicks from Start until the start of the next bucket
+type SeriesBucket struct {
+	Start  time.Time `json:"start"`
+	Clicks int       `json:"clicks"`
+}
+
+// ClickTimeseriesHandler counts the clicks of a short URL per interval between from and to,
+// including the intervals without clicks. Buckets start on the wall clock of ?tz=.
+func ClickTimeseriesHandler(w http.ResponseWriter, r *http.Request) {
+	shortURL := mux.Vars(r)["shortURL"]
+	query := r.URL.Query()
+
+	if !authorizeLink(w, r, shortURL) {
+		return
+	}
+	interval := query.Get("interval")
+	if interval == "" {
+		interval = "hour"
+	}
+	span, ok := seriesRanges[interval]
+	if !ok {
+		http.Error(w, "interval must be minute, hour, day or week", http.StatusBadRequest)
+		return
+	}
+	loc, ok := timeZoneParam(w, query.Get("tz"))
+	if !ok {
+		return
+	}
+	to, ok := timeParam(w, query.Get("to"), "to", time.Now(), loc)
+	if !ok {
+		return
+	}
+	from, ok := timeParam(w, query.Get("from"), "from", to.Add(-span), loc)
+	if !ok {
+		return
+	}
+	if !from.Before(to) {
+		http.Error(w, "from must be before to", http.StatusBadRequest)
+		return
+	}
+	includeBots, ok := includeBotsParam(w, r)
+	if !ok {
+		return
+	}
+
+	bounds, ok := seriesBounds(from, to, interval)
+	if !ok {
+		http.Error(w, fmt.Sprintf("from and to are more than %d %ss apart", maxSeriesBuckets, interval), http.StatusBadRequest)
+		return
+	}
+	counts, err := database.Clicks.GetClickSeries(r.Context(), shortURL, bounds, includeBots)
+	if err != nil {
+		log.Println("Failed to count clicks per bucket:", err)
+		http.Error(w, "Failed to retrieve click time series", http.StatusInternalServerError)
+		return
+	}
+
+	buckets := make([]SeriesBucket, len(counts))
+	total := 0
+	for i, clicks := range counts {
+		buckets[i] = SeriesBucket{Start: bounds[i], Clicks: clicks}
+		total += clicks
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"short_url": baseURL + shortURL,
+		"interval":  interval,
+		"tz":        loc.String(),
+		"from":      bounds[0],
+		"to":        bounds[len(bounds)-1],
+		"total":     total,
+		"buckets":   buckets,
+	})
+}
+
+// Parse ?limit=, defaultLimit if not given. Writes a 400 response if out of range.
+func limitParam(w http.ResponseWriter, value string) (int, bool) {
+	if value == "" {
+		return defaultLimit, true
+	}
+	limit, err := strconv.Atoi(value)
+	if err != nil || limit < 1 || limit > maxLimit {
+		http.Error(w, fmt.Sprintf("limit must be between 1 and %d", maxLimit), http.StatusBadRequest)
+		return 0, false
+	}
+	return limit, true
+}
+
+// Load the IANA time zone of ?tz=, UTC if not given. Writes a 400 response if unknown.
+func timeZoneParam(w http.ResponseWriter, tz string) (*time.Location, bool) {
+	if tz == "" {
+		return time.UTC, true
+	}
+	loc, err := time.LoadLocation(tz)
+	if err != nil {
+		http.Error(w, "tz must be an IANA time zone such as Europe/Berlin", http.StatusBadRequest)
+		return nil, false
+	}
+	return loc, true
+}
+
+// Parse an RFC 3339 time or a date, which starts at midnight in loc. Writes a 400 response if invalid.
+func timeParam(w http.ResponseWriter, value, name string, fallback time.Time, loc *time.Location) (time.Time, bool) {
+	if value == "" {
+		return fallback.In(loc), true
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t.In(loc), true
+	}
+	if t, err := time.ParseInLocation(time.DateOnly, value, loc); err == nil {
+		return t, true
+	}
+	http.Error(w, name+" must be an RFC 3339 time or a YYYY-MM-DD date", http.StatusBadRequest)
+	return time.Time{}, false
+}
+
+// Bucket bounds from the start of the bucket holding from to the end of the bucket holding the
+// instant before to, false if there would be more than maxSeriesBuckets buckets
+func seriesBounds(from, to time.Time, interval string) ([]time.Time, bool) {
+	bounds := []time.Time{bucketStart(from, interval)}
+	for bounds[len(bounds)-1].Before(to) {
+		if len(bounds) > maxSeriesBuckets {
+			return nil, false
+		}
+		bounds = append(bounds, nextBucket(bounds[len(bounds)-1], interval))
+	}
+	return bounds, true
+}
+
+// Start of the bucket holding t on the wall clock of t's location. Weeks start on Monday.
+func bucketStart(t time.Time, interval string) time.Time {
+	year, month, day := t.Date()
+	switch interval {
+	case "minute", "hour":
+		// Truncated in local time, so hours of zones offset by a half hour start at :30 UTC
+		unit := time.Minute
+		if interval == "hour" {
+			unit = time.Hour
+		}
+		_, offset := t.Zone()
+		shift := time.Duration(offset) * time.Second
+		return t.Add(shift).Truncate(unit).Add(-shift)
+	case "day":
+		return time.Date(year, month, day, 0, 0, 0, 0, t.Location())
+	default:
+		sinceMonday := (int(t.Weekday()) + 6) % 7
+		return time.Date(year, month, day-sinceMonday, 0, 0, 0, 0, t.Location())
+	}
+}
+
+// Start of the bucket after the one starting at start. Days and weeks follow the calendar,
+// so they are an hour shorter or longer across daylight saving changes.
+func nextBucket(start time.Time, interval string) time.Time {
+	year, month, day := start.Date()
+	switch interval {
+	case "minute":
+		return start.Add(time.Minute)
+	case "hour":
+		if next := bucketStart(start.Add(time.Hour), interval); next.After(start) {
+			return next
+		}
+		return start.Add(time.Hour)
+	case "day":
+		return time.Date(year, month, day+1, 0, 0, 0, 0, start.Location())
+	default:
+		return time.Date(year, month, day+7, 0, 0, 0, 0, start.Location())
+	}
+}
@@ -0,0 +1,104 @@
+package handlers
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"cloudflaretinyurl/clientip"
+	"cloudflaretinyurl/database"
+	"cloudflaretinyurl/geoip"
+	"cloudflaretinyurl/useragent"
+)
+
+// Longest values stored per click, matching the url_clicks columns
+const (
+	maxHostLength      = 255
+	maxUserAgentLength = 512
+	maxLanguageLength  = 35
+	maxPlaceLength     = 128
+)
+
+// Describe a redirect request as a click event. The client IP is geolocated and anonymized
+// here, so the raw address never leaves the request.
+func captureClick(r *http.Request, shortURL string) database.Click {
+	ip := clientip.FromRequest(r)
+	agent := useragent.Parse(r.UserAgent())
+	location := geoip.Lookup(ip)
+	return database.Click{
+		ShortURL:       shortURL,
+		AccessedAt:     time.Now(),
+		ReferrerHost:   referrerHost(r.Referer()),
+		UserAgent:      truncate(r.UserAgent(), maxUserAgentLength),
+		IP:             clientip.Anonymize(ip),
+		Language:       preferredLanguage(r.Header.Get("Accept-Language")),
+		Host:           requestHost(r.Host),
+		DeviceType:     agent.DeviceType,
+		OSFamily:       agent.OSFamily,
+		OSVersion:      agent.OSVersion,
+		BrowserFamily:  agent.BrowserFamily,
+		BrowserVersion: agent.BrowserVersion,
+		Bot:            agent.Bot,
+		Country:        location.Country,
+		Region:         truncate(location.Region, maxPlaceLength),
+		City:           truncate(location.City, maxPlaceLength),
+		ASN:            location.ASN,
+	}
+}
+
+// Lowercased host of the Referer header, empty if it has none
+func referrerHost(referer string) string {
+	u, err := url.Parse(referer)
+	if err != nil {
+		return ""
+	}
+	return truncate(strings.TrimSuffix(strings.ToLower(u.Hostname()), "."), maxHostLength)
+}
+
+// Lowercased Host header without the port
+func requestHost(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return truncate(strings.ToLower(strings.Trim(host, "[]")), maxHostLength)
+}
+
+// The Accept-Language tag with the highest quality, lowercased, ties going to the first listed
+func preferredLanguage(header string) string {
+	best, bestQuality := "", 0.0
+	for _, entry := range strings.Split(header, ",") {
+		tag, params, _ := strings.Cut(strings.TrimSpace(entry), ";")
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if tag == "" || tag == "*" || len(tag) > maxLanguageLength || strings.Trim(tag, "abcdefghijklmnopqrstuvwxyz0123456789-") != "" {
+			continue
+		}
+
+		quality := 1.0
+		if q, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			parsed, err := strconv.ParseFloat(q, 64)
+			if err != nil {
+				continue
+			}
+			quality = parsed
+		}
+		if quality > bestQuality {
+			best, bestQuality = tag, quality
+		}
+	}
+	return best
+}
+
+// Cut s to at most n bytes without splitting a UTF-8 sequence
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
@@ -1,132 +1,358 @@
 package handlers
 
 import (
+	"cloudflaretinyurl/auth"
+	"cloudflaretinyurl/clickingest"
+	"cloudflaretinyurl/config"
+	"cloudflaretinyurl/screening"
+	"cloudflaretinyurl/urlpolicy"
 	"cloudflaretinyurl/utils"
 	"context"
+	"crypto/sha256"
 	"database/sql"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
+	"strconv"
 	"time"
 
 	"cloudflaretinyurl/database"
-	"cloudflaretinyurl/rediscounter"
+	"cloudflaretinyurl/metrics"
 
 	"github.com/gorilla/mux"
 	"github.com/mattheath/base62"
-	"github.com/redis/go-redis/v9"
 )
 
 type URL struct {
-	ShortURL  string     `json:"short_url"`
-	LongURL   string     `json:"long_url"`
-	CreatedAt time.Time  `json:"created_at"`
-	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	ShortURL    string     `json:"short_url"`
+	LongURL     string     `json:"long_url"`
+	CustomAlias string     `json:"custom_alias,omitempty"`
+	CreatedAt   time.Time  `json:"created_at"`
+	ExpiresAt   *time.Time `json:"expires_at,omitempty"`
 }
 
-var baseURL = "http://localhost:8080/api/v1/"
+// Set by InitHandlers, defaults keep the handlers usable without it
+var (
+	baseURL       = config.Default().Server.BaseURL
+	counterOffset = config.Default().IDs.CounterOffset
+	dedupScope    = config.Default().Dedup.Scope
+)
+
+// Initialize handler settings
+func InitHandlers(serverConfig config.Server, idConfig config.IDs, dedupConfig config.Dedup) {
+	baseURL = serverConfig.BaseURL
+	counterOffset = idConfig.CounterOffset
+	dedupScope = dedupConfig.Scope
+}
+
+// LegacyDedupKey is the dedup key of a long URL stored before long URLs were normalized,
+// empty when dedup is off or the URL no longer passes the URL policy
+func LegacyDedupKey(longURL, owner string) string {
+	normalized, err := urlpolicy.Normalize(longURL)
+	if err != nil {
+		return ""
+	}
+	return dedupKey(normalized, owner)
+}
+
+// Key under which a normalized long URL is deduplicated, empty when dedup is off
+func dedupKey(longURL, owner string) string {
+	sum := sha256.Sum256([]byte(longURL))
+	digest := hex.EncodeToString(sum[:])
+	switch dedupScope {
+	case "global":
+		return digest
+	case "owner":
+		return owner + ":" + digest
+	}
+	return ""
+}
+
+// Recorded as the author of revisions made by screening
+const screeningActor = "screening"
+
+// Counter values to try before giving up when generated codes collide with custom aliases or routes
+const maxGenerateAttempts = 5
+
+// errCounterUnavailable is returned by storeShortURL when no counter value could be taken for a generated short URL
+var errCounterUnavailable = errors.New("short URL counter is unavailable")
 
 // Generate Unique Short URL
-func generateShortURL() string {
-	newCounter, err := database.IncrementGlobalCounter()
+func generateShortURL(ctx context.Context) (string, error) {
+	newCounter, err := database.URLs.IncrementGlobalCounter(ctx)
 	if err != nil {
-		log.Fatal("Failed to increment global counter:", err)
+		return "", fmt.Errorf("%w: %v", errCounterUnavailable, err)
 	}
-	return base62.EncodeInt64(newCounter + 10000)
+	return base62.EncodeInt64(newCounter + counterOffset), nil
+}
+
+// Store the URL under its custom alias (u.ShortURL), or under the next generated short URL not already claimed by an alias
+func storeShortURL(ctx context.Context, u database.URLRecord) (string, error) {
+	if u.ShortURL != "" {
+		return u.ShortURL, database.URLs.StoreURL(ctx, u)
+	}
+
+	for attempt := 0; attempt < maxGenerateAttempts; attempt++ {
+		shortURL, err := generateShortURL(ctx)
+		if err != nil {
+			return "", err
+		}
+		u.ShortURL = shortURL
+		if utils.IsReserved(u.ShortURL) {
+			continue // Shadowed by an API route
+		}
+		err = database.URLs.StoreURL(ctx, u)
+		if !errors.Is(err, database.ErrShortURLExists) {
+			return u.ShortURL, err
+		}
+		log.Println("Generated short URL is taken by a custom alias, retrying:", u.ShortURL)
+	}
+	return "", fmt.Errorf("no free short URL after %d attempts", maxGenerateAttempts)
 }
 
 // Create Short URL Handler
 func CreateTinyURL(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
 	var request URL
 	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
 		http.Error(w, "Invalid request", http.StatusBadRequest)
 		return
 	}
+	longURL, ok := checkLongURL(w, request.LongURL, "create")
+	if !ok {
+		return
+	}
+	request.LongURL = longURL
 	log.Println("long url", request.LongURL)
-	shortURL := generateShortURL()
-
-	// Check if long URL already exists
-	existingShortURL, existingExpiry, err := database.GetShortURLByLongURL(request.LongURL)
-	if err != nil && err != sql.ErrNoRows {
-		http.Error(w, "Database error", http.StatusInternalServerError)
+	if request.ExpiresAt != nil && !request.ExpiresAt.After(time.Now()) {
+		http.Error(w, "expires_at must be in the future", http.StatusBadRequest)
 		return
 	}
+	if request.CustomAlias != "" {
+		if err := utils.ValidateAlias(request.CustomAlias); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
 
-	// If existing URL is found and not expired, return the existing short URL
-	if existingShortURL != "" && (existingExpiry == nil || existingExpiry.After(time.Now())) {
-		log.Println("Long URL already exists, returning existing short URL:", existingShortURL)
-		response := URL{ShortURL: baseURL + existingShortURL, LongURL: request.LongURL}
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(response)
-		return
+	// Return the live short URL of an already shortened long URL, before using up a counter value
+	principal, _ := auth.FromContext(ctx)
+	key := dedupKey(request.LongURL, principal.Owner)
+	if key != "" {
+		existingShortURL, _, err := database.URLs.GetShortURLByDedupKey(ctx, key)
+		if err != nil && err != sql.ErrNoRows {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		if err == nil {
+			writeExistingURL(w, request, existingShortURL)
+			return
+		}
 	}
-	// Store in PostgreSQL
-	err = database.StoreURL(shortURL, request.LongURL, request.ExpiresAt)
-	if err != nil {
+
+	// Store in PostgreSQL, owned by the caller's API key owner
+	shortURL, err := storeShortURL(ctx, database.URLRecord{
+		ShortURL:  request.CustomAlias,
+		LongURL:   request.LongURL,
+		Owner:     principal.Owner,
+		ExpiresAt: request.ExpiresAt,
+		DedupKey:  key,
+	})
+	var duplicate *database.DuplicateError
+	switch {
+	case errors.As(err, &duplicate):
+		// A concurrent create of the same long URL won
+		writeExistingURL(w, request, duplicate.ShortURL)
+		return
+	case errors.Is(err, database.ErrShortURLExists):
+		http.Error(w, "Custom alias is already in use", http.StatusConflict)
+		return
+	case errors.Is(err, errCounterUnavailable):
+		log.Println("Failed to increment global counter:", err)
+		http.Error(w, "Short URL counter unavailable, retry", http.StatusServiceUnavailable)
+		return
+	case err != nil:
 		http.Error(w, "Database error", http.StatusInternalServerError)
 		return
 	}
 
-	// Cache in Redis
-	database.CacheURL(shortURL, request.LongURL)
+	// Cache in Redis, new links are at revision 1
+	database.URLCache.CacheURL(ctx, shortURL, database.URLMapping{LongURL: request.LongURL, ExpiresAt: request.ExpiresAt, Revision: 1})
 
 	response := URL{ShortURL: baseURL + shortURL, LongURL: request.LongURL}
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(response)
 }
 
+// Normalize and screen a long URL, on rejection write a 400 and return false. stage labels screening metrics.
+func checkLongURL(w http.ResponseWriter, rawURL, stage string) (string, bool) {
+	longURL, err := urlpolicy.Normalize(rawURL)
+	if err != nil {
+		response := ValidationError{Field: "long_url", Code: urlpolicy.CodeInvalid, Message: err.Error()}
+		var policyErr *urlpolicy.Error
+		if errors.As(err, &policyErr) {
+			response.Code = policyErr.Code
+		}
+		writeValidationError(w, response)
+		return "", false
+	}
+	if match, listed := screening.Check(longURL); listed {
+		log.Printf("Rejected long URL %s listed in %s (%s %s)", longURL, match.List, match.Kind, match.Rule)
+		metrics.ScreeningMatches.WithLabelValues(stage, match.Kind).Inc()
+		writeValidationError(w, ValidationError{Field: "long_url", Code: screening.CodeBlocked, Message: "long_url is listed as unsafe"})
+		return "", false
+	}
+	return longURL, true
+}
+
+// Respond with the short URL a long URL is already shortened as, unless a different alias was requested
+func writeExistingURL(w http.ResponseWriter, request URL, existingShortURL string) {
+	if request.CustomAlias != "" && request.CustomAlias != existingShortURL {
+		http.Error(w, "Long URL is already shortened as "+existingShortURL, http.StatusConflict)
+		return
+	}
+	log.Println("Long URL already exists, returning existing short URL:", existingShortURL)
+	response := URL{ShortURL: baseURL + existingShortURL, LongURL: request.LongURL}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
 // Redirect to Original URL
 func RedirectTinyURL(w http.ResponseWriter, r *http.Request) {
 	params := mux.Vars(r)
 	shortURL := params["shortURL"]
+	ctx := r.Context()
 
 	// Check Redis Cache First
-	longURL, err := database.GetCachedURL(shortURL)
-	if err == redis.Nil {
+	mapping, err := database.URLCache.GetCachedURL(ctx, shortURL)
+	if err == nil {
+		metrics.CacheLookups.WithLabelValues(metrics.CacheHit).Inc()
+	} else {
+		metrics.CacheLookups.WithLabelValues(metrics.CacheMiss).Inc()
+
 		// Fetch from PostgreSQL
-		longURL, err = database.GetURL(shortURL)
+		mapping, err = database.URLs.GetURL(ctx, shortURL)
 		if err != nil {
 			http.Error(w, "URL not found", http.StatusNotFound)
 			return
 		}
-		// Cache the result in Redis
-		database.CacheURL(shortURL, longURL)
+		// Cache the result in Redis, unless an update cached a newer revision meanwhile
+		database.URLCache.CacheURL(ctx, shortURL, mapping)
 	}
+	longURL := mapping.LongURL
 
-	// Generate Snowflake ID for click event
-	clickEventKey := utils.GenerateSnowflakeID(shortURL)
+	// Refuse disabled and expired links, links disabled by screening show why
+	if mapping.Disabled && mapping.Flagged {
+		writeInterstitial(w, r, longURL, mapping.FlagReason, false)
+		return
+	}
+	if mapping.Disabled {
+		http.Error(w, "URL is disabled", http.StatusGone)
+		return
+	}
+	if mapping.ExpiresAt != nil && !mapping.ExpiresAt.After(time.Now()) {
+		http.Error(w, "URL has expired", http.StatusGone)
+		return
+	}
+
+	// Screen again, lists may have changed since the link was created
+	if match, listed, screened := screening.CheckLink(shortURL, longURL); listed {
+		metrics.ScreeningMatches.WithLabelValues("redirect", match.Kind).Inc()
+		if screened {
+			storeScreeningVerdict(ctx, shortURL, match)
+		}
+		if screening.Action() == screening.ActionDisable || r.URL.Query().Get("confirm") != "1" {
+			log.Printf("Held redirect of %s to %s %s", shortURL, longURL, match.Reason())
+			writeInterstitial(w, r, longURL, match.Reason(), screening.Action() == screening.ActionFlag)
+			return
+		}
+	}
 
-	// Update Click Counters
-	rediscounter.UpdateGlobalCounter(clickEventKey)
+	click := captureClick(r, shortURL)
 
-	// Store Click Timestamp in PostgreSQL
-	_, err = database.DB.Exec("INSERT INTO url_clicks (short_url, accessed_at) VALUES ($1, NOW())", shortURL)
+	// Generate Snowflake ID for click event
+	clickEventKey, err := utils.GenerateSnowflakeID(shortURL)
 	if err != nil {
-		log.Println("Failed to log click event:", err)
+		log.Println("Skipping click counters:", err)
+	} else {
+		// Update Click Counters, bots only count when asked for
+		database.URLCache.IncrementCounters(ctx, clickEventKey, click.Bot)
+	}
+
+	// Queue the click for batched insertion into PostgreSQL
+	if err := clickingest.Enqueue(click); err != nil {
+		// Buffer full or pipeline stopped, store synchronously rather than lose the click
+		if err := database.Clicks.RecordClick(ctx, click); err != nil {
+			log.Println("Failed to log click event:", err)
+		}
 	}
 
 	http.Redirect(w, r, longURL, http.StatusFound)
 }
 
+// Flag a link whose long URL matched a list on redirect, and disable it if screening.action
+// says so, as a revision the owner sees in the link history
+func storeScreeningVerdict(ctx context.Context, shortURL string, match screening.Match) {
+	record, err := database.URLs.GetURLRecord(ctx, shortURL)
+	if err != nil {
+		log.Println("Failed to read screened link", shortURL, ":", err)
+		return
+	}
+	disable := screening.Action() == screening.ActionDisable
+	if record.Flagged && (record.Disabled || !disable) {
+		return
+	}
+
+	record.Flagged = true
+	record.FlagReason = match.Reason()
+	if disable {
+		record.Disabled = true
+		record.DedupKey = "" // Like links disabled by their owner
+	}
+	revision, err := database.URLs.UpdateURL(ctx, record, screeningActor)
+	if err != nil {
+		log.Println("Failed to store screening verdict of", shortURL, ":", err)
+		return
+	}
+	log.Printf("Flagged %s (disabled: %t), %s", shortURL, record.Disabled, record.FlagReason)
+
+	// Disabled links must stop redirecting from the cache too
+	cacheRevision(ctx, shortURL, revision)
+}
+
+// Cache the state an update committed, replacing older revisions cached by any instance
+func cacheRevision(ctx context.Context, shortURL string, revision database.URLRevision) {
+	database.URLCache.CacheURL(ctx, shortURL, database.URLMapping{
+		LongURL:    revision.LongURL,
+		ExpiresAt:  revision.ExpiresAt,
+		Disabled:   !revision.Enabled,
+		Flagged:    revision.Flagged,
+		FlagReason: revision.FlagReason,
+		Revision:   revision.Revision,
+	})
+}
+
 // Delete Short URL Handler
 func DeleteTinyURL(w http.ResponseWriter, r *http.Request) {
 	params := mux.Vars(r)
 	shortURL := params["shortURL"]
+	ctx := r.Context()
+
+	if !authorizeLink(w, r, shortURL) {
+		return
+	}
 
 	// Delete from PostgreSQL
-	_, err := database.DB.Exec("DELETE FROM urls WHERE short_url=$1", shortURL)
-	if err != nil {
+	if err := database.URLs.DeleteURL(ctx, shortURL); err != nil {
 		http.Error(w, "Database error", http.StatusInternalServerError)
 		return
 	}
 
-	// Remove from Redis
-	database.RDB.Del(context.Background(), shortURL)
-	database.RDB.Del(context.Background(), fmt.Sprintf("count:%s:all_time", shortURL))
-	database.RDB.Del(context.Background(), fmt.Sprintf("count:%s:24h", shortURL))
-	database.RDB.Del(context.Background(), fmt.Sprintf("count:%s:week", shortURL))
-	database.RDB.Del(context.Background(), fmt.Sprintf("count:%s:1min", shortURL))
+	// Remove from Redis, the tombstone keeps redirects in flight from caching the link again
+	database.URLCache.PurgeURL(ctx, shortURL)
 
 	w.WriteHeader(http.StatusNoContent)
 }
@@ -135,15 +361,24 @@ func DeleteTinyURL(w http.ResponseWriter, r *http.Request) {
 func GetTinyURLCounts(w http.ResponseWriter, r *http.Request) {
 	params := mux.Vars(r)
 	shortURL := params["shortURL"]
+	ctx := r.Context()
 
-	allTime, last24h, lastWeek, last1min, err := rediscounter.GetURLCounter(shortURL)
+	if !authorizeLink(w, r, shortURL) {
+		return
+	}
+	includeBots, ok := includeBotsParam(w, r)
+	if !ok {
+		return
+	}
+
+	allTime, last24h, lastWeek, last1min, err := database.URLCache.GetCounters(ctx, shortURL, includeBots)
 	log.Println(allTime, last24h, lastWeek, last1min)
 	if err != nil {
 		log.Println("Redis error:", err)
 		log.Println("Redis unavailable, fetching click counts from database...")
 
 		var err error
-		allTime, last24h, lastWeek, err = database.GetClickCounts(shortURL)
+		allTime, last24h, lastWeek, err = database.Clicks.GetClickCounts(ctx, shortURL, includeBots)
 		if err != nil {
 			http.Error(w, "Failed to retrieve click counts", http.StatusInternalServerError)
 			return
@@ -165,9 +400,18 @@ func GetTinyURLCounts(w http.ResponseWriter, r *http.Request) {
 func GetClickCountsHandler(w http.ResponseWriter, r *http.Request) {
 	params := mux.Vars(r)
 	shortURL := params["shortURL"]
+	ctx := r.Context()
+
+	if !authorizeLink(w, r, shortURL) {
+		return
+	}
+	includeBots, ok := includeBotsParam(w, r)
+	if !ok {
+		return
+	}
 
 	// Query the database for click counts
-	allTime, last24h, lastWeek, err := database.GetClickCounts(shortURL)
+	allTime, last24h, lastWeek, err := database.Clicks.GetClickCounts(ctx, shortURL, includeBots)
 	if err != nil {
 		log.Println("Failed to retrieve click counts from database:", err)
 		http.Error(w, "Failed to retrieve click counts", http.StatusInternalServerError)
@@ -184,3 +428,50 @@ func GetClickCountsHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(response)
 }
+
+// The include_bots query parameter, false by default. On an invalid value write a 400 and return false.
+func includeBotsParam(w http.ResponseWriter, r *http.Request) (bool, bool) {
+	value := r.URL.Query().Get("include_bots")
+	if value == "" {
+		return false, true
+	}
+	includeBots, err := strconv.ParseBool(value)
+	if err != nil {
+		http.Error(w, "include_bots must be true or false", http.StatusBadRequest)
+		return false, false
+	}
+	return includeBots, true
+}
+
+// ValidationError is the body of a 400 response for a rejected request field
+type ValidationError struct {
+	Field   string `json:"field"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// Write a rejected field as a structured 400 response
+func writeValidationError(w http.ResponseWriter, response ValidationError) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(map[string]ValidationError{"error": response})
+}
+
+// Check that the caller may manage the link, otherwise write 404 or 403 and return false
+func authorizeLink(w http.ResponseWriter, r *http.Request, shortURL string) bool {
+	owner, err := database.URLs.GetURLOwner(r.Context(), shortURL)
+	if err == sql.ErrNoRows {
+		http.Error(w, "URL not found", http.StatusNotFound)
+		return false
+	}
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return false
+	}
+
+	if principal, _ := auth.FromContext(r.Context()); !principal.CanManage(owner) {
+		http.Error(w, "API key does not own this URL", http.StatusForbidden)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,30 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"cloudflaretinyurl/health"
+)
+
+// Liveness probe: fails only when a background worker has stopped making progress
+func HealthzHandler(w http.ResponseWriter, r *http.Request) {
+	writeHealthReport(w, health.Liveness())
+}
+
+// Readiness probe: fails when a critical dependency (PostgreSQL, Redis) is unreachable,
+// degraded but still 200 when only non-critical checks fail
+func ReadyzHandler(w http.ResponseWriter, r *http.Request) {
+	writeHealthReport(w, health.Readiness(r.Context()))
+}
+
+func writeHealthReport(w http.ResponseWriter, report health.Report) {
+	status := http.StatusOK
+	if report.Status == health.StatusUnavailable {
+		status = http.StatusServiceUnavailable
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(report)
+}
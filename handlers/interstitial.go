@@ -0,0 +1,49 @@
+package handlers
+
+import (
+	"html/template"
+	"log"
+	"net/http"
+)
+
+// Shown instead of redirecting to a listed long URL
+var interstitialTemplate = template.Must(template.New("interstitial").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="robots" content="noindex">
+<title>Warning: this link may be unsafe</title>
+</head>
+<body>
+<h1>This link may be unsafe</h1>
+<p>The short link you followed leads to a site listed as suspected phishing or malware:</p>
+<p><code>{{.LongURL}}</code></p>
+{{if .Reason}}<p>Reason: {{.Reason}}</p>
+{{end}}{{if .ContinueURL}}<p><a href="{{.ContinueURL}}" rel="noreferrer">Continue anyway</a></p>
+{{else}}<p>This link has been disabled.</p>
+{{end}}</body>
+</html>
+`))
+
+// Write the warning page for a listed long URL and the reason it is listed, with a link to
+// continue unless the link is disabled
+func writeInterstitial(w http.ResponseWriter, r *http.Request, longURL, reason string, allowContinue bool) {
+	data := struct {
+		LongURL     string
+		Reason      string
+		ContinueURL string
+	}{LongURL: longURL, Reason: reason}
+
+	status := http.StatusForbidden
+	if allowContinue {
+		data.ContinueURL = r.URL.Path + "?confirm=1"
+		status = http.StatusOK
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	if err := interstitialTemplate.Execute(w, data); err != nil {
+		log.Println("Failed to render interstitial:", err)
+	}
+}
@@ -0,0 +1,152 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"cloudflaretinyurl/auth"
+	"cloudflaretinyurl/database"
+
+	"github.com/gorilla/mux"
+)
+
+// Longest overlap during which a rotated key keeps working
+const maxRotationGrace = 7 * 24 * time.Hour
+
+// KeyRequest is the body of a key creation request
+type KeyRequest struct {
+	Owner string `json:"owner"`
+	Admin bool   `json:"admin"`
+}
+
+// KeyResponse carries a newly created key, the only response that includes it in plain text
+type KeyResponse struct {
+	Key    string          `json:"key"`
+	APIKey database.APIKey `json:"api_key"`
+}
+
+// Create an API key for an owner (admin only)
+func CreateAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	var request KeyRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	if request.Owner == "" || len(request.Owner) > 64 {
+		http.Error(w, "owner must be 1 to 64 characters", http.StatusBadRequest)
+		return
+	}
+
+	key, stored, err := auth.GenerateKey(r.Context(), request.Owner, request.Admin)
+	if err != nil {
+		log.Println("Failed to create API key:", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	writeKey(w, key, stored)
+}
+
+// List API keys: admins see every key or those of ?owner=, other keys see their owner's keys
+func ListAPIKeysHandler(w http.ResponseWriter, r *http.Request) {
+	principal, _ := auth.FromContext(r.Context())
+	owner := principal.Owner
+	if principal.Admin {
+		owner = r.URL.Query().Get("owner")
+	}
+
+	keys, err := database.Keys.ListAPIKeys(r.Context(), owner)
+	if err != nil {
+		log.Println("Failed to list API keys:", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"keys": keys})
+}
+
+// Replace a key with a new one of the same owner and scope. The old key keeps working
+// for ?grace= (a duration, default 0) so clients can switch over.
+func RotateAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	grace := time.Duration(0)
+	if value := r.URL.Query().Get("grace"); value != "" {
+		var err error
+		grace, err = time.ParseDuration(value)
+		if err != nil || grace < 0 || grace > maxRotationGrace {
+			http.Error(w, "Invalid grace, must be a duration up to "+maxRotationGrace.String(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	old, ok := authorizeKey(w, r)
+	if !ok {
+		return
+	}
+	if !old.Active(time.Now()) {
+		http.Error(w, "API key is revoked", http.StatusConflict)
+		return
+	}
+
+	key, stored, err := auth.GenerateKey(r.Context(), old.Owner, old.Admin)
+	if err == nil {
+		err = database.Keys.RevokeAPIKey(r.Context(), old.ID, time.Now().Add(grace))
+	}
+	if err != nil {
+		log.Println("Failed to rotate API key:", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	writeKey(w, key, stored)
+}
+
+// Revoke a key immediately
+func RevokeAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	key, ok := authorizeKey(w, r)
+	if !ok {
+		return
+	}
+
+	if err := database.Keys.RevokeAPIKey(r.Context(), key.ID, time.Now()); err != nil {
+		log.Println("Failed to revoke API key:", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Look up the key named in the path and check the caller may manage it: admins manage
+// every key, other keys those of their owner except admin keys
+func authorizeKey(w http.ResponseWriter, r *http.Request) (database.APIKey, bool) {
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid key id", http.StatusBadRequest)
+		return database.APIKey{}, false
+	}
+
+	key, err := database.Keys.GetAPIKey(r.Context(), id)
+	if err == sql.ErrNoRows {
+		http.Error(w, "API key not found", http.StatusNotFound)
+		return database.APIKey{}, false
+	}
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return database.APIKey{}, false
+	}
+
+	principal, _ := auth.FromContext(r.Context())
+	if !principal.CanManage(key.Owner) || (key.Admin && !principal.Admin) {
+		http.Error(w, "API key not found", http.StatusNotFound) // Do not reveal other owners' keys
+		return database.APIKey{}, false
+	}
+	return key, true
+}
+
+func writeKey(w http.ResponseWriter, key string, stored database.APIKey) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(KeyResponse{Key: key, APIKey: stored})
+}
@@ -0,0 +1,177 @@
+package handlers
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"cloudflaretinyurl/auth"
+	"cloudflaretinyurl/database"
+	"cloudflaretinyurl/metrics"
+	"cloudflaretinyurl/screening"
+
+	"github.com/gorilla/mux"
+)
+
+// Attempts at applying an update while concurrent updates keep changing the link
+const maxUpdateAttempts = 3
+
+// LinkPatch is the body of a link update, absent fields are left unchanged
+type LinkPatch struct {
+	LongURL   *string         `json:"long_url"`
+	ExpiresAt json.RawMessage `json:"expires_at"` // null removes the expiry
+	Enabled   *bool           `json:"enabled"`
+}
+
+// LinkResponse is the state of a link after an update
+type LinkResponse struct {
+	ShortURL   string     `json:"short_url"`
+	LongURL    string     `json:"long_url"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+	Enabled    bool       `json:"enabled"`
+	Flagged    bool       `json:"flagged"`
+	FlagReason string     `json:"flag_reason,omitempty"`
+	Revision   int        `json:"revision"`
+}
+
+// Update the long URL, expiry or enabled state of a link
+func UpdateLinkHandler(w http.ResponseWriter, r *http.Request) {
+	shortURL := mux.Vars(r)["shortURL"]
+	ctx := r.Context()
+
+	if !authorizeLink(w, r, shortURL) {
+		return
+	}
+
+	var patch LinkPatch
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&patch); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	if patch.LongURL == nil && patch.ExpiresAt == nil && patch.Enabled == nil {
+		http.Error(w, "Request must set long_url, expires_at or enabled", http.StatusBadRequest)
+		return
+	}
+
+	if patch.LongURL != nil {
+		longURL, ok := checkLongURL(w, *patch.LongURL, "update")
+		if !ok {
+			return
+		}
+		patch.LongURL = &longURL
+	}
+	var expiresAt *time.Time
+	if patch.ExpiresAt != nil && !bytes.Equal(patch.ExpiresAt, []byte("null")) {
+		if err := json.Unmarshal(patch.ExpiresAt, &expiresAt); err != nil {
+			writeValidationError(w, ValidationError{Field: "expires_at", Code: "invalid", Message: "expires_at must be an RFC 3339 timestamp or null"})
+			return
+		}
+		if !expiresAt.After(time.Now()) {
+			writeValidationError(w, ValidationError{Field: "expires_at", Code: "in_past", Message: "expires_at must be in the future"})
+			return
+		}
+	}
+
+	principal, _ := auth.FromContext(ctx)
+	var revision database.URLRevision
+	for attempt := 1; ; attempt++ {
+		record, err := database.URLs.GetURLRecord(ctx, shortURL)
+		if err == sql.ErrNoRows {
+			http.Error(w, "URL not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+
+		// Links claim a dedup key again when their long URL changes or they are enabled again.
+		// A new long URL passed screening, so the link is no longer flagged.
+		reclaim := record.Disabled
+		if patch.LongURL != nil && *patch.LongURL != record.LongURL {
+			reclaim = true
+			record.LongURL = *patch.LongURL
+			record.Flagged, record.FlagReason = false, ""
+		}
+
+		// A flagged link is enabled again only once its long URL is no longer listed
+		if patch.Enabled != nil && *patch.Enabled && record.Disabled && record.Flagged {
+			if match, listed := screening.Check(record.LongURL); listed {
+				metrics.ScreeningMatches.WithLabelValues("update", match.Kind).Inc()
+				writeValidationError(w, ValidationError{Field: "enabled", Code: screening.CodeBlocked, Message: "long_url is still listed as unsafe, change it to enable the link"})
+				return
+			}
+			record.Flagged, record.FlagReason = false, ""
+		}
+		if patch.ExpiresAt != nil {
+			record.ExpiresAt = expiresAt
+		}
+		if patch.Enabled != nil {
+			record.Disabled = !*patch.Enabled
+		}
+		switch {
+		case record.Disabled:
+			record.DedupKey = ""
+		case reclaim:
+			record.DedupKey = dedupKey(record.LongURL, record.Owner)
+		}
+
+		revision, err = database.URLs.UpdateURL(ctx, record, principal.Owner)
+		if errors.Is(err, database.ErrRevisionConflict) && attempt < maxUpdateAttempts {
+			continue
+		}
+		switch {
+		case errors.Is(err, database.ErrRevisionConflict):
+			http.Error(w, "URL is being changed concurrently, retry", http.StatusConflict)
+			return
+		case errors.Is(err, database.ErrLongURLExists):
+			http.Error(w, "Long URL is already shortened by another link", http.StatusConflict)
+			return
+		case err == sql.ErrNoRows:
+			http.Error(w, "URL not found", http.StatusNotFound)
+			return
+		case err != nil:
+			log.Println("Failed to update URL:", err)
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		break
+	}
+
+	// Replace the cached mapping, redirects that read the old revision cannot cache it again
+	cacheRevision(ctx, shortURL, revision)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(LinkResponse{
+		ShortURL:   baseURL + shortURL,
+		LongURL:    revision.LongURL,
+		ExpiresAt:  revision.ExpiresAt,
+		Enabled:    revision.Enabled,
+		Flagged:    revision.Flagged,
+		FlagReason: revision.FlagReason,
+		Revision:   revision.Revision,
+	})
+}
+
+// List every revision of a link, oldest first
+func LinkHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	shortURL := mux.Vars(r)["shortURL"]
+
+	if !authorizeLink(w, r, shortURL) {
+		return
+	}
+
+	revisions, err := database.URLs.GetURLHistory(r.Context(), shortURL)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"short_url": baseURL + shortURL, "revisions": revisions})
+}
@@ -0,0 +1,179 @@
+package health
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"cloudflaretinyurl/config"
+)
+
+// Overall and per-check statuses reported by /healthz and /readyz
+const (
+	StatusOK          = "ok"
+	StatusDegraded    = "degraded"    // A non-critical check failed, traffic can still be served
+	StatusUnavailable = "unavailable" // A critical check failed
+)
+
+// Check is a dependency probe run by Readiness, with its own timeout
+type Check struct {
+	Name     string
+	Critical bool // Failing critical checks make the instance unready, others only degrade it
+	Run      func(ctx context.Context) error
+}
+
+// Result is the outcome of one check
+type Result struct {
+	Status     string  `json:"status"`
+	Critical   bool    `json:"critical"`
+	Error      string  `json:"error,omitempty"`
+	DurationMs float64 `json:"duration_ms"`
+}
+
+// Report is the JSON body of /healthz and /readyz
+type Report struct {
+	Status string            `json:"status"`
+	Checks map[string]Result `json:"checks"`
+}
+
+type heartbeat struct {
+	last   time.Time
+	maxAge time.Duration
+}
+
+var (
+	mu         sync.RWMutex
+	cfg        = config.Default().Health
+	checks     []Check
+	heartbeats = make(map[string]heartbeat)
+)
+
+// Initialize health reporting settings
+func InitHealth(healthConfig config.Health) {
+	mu.Lock()
+	defer mu.Unlock()
+	cfg = healthConfig
+}
+
+// Register a readiness check
+func AddCheck(check Check) {
+	mu.Lock()
+	defer mu.Unlock()
+	checks = append(checks, check)
+}
+
+// Beat records that a background worker is making progress. A worker that has not beaten
+// within maxAge is reported stale, failing liveness.
+func Beat(worker string, maxAge time.Duration) {
+	mu.Lock()
+	defer mu.Unlock()
+	heartbeats[worker] = heartbeat{last: time.Now(), maxAge: maxAge}
+}
+
+// Forget stops tracking a worker that exited on purpose
+func Forget(worker string) {
+	mu.Lock()
+	defer mu.Unlock()
+	delete(heartbeats, worker)
+}
+
+// Reset drops every check and heartbeat
+func Reset() {
+	mu.Lock()
+	defer mu.Unlock()
+	checks = nil
+	heartbeats = make(map[string]heartbeat)
+}
+
+// Liveness reports the worker heartbeats only, so a dead dependency never gets the process restarted
+func Liveness() Report {
+	report := Report{Status: StatusOK, Checks: workerResults()}
+	for _, result := range report.Checks {
+		if result.Status != StatusOK {
+			report.Status = StatusUnavailable
+		}
+	}
+	return report
+}
+
+// Readiness runs every registered check concurrently, each bounded by the check timeout,
+// and adds the worker heartbeats as non-critical results
+func Readiness(ctx context.Context) Report {
+	mu.RLock()
+	registered := append([]Check(nil), checks...)
+	timeout := cfg.CheckTimeout
+	mu.RUnlock()
+
+	results := make([]Result, len(registered))
+	var wg sync.WaitGroup
+	for i, check := range registered {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i] = run(ctx, check, timeout)
+		}()
+	}
+	wg.Wait()
+
+	report := Report{Status: StatusOK, Checks: workerResults()}
+	for name, result := range report.Checks {
+		result.Critical = false
+		report.Checks[name] = result
+		if result.Status != StatusOK {
+			report.Status = StatusDegraded
+		}
+	}
+	for i, check := range registered {
+		report.Checks[check.Name] = results[i]
+		switch {
+		case results[i].Status == StatusOK:
+		case check.Critical:
+			report.Status = StatusUnavailable
+		case report.Status == StatusOK:
+			report.Status = StatusDegraded
+		}
+	}
+	return report
+}
+
+// Run one check, giving up once the timeout passes even if the check ignores its context
+func run(ctx context.Context, check Check, timeout time.Duration) Result {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	start := time.Now()
+	done := make(chan error, 1)
+	go func() { done <- check.Run(ctx) }()
+
+	var err error
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		err = fmt.Errorf("timed out after %s", timeout)
+	}
+
+	result := Result{Status: StatusOK, Critical: check.Critical, DurationMs: float64(time.Since(start).Microseconds()) / 1000}
+	if err != nil {
+		result.Status = StatusUnavailable
+		result.Error = err.Error()
+	}
+	return result
+}
+
+// One result per tracked worker, named worker:<name>
+func workerResults() map[string]Result {
+	mu.RLock()
+	defer mu.RUnlock()
+
+	results := make(map[string]Result, len(heartbeats))
+	for name, beat := range heartbeats {
+		result := Result{Status: StatusOK, Critical: true}
+		if age := time.Since(beat.last); age > beat.maxAge {
+			result.Status = StatusUnavailable
+			result.Error = fmt.Sprintf("no heartbeat for %s", age.Round(time.Second))
+		}
+		results["worker:"+name] = result
+	}
+	return results
+}
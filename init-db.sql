@@ -1,18 +1,202 @@
+-- Applied by docker-entrypoint-initdb.d to new databases, and by the service on every start
+-- (database.Migrate), so every statement must be safe to run again on an existing database
+
+-- Table: schema_migrations (One-time data migrations already applied by database.Migrate)
+CREATE TABLE IF NOT EXISTS schema_migrations (
+    name VARCHAR(128) PRIMARY KEY,
+    applied_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
 -- Table: urls (Stores URL Mappings)
 CREATE TABLE IF NOT EXISTS urls (
     short_url VARCHAR(124) PRIMARY KEY,
-    long_url TEXT UNIQUE NOT NULL,
+    long_url TEXT NOT NULL,
     created_at TIMESTAMPTZ DEFAULT NOW(),
-    expires_at TIMESTAMPTZ NULL
+    expires_at TIMESTAMPTZ NULL,
+    owner VARCHAR(64) NULL, -- API key owner allowed to manage the link, NULL for links created without auth
+    dedup_key TEXT NULL, -- SHA-256 of the normalized long URL, prefixed with the owner for per-owner dedup. NULL: not deduplicated
+    disabled BOOLEAN NOT NULL DEFAULT FALSE, -- Disabled links stop redirecting until enabled again
+    revision INT NOT NULL DEFAULT 1, -- Latest url_revisions entry, compared on update to detect concurrent edits
+    flagged BOOLEAN NOT NULL DEFAULT FALSE, -- Long URL matched a screening list on redirect
+    flag_reason TEXT NULL -- List rule the long URL matched, NULL unless flagged
 );
 
+-- Migration for databases created before link ownership
+ALTER TABLE urls ADD COLUMN IF NOT EXISTS owner VARCHAR(64) NULL;
+
+-- Migration for databases created before dedup policies: long URLs are no longer unique,
+-- expired links must not block re-creation
+ALTER TABLE urls DROP CONSTRAINT IF EXISTS urls_long_url_key;
+ALTER TABLE urls ADD COLUMN IF NOT EXISTS dedup_key TEXT NULL;
+
+-- Migration for databases created before link updates
+ALTER TABLE urls ADD COLUMN IF NOT EXISTS disabled BOOLEAN NOT NULL DEFAULT FALSE;
+ALTER TABLE urls ADD COLUMN IF NOT EXISTS revision INT NOT NULL DEFAULT 1;
+
+-- Migration for databases created before screening verdicts were stored
+ALTER TABLE urls ADD COLUMN IF NOT EXISTS flagged BOOLEAN NOT NULL DEFAULT FALSE;
+ALTER TABLE urls ADD COLUMN IF NOT EXISTS flag_reason TEXT NULL;
+
 -- Table: url_clicks (Tracks Click Events)
 CREATE TABLE IF NOT EXISTS url_clicks (
     id BIGSERIAL PRIMARY KEY,
     short_url VARCHAR(124) NOT NULL REFERENCES urls(short_url) ON DELETE CASCADE,
-    accessed_at TIMESTAMPTZ DEFAULT NOW()
+    accessed_at TIMESTAMPTZ DEFAULT NOW(),
+    referrer_host VARCHAR(255) NULL, -- Host of the Referer header
+    user_agent TEXT NULL,
+    ip VARCHAR(45) NULL, -- Client IP after anonymization (client_ip.privacy), NULL when IPs are not stored
+    language VARCHAR(35) NULL, -- Preferred Accept-Language tag
+    host VARCHAR(255) NULL, -- Host the short URL was requested on
+    device_type VARCHAR(16) NULL, -- desktop, mobile, tablet, tv, console, bot or other, from the user agent
+    os_family VARCHAR(32) NULL,
+    os_version VARCHAR(16) NULL,
+    browser_family VARCHAR(32) NULL, -- Name of the bot for bots
+    browser_version VARCHAR(16) NULL,
+    is_bot BOOLEAN NOT NULL DEFAULT FALSE, -- Crawlers and HTTP libraries, left out of click counts by default
+    country VARCHAR(2) NULL, -- ISO 3166-1 alpha-2 code from the GeoIP database (geoip.database)
+    region VARCHAR(128) NULL,
+    city VARCHAR(128) NULL,
+    asn BIGINT NULL -- Autonomous system number from geoip.asn_database
+);
+
+-- Migration for databases created before rich click capture
+ALTER TABLE url_clicks ADD COLUMN IF NOT EXISTS referrer_host VARCHAR(255) NULL;
+ALTER TABLE url_clicks ADD COLUMN IF NOT EXISTS user_agent TEXT NULL;
+ALTER TABLE url_clicks ADD COLUMN IF NOT EXISTS ip VARCHAR(45) NULL;
+ALTER TABLE url_clicks ADD COLUMN IF NOT EXISTS language VARCHAR(35) NULL;
+ALTER TABLE url_clicks ADD COLUMN IF NOT EXISTS host VARCHAR(255) NULL;
+
+-- Migration for databases created before user agent classification
+ALTER TABLE url_clicks ADD COLUMN IF NOT EXISTS device_type VARCHAR(16) NULL;
+ALTER TABLE url_clicks ADD COLUMN IF NOT EXISTS os_family VARCHAR(32) NULL;
+ALTER TABLE url_clicks ADD COLUMN IF NOT EXISTS os_version VARCHAR(16) NULL;
+ALTER TABLE url_clicks ADD COLUMN IF NOT EXISTS browser_family VARCHAR(32) NULL;
+ALTER TABLE url_clicks ADD COLUMN IF NOT EXISTS browser_version VARCHAR(16) NULL;
+ALTER TABLE url_clicks ADD COLUMN IF NOT EXISTS is_bot BOOLEAN NOT NULL DEFAULT FALSE;
+
+-- Migration for databases created before GeoIP enrichment
+ALTER TABLE url_clicks ADD COLUMN IF NOT EXISTS country VARCHAR(2) NULL;
+ALTER TABLE url_clicks ADD COLUMN IF NOT EXISTS region VARCHAR(128) NULL;
+ALTER TABLE url_clicks ADD COLUMN IF NOT EXISTS city VARCHAR(128) NULL;
+ALTER TABLE url_clicks ADD COLUMN IF NOT EXISTS asn BIGINT NULL;
+
+-- Table: urls_archive (Expired URL Mappings moved by the sweeper)
+CREATE TABLE IF NOT EXISTS urls_archive (
+    id BIGSERIAL PRIMARY KEY,
+    short_url VARCHAR(124) NOT NULL,
+    long_url TEXT NOT NULL,
+    created_at TIMESTAMPTZ,
+    expires_at TIMESTAMPTZ,
+    archived_at TIMESTAMPTZ DEFAULT NOW(),
+    owner VARCHAR(64) NULL
+);
+
+ALTER TABLE urls_archive ADD COLUMN IF NOT EXISTS owner VARCHAR(64) NULL;
+
+-- Table: url_clicks_archive (Click Events of archived URLs)
+CREATE TABLE IF NOT EXISTS url_clicks_archive (
+    id BIGINT PRIMARY KEY,
+    short_url VARCHAR(124) NOT NULL,
+    accessed_at TIMESTAMPTZ,
+    referrer_host VARCHAR(255) NULL,
+    user_agent TEXT NULL,
+    ip VARCHAR(45) NULL,
+    language VARCHAR(35) NULL,
+    host VARCHAR(255) NULL,
+    device_type VARCHAR(16) NULL,
+    os_family VARCHAR(32) NULL,
+    os_version VARCHAR(16) NULL,
+    browser_family VARCHAR(32) NULL,
+    browser_version VARCHAR(16) NULL,
+    is_bot BOOLEAN NOT NULL DEFAULT FALSE,
+    country VARCHAR(2) NULL,
+    region VARCHAR(128) NULL,
+    city VARCHAR(128) NULL,
+    asn BIGINT NULL
+);
+
+ALTER TABLE url_clicks_archive ADD COLUMN IF NOT EXISTS referrer_host VARCHAR(255) NULL;
+ALTER TABLE url_clicks_archive ADD COLUMN IF NOT EXISTS user_agent TEXT NULL;
+ALTER TABLE url_clicks_archive ADD COLUMN IF NOT EXISTS ip VARCHAR(45) NULL;
+ALTER TABLE url_clicks_archive ADD COLUMN IF NOT EXISTS language VARCHAR(35) NULL;
+ALTER TABLE url_clicks_archive ADD COLUMN IF NOT EXISTS host VARCHAR(255) NULL;
+ALTER TABLE url_clicks_archive ADD COLUMN IF NOT EXISTS device_type VARCHAR(16) NULL;
+ALTER TABLE url_clicks_archive ADD COLUMN IF NOT EXISTS os_family VARCHAR(32) NULL;
+ALTER TABLE url_clicks_archive ADD COLUMN IF NOT EXISTS os_version VARCHAR(16) NULL;
+ALTER TABLE url_clicks_archive ADD COLUMN IF NOT EXISTS browser_family VARCHAR(32) NULL;
+ALTER TABLE url_clicks_archive ADD COLUMN IF NOT EXISTS browser_version VARCHAR(16) NULL;
+ALTER TABLE url_clicks_archive ADD COLUMN IF NOT EXISTS is_bot BOOLEAN NOT NULL DEFAULT FALSE;
+ALTER TABLE url_clicks_archive ADD COLUMN IF NOT EXISTS country VARCHAR(2) NULL;
+ALTER TABLE url_clicks_archive ADD COLUMN IF NOT EXISTS region VARCHAR(128) NULL;
+ALTER TABLE url_clicks_archive ADD COLUMN IF NOT EXISTS city VARCHAR(128) NULL;
+ALTER TABLE url_clicks_archive ADD COLUMN IF NOT EXISTS asn BIGINT NULL;
+
+-- Table: url_revisions (Every state of a link, from creation through each update)
+CREATE TABLE IF NOT EXISTS url_revisions (
+    id BIGSERIAL PRIMARY KEY,
+    short_url VARCHAR(124) NOT NULL REFERENCES urls(short_url) ON DELETE CASCADE,
+    revision INT NOT NULL,
+    long_url TEXT NOT NULL,
+    expires_at TIMESTAMPTZ NULL,
+    enabled BOOLEAN NOT NULL,
+    flagged BOOLEAN NOT NULL DEFAULT FALSE,
+    flag_reason TEXT NULL,
+    changed_by VARCHAR(64) NULL, -- Owner of the API key that made the change
+    changed_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    UNIQUE (short_url, revision)
+);
+
+ALTER TABLE url_revisions ADD COLUMN IF NOT EXISTS flagged BOOLEAN NOT NULL DEFAULT FALSE;
+ALTER TABLE url_revisions ADD COLUMN IF NOT EXISTS flag_reason TEXT NULL;
+
+-- Backfill revision 1 of links created before link updates
+INSERT INTO url_revisions (short_url, revision, long_url, expires_at, enabled, changed_by, changed_at)
+SELECT short_url, 1, long_url, expires_at, NOT disabled, owner, COALESCE(created_at, NOW()) FROM urls
+WHERE revision = 1
+ON CONFLICT (short_url, revision) DO NOTHING;
+
+-- Table: url_click_rollups (Clicks per short URL and UTC hour, for time series)
+CREATE TABLE IF NOT EXISTS url_click_rollups (
+    short_url VARCHAR(124) NOT NULL REFERENCES urls(short_url) ON DELETE CASCADE,
+    hour TIMESTAMPTZ NOT NULL, -- Start of the hour
+    clicks BIGINT NOT NULL,
+    bot_clicks BIGINT NOT NULL,
+    PRIMARY KEY (short_url, hour)
+);
+
+-- Table: click_rollup_watermark (Single row, url_clicks before rolled_up_to are in url_click_rollups)
+CREATE TABLE IF NOT EXISTS click_rollup_watermark (
+    id INT PRIMARY KEY CHECK (id = 1),
+    rolled_up_to TIMESTAMPTZ NULL -- NULL until the first roll up, which starts at the oldest click
+);
+
+INSERT INTO click_rollup_watermark (id, rolled_up_to) VALUES (1, NULL) ON CONFLICT (id) DO NOTHING;
+
+-- Table: url_click_rollup_dirty (Hours before the watermark that got clicks after their roll up, rolled up again next time)
+CREATE TABLE IF NOT EXISTS url_click_rollup_dirty (
+    short_url VARCHAR(124) NOT NULL REFERENCES urls(short_url) ON DELETE CASCADE,
+    hour TIMESTAMPTZ NOT NULL, -- Start of the hour
+    PRIMARY KEY (short_url, hour)
+);
+
+-- Table: api_keys (API keys, only the SHA-256 hash of each key is stored)
+CREATE TABLE IF NOT EXISTS api_keys (
+    id BIGSERIAL PRIMARY KEY,
+    owner VARCHAR(64) NOT NULL,
+    key_prefix VARCHAR(16) NOT NULL, -- Leading characters of the key, to tell keys apart
+    key_hash CHAR(64) UNIQUE NOT NULL,
+    is_admin BOOLEAN NOT NULL DEFAULT FALSE,
+    created_at TIMESTAMPTZ DEFAULT NOW(),
+    revoked_at TIMESTAMPTZ NULL -- The key stops working at this time, set on revocation or rotation
 );
 
 -- Indexes for Performance Optimization
-CREATE INDEX idx_url_clicks_time ON url_clicks(accessed_at);
-CREATE INDEX idx_url_short_url ON url_clicks(short_url);
+CREATE INDEX IF NOT EXISTS idx_url_clicks_time ON url_clicks(accessed_at);
+CREATE INDEX IF NOT EXISTS idx_url_short_url ON url_clicks(short_url);
+CREATE INDEX IF NOT EXISTS idx_urls_expires_at ON urls(expires_at) WHERE expires_at IS NOT NULL;
+CREATE INDEX IF NOT EXISTS idx_urls_archive_short_url ON urls_archive(short_url);
+CREATE INDEX IF NOT EXISTS idx_url_clicks_archive_short_url ON url_clicks_archive(short_url);
+CREATE INDEX IF NOT EXISTS idx_urls_owner ON urls(owner);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_urls_dedup_key ON urls(dedup_key); -- Race-free dedup, NULLs never conflict
+CREATE INDEX IF NOT EXISTS idx_api_keys_owner ON api_keys(owner);
+CREATE INDEX IF NOT EXISTS idx_url_clicks_short_url_time ON url_clicks(short_url, accessed_at); -- Time series of one link
@@ -0,0 +1,127 @@
+package lifecycle
+
+import (
+	"context"
+	"log"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Manager owns the process lifetime: it runs background workers on a shared context and
+// shuts everything down in order on SIGINT/SIGTERM.
+//
+// Shutdown runs in three phases:
+//  1. stop hooks (OnStop), newest first, e.g. draining the HTTP server
+//  2. cancel the worker context and wait for every worker started with Go
+//  3. close hooks (OnClose), newest first, e.g. flushing buffers, then closing pools
+type Manager struct {
+	signalCtx  context.Context
+	stopSignal context.CancelFunc
+
+	workerCtx    context.Context
+	stopWorkers  context.CancelFunc
+	workers      sync.WaitGroup
+	mu           sync.Mutex
+	stopHooks    []hook
+	closeHooks   []hook
+	shutdownOnce sync.Once
+}
+
+type hook struct {
+	name string
+	fn   func(ctx context.Context) error
+}
+
+// New returns a Manager whose shutdown is triggered by SIGINT, SIGTERM or Trigger
+func New() *Manager {
+	signalCtx, stopSignal := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	workerCtx, stopWorkers := context.WithCancel(context.Background())
+	return &Manager{
+		signalCtx:   signalCtx,
+		stopSignal:  stopSignal,
+		workerCtx:   workerCtx,
+		stopWorkers: stopWorkers,
+	}
+}
+
+// Context is cancelled when workers should stop, pass it to everything started at boot
+func (m *Manager) Context() context.Context {
+	return m.workerCtx
+}
+
+// Go runs a background worker that must return once its context is cancelled
+func (m *Manager) Go(name string, worker func(ctx context.Context)) {
+	m.workers.Add(1)
+	go func() {
+		defer m.workers.Done()
+		worker(m.workerCtx)
+		log.Println("Stopped worker:", name)
+	}()
+}
+
+// OnStop registers a hook that runs before workers are stopped
+func (m *Manager) OnStop(name string, fn func(ctx context.Context) error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.stopHooks = append(m.stopHooks, hook{name, fn})
+}
+
+// OnClose registers a hook that runs after workers are stopped, in reverse registration
+// order, so resources opened first are closed last
+func (m *Manager) OnClose(name string, fn func(ctx context.Context) error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.closeHooks = append(m.closeHooks, hook{name, fn})
+}
+
+// Trigger starts shutdown as if a signal had been received, e.g. when the HTTP server fails
+func (m *Manager) Trigger() {
+	m.stopSignal()
+}
+
+// Wait blocks until shutdown is triggered
+func (m *Manager) Wait() {
+	<-m.signalCtx.Done()
+}
+
+// Shutdown runs the three shutdown phases, all bounded by timeout
+func (m *Manager) Shutdown(timeout time.Duration) {
+	m.shutdownOnce.Do(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+
+		m.mu.Lock()
+		stopHooks, closeHooks := m.stopHooks, m.closeHooks
+		m.mu.Unlock()
+
+		log.Println("Shutting down...")
+		runHooks(ctx, stopHooks)
+
+		m.stopWorkers()
+		done := make(chan struct{})
+		go func() {
+			m.workers.Wait()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-ctx.Done():
+			log.Println("Timed out waiting for workers to stop")
+		}
+
+		runHooks(ctx, closeHooks)
+		m.stopSignal()
+		log.Println("Shutdown complete")
+	})
+}
+
+// Run hooks newest first, logging failures without skipping the rest
+func runHooks(ctx context.Context, hooks []hook) {
+	for i := len(hooks) - 1; i >= 0; i-- {
+		if err := hooks[i].fn(ctx); err != nil {
+			log.Printf("Shutdown step %q failed: %v", hooks[i].name, err)
+		}
+	}
+}
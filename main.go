@@ -1,44 +1,198 @@
 package main
 
 import (
+	"context"
+	_ "embed"
+	"flag"
 	"log"
 	"net/http"
+	"os"
+	_ "time/tzdata" // Time zones of click time series, also in images without tzdata
 
+	"cloudflaretinyurl/auth"
+	"cloudflaretinyurl/clickingest"
+	"cloudflaretinyurl/clickrollup"
+	"cloudflaretinyurl/clientip"
+	"cloudflaretinyurl/config"
 	"cloudflaretinyurl/database"
+	"cloudflaretinyurl/geoip"
+	"cloudflaretinyurl/handlers"
+	"cloudflaretinyurl/health"
+	"cloudflaretinyurl/lifecycle"
+	"cloudflaretinyurl/metrics"
+	"cloudflaretinyurl/ratelimit"
 	"cloudflaretinyurl/rediscounter"
+	"cloudflaretinyurl/redislease"
 	"cloudflaretinyurl/redislocks"
 	"cloudflaretinyurl/redispubsub"
 	"cloudflaretinyurl/redisqueue"
 	"cloudflaretinyurl/routes"
+	"cloudflaretinyurl/screening"
+	"cloudflaretinyurl/sweeper"
+	"cloudflaretinyurl/tracing"
+	"cloudflaretinyurl/urlpolicy"
 	"cloudflaretinyurl/utils"
 )
 
+// PostgreSQL schema, applied on every start so existing databases are migrated
+//
+//go:embed init-db.sql
+var schema string
+
 func main() {
-	// Initialize PostgreSQL & Redis
-	if err := database.InitDB(); err != nil {
+	// Defaults < config file (-config / CONFIG_FILE) < environment < flags
+	cfg, err := config.Load(os.Args[1:])
+	if err == flag.ErrHelp {
+		return
+	}
+	if err != nil {
+		log.Fatalf("Configuration error: %v", err)
+	}
+	log.Printf("Effective configuration:\n%s", cfg)
+
+	// SIGINT/SIGTERM cancel lc.Context() and start an ordered shutdown
+	lc := lifecycle.New()
+	health.InitHealth(cfg.Health)
+
+	// Export spans until everything else has shut down
+	shutdownTracing, err := tracing.Init(lc.Context(), cfg.Tracing)
+	if err != nil {
+		log.Fatalf("Failed to initialize tracing: %v", err)
+	}
+	lc.OnClose("tracing", shutdownTracing)
+
+	// Handler settings and the URL policy, also used to migrate links stored by older versions
+	handlers.InitHandlers(cfg.Server, cfg.IDs, cfg.Dedup)
+	urlpolicy.InitURLPolicy(cfg.URLPolicy, cfg.Server.BaseURL)
+
+	// storage.backend=memory runs the API without PostgreSQL & Redis
+	memory := cfg.Storage.Backend == "memory"
+	if memory {
+		log.Println("Using in-memory storage backend")
+		database.InitMemory(cfg.Cache)
+	} else {
+		initPostgresRedis(lc, cfg)
+	}
+
+	// Require API keys, storing the configured bootstrap admin key so the first keys can be created
+	auth.InitAuth(cfg.Auth)
+	if err := auth.EnsureAdminKey(lc.Context()); err != nil {
+		log.Fatalf("Failed to store admin API key: %v", err)
+	}
+	if !auth.Enabled() {
+		log.Println("WARNING: API key authentication is disabled")
+	}
+
+	// Client IPs are read from X-Forwarded-For behind trusted proxies, for rate limits and clicks
+	clientip.InitClientIP(cfg.ClientIP)
+
+	// Clicks are geolocated from local MaxMind databases, re-read on SIGHUP
+	if err := geoip.InitGeoIP(cfg.GeoIP); err != nil {
+		log.Fatalf("Failed to load GeoIP databases: %v", err)
+	}
+	if geoip.Enabled() {
+		lc.Go("geoip reloader", geoip.WatchReload)
+	}
+
+	// Rate limits are shared through Redis, and per instance with the memory backend
+	if memory {
+		ratelimit.InitRateLimit(cfg.RateLimit, nil)
+	} else {
+		ratelimit.InitRateLimit(cfg.RateLimit, database.RDB)
+	}
+
+	// Initialize Snowflake ID generator, leasing a node ID from Redis unless overridden
+	initSnowflake(lc, cfg.IDs, !memory)
+
+	// Start batched click ingestion, drained before the database is closed
+	if err := clickingest.Start(cfg.Clicks); err != nil {
+		log.Fatalf("Failed to start click ingestion: %v", err)
+	}
+	lc.OnClose("click ingestion", clickingest.Stop)
+
+	// Set up API routes
+	if err := screening.InitScreening(cfg.Screening); err != nil {
+		log.Fatalf("Failed to load screening lists: %v", err)
+	}
+	if cfg.Screening.ListsDir != "" {
+		lc.Go("blocklist reloader", screening.WatchLists)
+	}
+	r := routes.InitRoutes()
+	server := &http.Server{Addr: cfg.Server.Addr, Handler: r}
+	lc.OnStop("http server", server.Shutdown)
+
+	go func() {
+		log.Println("Server is listening on", cfg.Server.Addr)
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Println("HTTP server failed:", err)
+			lc.Trigger()
+		}
+	}()
+
+	lc.Wait()
+	lc.Shutdown(cfg.Server.ShutdownTimeout)
+}
+
+// ids.snowflake_node_id pins the node ID, otherwise a free one is leased from Redis.
+// Without Redis there is a single instance, which uses node ID 1.
+func initSnowflake(lc *lifecycle.Manager, idConfig config.IDs, lease bool) {
+	if idConfig.SnowflakeNodeID >= 0 {
+		if err := utils.InitSnowflake(idConfig.SnowflakeNodeID); err != nil {
+			log.Fatalf("Failed to initialize Snowflake ID generator: %v", err)
+		}
+		log.Println("Using configured Snowflake node ID:", idConfig.SnowflakeNodeID)
+		return
+	}
+
+	if !lease {
+		if err := utils.InitSnowflake(1); err != nil {
+			log.Fatalf("Failed to initialize Snowflake ID generator: %v", err)
+		}
+		return
+	}
+
+	if _, err := redislease.LeaseNodeID(lc.Context()); err != nil {
+		log.Fatalf("Failed to lease Snowflake node ID: %v", err)
+	}
+	lc.OnClose("snowflake lease", redislease.Release)
+	health.AddCheck(health.Check{Name: "snowflake_lease", Run: redislease.Check})
+}
+
+// Initialize PostgreSQL, Redis and the Redis-backed background workers
+func initPostgresRedis(lc *lifecycle.Manager, cfg config.Config) {
+	// Initialize PostgreSQL & Redis, closed last on shutdown
+	if err := database.InitDB(lc.Context(), cfg.Postgres, cfg.Redis, cfg.Cache); err != nil {
 		log.Fatalf("Initialization Error: %v", err)
 	}
+	lc.OnClose("redis", func(context.Context) error { return database.CloseRedis() })
+	lc.OnClose("postgres", func(context.Context) error { return database.CloseDB() })
 
-	// Initialize Snowflake ID generator with machine ID 1
-	if err := utils.InitSnowflake(1); err != nil {
-		log.Fatalf("Failed to initialize Snowflake ID generator: %v", err)
+	// Bring databases created by older versions up to the current schema
+	if err := database.Migrate(lc.Context(), schema, handlers.LegacyDedupKey); err != nil {
+		log.Fatalf("Failed to migrate PostgreSQL: %v", err)
 	}
+	health.AddCheck(health.Check{Name: "postgres", Critical: true, Run: database.PingDB})
+	health.AddCheck(health.Check{Name: "redis", Critical: true, Run: database.PingRedis})
+	metrics.RegisterPools(database.DB, database.RDB)
 
 	// Initialize Redis-based services (Counters, Queues, Pub/Sub, Locks)
 	rediscounter.InitRedisCounter(database.RDB)
-	redisqueue.InitRedisQueue(database.RDB)
+	redisqueue.InitRedisQueue(database.RDB, cfg.Queue)
 	redispubsub.InitRedisPubSub(database.RDB)
 	redislocks.InitRedisLocks(database.RDB)
+	health.AddCheck(health.Check{Name: "keyspace_notifications", Run: redispubsub.CheckKeyspaceNotifications})
 
 	// Start processing expired clicks in a separate goroutine
-	go redisqueue.ProcessExpiredClicks()
+	lc.Go("expired click queue", redisqueue.ProcessExpiredClicks)
 
 	// Start listening for Redis Pub/Sub events
-	go redispubsub.ListenForExpiredClicks()
+	lc.Go("expired click listener", redispubsub.ListenForExpiredClicks)
 
-	// Set up API routes
-	r := routes.InitRoutes()
+	// Start archiving expired URLs (one instance at a time)
+	sweeper.InitSweeper(cfg.Sweeper)
+	lc.Go("expired URL sweeper", sweeper.StartExpiredURLSweeper)
 
-	log.Println("Server is running on port 8080...")
-	http.ListenAndServe(":8080", r)
+	// Roll up clicks per hour for time series (one instance at a time)
+	clickrollup.InitClickRollup(cfg.Rollups)
+	lc.Go("click rollup", clickrollup.StartClickRollup)
 }
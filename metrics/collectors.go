@@ -0,0 +1,104 @@
+package metrics
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/redis/go-redis/v9"
+)
+
+// How long a scrape waits for Redis to report queue lengths
+const scrapeTimeout = 2 * time.Second
+
+// queueDepthCollector reads queue lengths from Redis on every scrape
+type queueDepthCollector struct {
+	mu    sync.RWMutex
+	depth func(ctx context.Context) (map[string]int64, error)
+	desc  *prometheus.Desc
+}
+
+var queueDepth = &queueDepthCollector{
+	desc: prometheus.NewDesc(namespace+"_queue_depth", "Items waiting per expired click queue (queue, processing, retry, dead_letter).", []string{"queue"}, nil),
+}
+
+// SetQueueDepthFunc sets how queue lengths are read, nil stops reporting them
+func SetQueueDepthFunc(depth func(ctx context.Context) (map[string]int64, error)) {
+	queueDepth.mu.Lock()
+	defer queueDepth.mu.Unlock()
+	queueDepth.depth = depth
+}
+
+func (c *queueDepthCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+func (c *queueDepthCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mu.RLock()
+	depth := c.depth
+	c.mu.RUnlock()
+	if depth == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), scrapeTimeout)
+	defer cancel()
+	lengths, err := depth(ctx)
+	if err != nil {
+		log.Println("Failed to read queue depth for metrics:", err)
+		return
+	}
+	for queue, length := range lengths {
+		ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, float64(length), queue)
+	}
+}
+
+// redisPoolCollector exposes go-redis connection pool statistics
+type redisPoolCollector struct {
+	client *redis.Client
+
+	hits, misses, timeouts, total, idle, stale *prometheus.Desc
+}
+
+func newRedisPoolCollector(client *redis.Client) *redisPoolCollector {
+	desc := func(name, help string) *prometheus.Desc {
+		return prometheus.NewDesc(namespace+"_redis_pool_"+name, help, nil, nil)
+	}
+	return &redisPoolCollector{
+		client:   client,
+		hits:     desc("hits_total", "Times a free connection was found in the pool."),
+		misses:   desc("misses_total", "Times a free connection was not found in the pool."),
+		timeouts: desc("timeouts_total", "Times a wait for a connection timed out."),
+		total:    desc("connections", "Connections in the pool."),
+		idle:     desc("idle_connections", "Idle connections in the pool."),
+		stale:    desc("stale_connections_total", "Stale connections removed from the pool."),
+	}
+}
+
+func (c *redisPoolCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, d := range []*prometheus.Desc{c.hits, c.misses, c.timeouts, c.total, c.idle, c.stale} {
+		ch <- d
+	}
+}
+
+func (c *redisPoolCollector) Collect(ch chan<- prometheus.Metric) {
+	stats := c.client.PoolStats()
+	ch <- prometheus.MustNewConstMetric(c.hits, prometheus.CounterValue, float64(stats.Hits))
+	ch <- prometheus.MustNewConstMetric(c.misses, prometheus.CounterValue, float64(stats.Misses))
+	ch <- prometheus.MustNewConstMetric(c.timeouts, prometheus.CounterValue, float64(stats.Timeouts))
+	ch <- prometheus.MustNewConstMetric(c.total, prometheus.GaugeValue, float64(stats.TotalConns))
+	ch <- prometheus.MustNewConstMetric(c.idle, prometheus.GaugeValue, float64(stats.IdleConns))
+	ch <- prometheus.MustNewConstMetric(c.stale, prometheus.CounterValue, float64(stats.StaleConns))
+}
+
+// Expose PostgreSQL and Redis connection pool statistics
+func RegisterPools(db *sql.DB, rdb *redis.Client) {
+	Registry.MustRegister(
+		collectors.NewDBStatsCollector(db, "postgres"),
+		newRedisPoolCollector(rdb),
+	)
+}
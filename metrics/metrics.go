@@ -0,0 +1,99 @@
+package metrics
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "tinyurl"
+
+// Registry holds every metric served on /metrics
+var Registry = prometheus.NewRegistry()
+
+var (
+	HTTPRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "http_requests_total",
+		Help:      "HTTP requests by route template, method and status code.",
+	}, []string{"route", "method", "code"})
+
+	HTTPDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "HTTP request latency by route template and method.",
+		Buckets:   []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5},
+	}, []string{"route", "method"})
+
+	CacheLookups = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "redirect_cache_lookups_total",
+		Help:      "Redirect cache lookups by result (hit, miss).",
+	}, []string{"result"})
+
+	CounterDecrements = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "click_counter_decrements_total",
+		Help:      "Expired click removals from the rolling counters by outcome (ok, invalid_key, error).",
+	}, []string{"outcome"})
+
+	LockAcquisitions = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "lock_acquisitions_total",
+		Help:      "Distributed lock acquisition attempts by lock name and outcome (acquired, contended, error).",
+	}, []string{"lock", "outcome"})
+
+	LocksLost = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "locks_lost_total",
+		Help:      "Held distributed locks found taken over on renewal or release, by lock name.",
+	}, []string{"lock"})
+
+	RateLimited = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "rate_limited_requests_total",
+		Help:      "Requests rejected with 429 by rate limit policy (api_key, ip, short_code).",
+	}, []string{"policy"})
+
+	ScreeningMatches = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "screening_matches_total",
+		Help:      "Long URLs matching a blocklist by stage (create, update, redirect) and rule kind (domain, url, regex, hash_prefix).",
+	}, []string{"stage", "kind"})
+
+	RateLimitFallbacks = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "rate_limit_fallbacks_total",
+		Help:      "Rate limit decisions made by the per-instance in-memory limiter because Redis was unavailable.",
+	})
+)
+
+// Cache lookup results
+const (
+	CacheHit  = "hit"
+	CacheMiss = "miss"
+)
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		HTTPRequests,
+		HTTPDuration,
+		CacheLookups,
+		CounterDecrements,
+		LockAcquisitions,
+		LocksLost,
+		RateLimited,
+		RateLimitFallbacks,
+		ScreeningMatches,
+		queueDepth,
+	)
+}
+
+// Handler serves the registry in the Prometheus text format
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{})
+}
@@ -0,0 +1,81 @@
+package ratelimit
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"cloudflaretinyurl/auth"
+	"cloudflaretinyurl/clientip"
+	"cloudflaretinyurl/metrics"
+
+	"github.com/gorilla/mux"
+)
+
+// Middleware limits requests under the named policy by the identity key returns. Requests
+// key returns "" for, and every request while the policy is disabled, pass unlimited.
+// Rejected requests get 429 with Retry-After, all limited requests X-RateLimit-* headers.
+func Middleware(name string, key func(*http.Request) string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			policy, ok := policies[name]
+			id := key(r)
+			if !ok || id == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			result := Allow(r.Context(), policy, id)
+			w.Header().Set("X-RateLimit-Limit", strconv.Itoa(result.Limit))
+			w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(result.Remaining))
+			w.Header().Set("X-RateLimit-Reset", strconv.Itoa(seconds(result.ResetAfter)))
+			if !result.Allowed {
+				metrics.RateLimited.WithLabelValues(name).Inc()
+				w.Header().Set("Retry-After", strconv.Itoa(max(seconds(result.RetryAfter), 1)))
+				http.Error(w, "Rate limit exceeded", http.StatusTooManyRequests)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// PerIP limits requests by client IP
+func PerIP(next http.Handler) http.Handler {
+	return Middleware(PolicyIP, ClientIP)(next)
+}
+
+// PerAPIKey limits requests by API key, it must run after auth.Middleware
+func PerAPIKey(next http.Handler) http.Handler {
+	return Middleware(PolicyAPIKey, APIKeyID)(next)
+}
+
+// PerShortCode limits requests by the {shortURL} route variable
+func PerShortCode(next http.Handler) http.Handler {
+	return Middleware(PolicyShortCode, ShortCode)(next)
+}
+
+// ClientIP identifies callers by their IP, read from X-Forwarded-For behind trusted proxies
+func ClientIP(r *http.Request) string {
+	return clientip.FromRequest(r)
+}
+
+// APIKeyID identifies callers by their API key, requests without one (auth disabled) are not limited
+func APIKeyID(r *http.Request) string {
+	principal, _ := auth.FromContext(r.Context())
+	if principal.KeyID == 0 {
+		return ""
+	}
+	return strconv.FormatInt(principal.KeyID, 10)
+}
+
+// ShortCode identifies the requested link
+func ShortCode(r *http.Request) string {
+	return mux.Vars(r)["shortURL"]
+}
+
+// Whole seconds, rounded up so clients never retry too early
+func seconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
@@ -0,0 +1,190 @@
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"log"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"cloudflaretinyurl/config"
+	"cloudflaretinyurl/metrics"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Policy names, used as metric label and in Redis keys
+const (
+	PolicyAPIKey    = "api_key"
+	PolicyIP        = "ip"
+	PolicyShortCode = "short_code"
+)
+
+// Policy allows Rate requests per second on average, in bursts of up to Burst requests
+type Policy struct {
+	Name  string
+	Rate  float64
+	Burst int
+}
+
+// Result of one rate limit check
+type Result struct {
+	Allowed    bool
+	Limit      int
+	Remaining  int
+	RetryAfter time.Duration // Until a request is allowed again, set when denied
+	ResetAfter time.Duration // Until the full burst is available again
+}
+
+// After a Redis error the in-memory limiter is used for this long, so an outage
+// does not add a failing round trip to every request
+const redisRetryInterval = time.Second
+
+var (
+	rdb            *redis.Client
+	policies       = policiesFrom(config.Default().RateLimit)
+	local          = newMemoryLimiter()
+	redisDownUntil atomic.Int64 // Unix nanoseconds
+)
+
+// GCRA (generic cell rate algorithm): KEYS[1] holds the theoretical arrival time (TAT) of the
+// next request in milliseconds of Redis server time. A request is allowed unless it would push
+// the TAT more than burst emission intervals past now.
+// ARGV: emission interval in ms, burst. Returns {allowed, remaining, retry after ms, reset after ms}.
+var gcraScript = redis.NewScript(`
+local time = redis.call('TIME')
+local now = tonumber(time[1]) * 1000 + tonumber(time[2]) / 1000
+local interval = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+
+local tat = tonumber(redis.call('GET', KEYS[1])) or now
+if tat < now then
+	tat = now
+end
+local newTat = tat + interval
+local allowAt = newTat - burst * interval
+if allowAt > now then
+	return {0, 0, math.ceil(allowAt - now), math.ceil(tat - now)}
+end
+
+redis.call('SET', KEYS[1], string.format('%.3f', newTat), 'PX', math.ceil(newTat - now))
+return {1, math.floor((now - allowAt) / interval), 0, math.ceil(newTat - now)}
+`)
+
+// Initialize the rate limit policies. Without a Redis client limits are per instance.
+func InitRateLimit(cfg config.RateLimit, redisClient *redis.Client) {
+	rdb = redisClient
+	policies = policiesFrom(cfg)
+	local = newMemoryLimiter()
+	redisDownUntil.Store(0)
+}
+
+// Enabled policies by name, a zero rate disables a policy
+func policiesFrom(cfg config.RateLimit) map[string]Policy {
+	enabled := map[string]Policy{}
+	if !cfg.Enabled {
+		return enabled
+	}
+	for _, policy := range []Policy{
+		{PolicyAPIKey, cfg.APIKeyRate, cfg.APIKeyBurst},
+		{PolicyIP, cfg.IPRate, cfg.IPBurst},
+		{PolicyShortCode, cfg.ShortCodeRate, cfg.ShortCodeBurst},
+	} {
+		if policy.Rate > 0 {
+			enabled[policy.Name] = policy
+		}
+	}
+	return enabled
+}
+
+// Interval between requests at the policy's average rate
+func (p Policy) interval() time.Duration {
+	return time.Duration(float64(time.Second) / p.Rate)
+}
+
+// Allow counts a request by id against the policy, shared by every instance through Redis.
+// While Redis is unavailable each instance enforces the policy on its own.
+func Allow(ctx context.Context, policy Policy, id string) Result {
+	key := "ratelimit:" + policy.Name + ":" + id
+
+	if rdb != nil && time.Now().UnixNano() >= redisDownUntil.Load() {
+		result, err := allowRedis(ctx, key, policy)
+		if err == nil {
+			return result
+		}
+		// A canceled or timed out request says nothing about Redis, only its own check falls back
+		if !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded) {
+			log.Println("Rate limiter falling back to memory, Redis error:", err)
+			redisDownUntil.Store(time.Now().Add(redisRetryInterval).UnixNano())
+		}
+	}
+
+	if rdb != nil {
+		metrics.RateLimitFallbacks.Inc()
+	}
+	return local.allow(key, policy, time.Now())
+}
+
+func allowRedis(ctx context.Context, key string, policy Policy) (Result, error) {
+	interval := float64(policy.interval()) / float64(time.Millisecond)
+	values, err := gcraScript.Run(ctx, rdb, []string{key}, interval, policy.Burst).Int64Slice()
+	if err != nil {
+		return Result{}, err
+	}
+	return Result{
+		Allowed:    values[0] == 1,
+		Limit:      policy.Burst,
+		Remaining:  int(values[1]),
+		RetryAfter: time.Duration(values[2]) * time.Millisecond,
+		ResetAfter: time.Duration(values[3]) * time.Millisecond,
+	}, nil
+}
+
+// How often the in-memory limiter forgets identities whose bucket is full again
+const pruneInterval = time.Minute
+
+// memoryLimiter applies the same GCRA as the Lua script to TATs held in process memory
+type memoryLimiter struct {
+	mu        sync.Mutex
+	tats      map[string]time.Time
+	lastPrune time.Time
+}
+
+func newMemoryLimiter() *memoryLimiter {
+	return &memoryLimiter{tats: map[string]time.Time{}, lastPrune: time.Now()}
+}
+
+func (m *memoryLimiter) allow(key string, policy Policy, now time.Time) Result {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if now.Sub(m.lastPrune) >= pruneInterval {
+		for k, tat := range m.tats {
+			if tat.Before(now) {
+				delete(m.tats, k)
+			}
+		}
+		m.lastPrune = now
+	}
+
+	interval := policy.interval()
+	tat := m.tats[key]
+	if tat.Before(now) {
+		tat = now
+	}
+	newTat := tat.Add(interval)
+	allowAt := newTat.Add(-time.Duration(policy.Burst) * interval)
+	if allowAt.After(now) {
+		return Result{Limit: policy.Burst, RetryAfter: allowAt.Sub(now), ResetAfter: tat.Sub(now)}
+	}
+
+	m.tats[key] = newTat
+	return Result{
+		Allowed:    true,
+		Limit:      policy.Burst,
+		Remaining:  int(math.Floor(float64(now.Sub(allowAt)) / float64(interval))),
+		ResetAfter: newTat.Sub(now),
+	}
+}
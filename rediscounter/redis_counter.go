@@ -4,133 +4,228 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"strconv"
 	"time"
 
+	"cloudflaretinyurl/metrics"
+	"cloudflaretinyurl/tracing"
 	"cloudflaretinyurl/utils"
 
 	"github.com/redis/go-redis/v9"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 var rdb *redis.Client
 
+// Longest rolling window, clicks older than this are trimmed from the window set
+const windowRetention = 7 * 24 * time.Hour
+
 func InitRedisCounter(redisClient *redis.Client) {
 	rdb = redisClient
 }
 
-// Extracts shortURL from Snowflake ID and updates global counters
-func UpdateGlobalCounter(snowflakeID string) {
-	ctx := context.Background()
+// Redis keys holding the counters of a short URL, bot clicks are counted under their own keys
+func allTimeKey(shortURL string, bot bool) string {
+	if bot {
+		return fmt.Sprintf("count:%s:bot_all_time", shortURL)
+	}
+	return fmt.Sprintf("count:%s:all_time", shortURL)
+}
 
-	// Extract shortURL from the Snowflake ID
+// Sorted set of click snowflake IDs scored by click time (ms), backing the 1min/24h/week windows
+func windowKey(shortURL string, bot bool) string {
+	if bot {
+		return fmt.Sprintf("count:%s:bot_window", shortURL)
+	}
+	return fmt.Sprintf("count:%s:window", shortURL)
+}
+
+// Sorted set of short URLs scored by their clicks in one UTC hour, bots left out, backing the top ranking
+func topKey(hour time.Time) string {
+	return "top:" + hour.UTC().Format("2006010215")
+}
+
+// Keys of the current hour and the hours before it, hours in all
+func topKeys(now time.Time, hours int) []string {
+	keys := make([]string, hours)
+	for i := range keys {
+		keys[i] = topKey(now.Add(-time.Duration(i) * time.Hour))
+	}
+	return keys
+}
+
+// Extracts shortURL from Snowflake ID and updates global counters, or the bot counters for bot clicks
+func UpdateGlobalCounter(ctx context.Context, snowflakeID string, bot bool) {
+	ctx, span := tracing.Start(ctx, "rediscounter.UpdateGlobalCounter", attribute.String("click.key", snowflakeID), attribute.Bool("click.bot", bot))
+	var err error
+	defer func() { tracing.End(span, err) }()
+
+	// Extract shortURL and click time from the Snowflake ID
 	shortURL, err := utils.DecodeShortURLFromSnowflakeID(snowflakeID)
 	if err != nil {
 		log.Println("Error extracting shortURL from Snowflake ID:", err)
 		return
 	}
+	id, clickedAt, err := utils.DecodeSnowflakeFromClickKey(snowflakeID)
+	if err != nil {
+		log.Println("Error extracting timestamp from Snowflake ID:", err)
+		return
+	}
 
-	// Generate Redis keys
-	allTimeKey := fmt.Sprintf("count:%s:all_time", shortURL)
-	last24hKey := fmt.Sprintf("count:%s:24h", shortURL)
-	lastWeekKey := fmt.Sprintf("count:%s:week", shortURL)
-	last1minKey := fmt.Sprintf("count:%s:1min", shortURL)
-
-	// Atomic counter update
-	err = rdb.Watch(ctx, func(tx *redis.Tx) error {
-		_, err := tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
-			pipe.Incr(ctx, allTimeKey)
-			pipe.Incr(ctx, last1minKey)
-			pipe.Expire(ctx, last1minKey, 1*time.Minute) // Set TTL for 1min counter
-			pipe.Incr(ctx, last24hKey)
-			pipe.Expire(ctx, last24hKey, 24*time.Hour) // Set TTL for 24h counter
-			pipe.Incr(ctx, lastWeekKey)
-			pipe.Expire(ctx, lastWeekKey, 7*24*time.Hour) // Set TTL for week counter
-			return nil
-		})
-		return err
-	}, allTimeKey, last24hKey, lastWeekKey, last1minKey)
+	window := windowKey(shortURL, bot)
+	cutoff := time.Now().Add(-windowRetention).UnixMilli()
+
+	// Record the click, trim clicks that left the longest window and write the click
+	// key whose expiry feeds the expired click queue
+	_, err = rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Incr(ctx, allTimeKey(shortURL, bot))
+		pipe.ZAdd(ctx, window, redis.Z{Score: float64(clickedAt), Member: strconv.FormatInt(id, 10)})
+		pipe.ZRemRangeByScore(ctx, window, "-inf", fmt.Sprintf("(%d", cutoff))
+		pipe.Expire(ctx, window, windowRetention) // An idle link's window empties completely
+		pipe.Set(ctx, snowflakeID, "", windowRetention)
+		if !bot {
+			top := topKey(time.UnixMilli(clickedAt))
+			pipe.ZIncrBy(ctx, top, 1, shortURL)
+			pipe.Expire(ctx, top, windowRetention+time.Hour) // Outlives the longest ranking window
+		}
+		return nil
+	})
 
 	if err != nil {
 		log.Println("Error updating global counter:", err)
 	}
 }
 
-// Decrement the global counter ensuring values do not go below zero
-func DecrementGlobalCounter(snowflakeID string) error {
-	ctx := context.Background()
+// Remove an expired click from the window set, safe to call more than once per click
+func DecrementGlobalCounter(ctx context.Context, snowflakeID string) error {
+	ctx, span := tracing.Start(ctx, "rediscounter.DecrementGlobalCounter", attribute.String("click.key", snowflakeID))
+	var err error
+	defer func() { tracing.End(span, err) }()
 
 	// Extract shortURL from the Snowflake ID
 	shortURL, err := utils.DecodeShortURLFromSnowflakeID(snowflakeID)
 	if err != nil {
 		log.Println("Error extracting shortURL from Snowflake ID:", err)
+		metrics.CounterDecrements.WithLabelValues("invalid_key").Inc()
 		return err
 	}
-
-	// Generate Redis keys
-	last24hKey := fmt.Sprintf("count:%s:24h", shortURL)
-	lastWeekKey := fmt.Sprintf("count:%s:week", shortURL)
-	last1minKey := fmt.Sprintf("count:%s:1min", shortURL)
-
-	// Ensure counters do not go below zero
-	err = rdb.Watch(ctx, func(tx *redis.Tx) error {
-		count24h, _ := tx.Get(ctx, last24hKey).Int()
-		countWeek, _ := tx.Get(ctx, lastWeekKey).Int()
-		count1min, _ := tx.Get(ctx, last1minKey).Int()
-
-		_, err := tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
-			if count24h > 0 {
-				pipe.Decr(ctx, last24hKey)
-			}
-			if countWeek > 0 {
-				pipe.Decr(ctx, lastWeekKey)
-			}
-			if count1min > 0 {
-				pipe.Decr(ctx, last1minKey)
-			}
-			return nil
-		})
+	id, _, err := utils.DecodeSnowflakeFromClickKey(snowflakeID)
+	if err != nil {
+		log.Println("Error extracting timestamp from Snowflake ID:", err)
+		metrics.CounterDecrements.WithLabelValues("invalid_key").Inc()
 		return err
-	}, last24hKey, lastWeekKey, last1minKey)
+	}
 
+	// Click keys do not tell bots apart, the ID is in at most one of the windows
+	member := strconv.FormatInt(id, 10)
+	_, err = rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.ZRem(ctx, windowKey(shortURL, false), member)
+		pipe.ZRem(ctx, windowKey(shortURL, true), member)
+		return nil
+	})
 	if err != nil {
 		log.Println("Error decrementing global counter:", err)
+		metrics.CounterDecrements.WithLabelValues("error").Inc()
+		return err
 	}
-	return err
+	metrics.CounterDecrements.WithLabelValues("ok").Inc()
+	return nil
 }
 
-// Retrieves the count from Redis for a given shortURL with race condition prevention
-func GetURLCounter(shortURL string) (int, int, int, int, error) {
-	ctx := context.Background()
-
-	// Define Redis keys
-	allTimeKey := fmt.Sprintf("count:%s:all_time", shortURL)
-	last1minKey := fmt.Sprintf("count:%s:1min", shortURL)
-	last24hKey := fmt.Sprintf("count:%s:24h", shortURL)
-	lastWeekKey := fmt.Sprintf("count:%s:week", shortURL)
-
-	// Start a pipeline to fetch multiple keys in one go
-	pipe := rdb.Pipeline()
+// Retrieves the all-time count and the sliding window counts from Redis for a given shortURL,
+// adding the bot counters when includeBots is set
+func GetURLCounter(ctx context.Context, shortURL string, includeBots bool) (int, int, int, int, error) {
+	ctx, span := tracing.Start(ctx, "rediscounter.GetURLCounter", attribute.String("short_url", shortURL), attribute.Bool("include_bots", includeBots))
+	var err error
+	defer func() { tracing.End(span, err) }()
 
-	allTimeCmd := pipe.Get(ctx, allTimeKey)
-	last1minCmd := pipe.Get(ctx, last1minKey)
-	last24hCmd := pipe.Get(ctx, last24hKey)
-	lastWeekCmd := pipe.Get(ctx, lastWeekKey)
+	now := time.Now()
+	since := func(d time.Duration) string {
+		return strconv.FormatInt(now.Add(-d).UnixMilli(), 10)
+	}
+	kinds := []bool{false}
+	if includeBots {
+		kinds = append(kinds, true)
+	}
 
-	// Execute the pipeline
-	_, err := pipe.Exec(ctx)
-	if err != nil && err != redis.Nil {
+	// Trim and count inside one transaction so all windows see the same set
+	var allTimeCmds []*redis.StringCmd
+	var last1minCmds, last24hCmds, lastWeekCmds []*redis.IntCmd
+	_, err = rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, bot := range kinds {
+			window := windowKey(shortURL, bot)
+			pipe.ZRemRangeByScore(ctx, window, "-inf", "("+since(windowRetention))
+			allTimeCmds = append(allTimeCmds, pipe.Get(ctx, allTimeKey(shortURL, bot)))
+			last1minCmds = append(last1minCmds, pipe.ZCount(ctx, window, since(time.Minute), "+inf"))
+			last24hCmds = append(last24hCmds, pipe.ZCount(ctx, window, since(24*time.Hour), "+inf"))
+			lastWeekCmds = append(lastWeekCmds, pipe.ZCard(ctx, window))
+		}
+		return nil
+	})
+	if err == redis.Nil {
+		err = nil // A missing all-time key counts as 0 below
+	}
+	if err != nil {
 		log.Println("Error executing Redis pipeline:", err)
 		return 0, 0, 0, 0, err
 	}
 
-	// Convert Redis responses, ensuring missing values default to 0
-	allTime, _ := safeRedisGet(allTimeCmd)
-	last1min, _ := safeRedisGet(last1minCmd)
-	last24h, _ := safeRedisGet(last24hCmd)
-	lastWeek, _ := safeRedisGet(lastWeekCmd)
-
+	// Convert Redis responses, ensuring a missing all-time key defaults to 0
+	var allTime, last24h, lastWeek, last1min int
+	for i := range kinds {
+		count, _ := safeRedisGet(allTimeCmds[i])
+		allTime += count
+		last24h += int(last24hCmds[i].Val())
+		lastWeek += int(lastWeekCmds[i].Val())
+		last1min += int(last1minCmds[i].Val())
+	}
 	return allTime, last24h, lastWeek, last1min, nil
 }
 
+// TopURL is a short URL ranked by its clicks
+type TopURL struct {
+	ShortURL string
+	Clicks   int
+}
+
+// Rank the short URLs with the most clicks in the current hour and the hours-1 hours before it
+func GetTopURLs(ctx context.Context, hours, limit int) ([]TopURL, error) {
+	ctx, span := tracing.Start(ctx, "rediscounter.GetTopURLs", attribute.Int("top.hours", hours), attribute.Int("top.limit", limit))
+	var err error
+	defer func() { tracing.End(span, err) }()
+
+	// Sum the hours into a scratch key, read the top of it and drop it in one transaction
+	scratch := fmt.Sprintf("top:window:%dh", hours)
+	var ranked *redis.ZSliceCmd
+	_, err = rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.ZUnionStore(ctx, scratch, &redis.ZStore{Keys: topKeys(time.Now(), hours)})
+		ranked = pipe.ZRevRangeWithScores(ctx, scratch, 0, int64(limit-1))
+		pipe.Del(ctx, scratch)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	top := make([]TopURL, 0, len(ranked.Val()))
+	for _, z := range ranked.Val() {
+		top = append(top, TopURL{ShortURL: z.Member.(string), Clicks: int(z.Score)})
+	}
+	return top, nil
+}
+
+// Delete every counter key of a short URL and drop it from the top ranking
+func DeleteURLCounters(ctx context.Context, shortURL string) error {
+	_, err := rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Del(ctx, allTimeKey(shortURL, false), windowKey(shortURL, false), allTimeKey(shortURL, true), windowKey(shortURL, true))
+		for _, top := range topKeys(time.Now(), int(windowRetention/time.Hour)+1) {
+			pipe.ZRem(ctx, top, shortURL)
+		}
+		return nil
+	})
+	return err
+}
+
 // Helper function to safely parse Redis responses, returning 0 for missing keys
 func safeRedisGet(cmd *redis.StringCmd) (int, error) {
 	val, err := cmd.Int()
@@ -0,0 +1,191 @@
+package redislease
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"sync"
+	"time"
+
+	"cloudflaretinyurl/health"
+	"cloudflaretinyurl/redislocks"
+	"cloudflaretinyurl/utils"
+)
+
+const (
+	keyPrefix     = "snowflake_node:" // + node ID, held by the instance generating IDs with it
+	maxNodeID     = 1023              // Snowflake supports 10-bit node IDs
+	leaseTTL      = 30 * time.Second
+	renewInterval = leaseTTL / 3
+	retryInterval = 5 * time.Second
+	workerName    = "snowflake lease"
+)
+
+var ErrNoFreeNodeID = errors.New("no free snowflake node ID")
+
+var (
+	mu      sync.Mutex
+	current *redislocks.Lock
+	nodeID  int64
+	stopCh  chan struct{}
+	doneCh  chan struct{}
+)
+
+// Claim a free Snowflake node ID, initialize the generator with it and keep the lease alive.
+// Requires redislocks to be initialized.
+func LeaseNodeID(ctx context.Context) (int64, error) {
+	id, lock, err := claim(ctx)
+	if err != nil {
+		return 0, err
+	}
+	if err := utils.InitSnowflake(id); err != nil {
+		lock.Release(ctx)
+		return 0, err
+	}
+
+	mu.Lock()
+	current, nodeID = lock, id
+	stopCh, doneCh = make(chan struct{}), make(chan struct{})
+	go maintain(stopCh, doneCh)
+	mu.Unlock()
+
+	log.Println("Leased Snowflake node ID", id)
+	return id, nil
+}
+
+// NodeID returns the leased node ID and whether the lease is currently held
+func NodeID() (int64, bool) {
+	mu.Lock()
+	defer mu.Unlock()
+	return nodeID, current != nil
+}
+
+// Check fails while a started lease is not held, i.e. ID generation is disabled
+func Check(ctx context.Context) error {
+	mu.Lock()
+	defer mu.Unlock()
+	if stopCh != nil && current == nil {
+		return errors.New("snowflake node ID lease lost, ID generation disabled")
+	}
+	return nil
+}
+
+// Release stops ID generation and hands the node ID back for other instances
+func Release(ctx context.Context) error {
+	mu.Lock()
+	stop, done := stopCh, doneCh
+	stopCh = nil
+	mu.Unlock()
+	if stop == nil {
+		return nil
+	}
+
+	close(stop)
+	<-done
+
+	utils.DisableSnowflake()
+	mu.Lock()
+	defer mu.Unlock()
+	if current == nil {
+		return nil
+	}
+	err := current.Release(ctx)
+	current = nil
+	log.Println("Released Snowflake node ID", nodeID)
+	return err
+}
+
+// Try every node ID once, starting at a random one so concurrent starts rarely contend
+func claim(ctx context.Context) (int64, *redislocks.Lock, error) {
+	start := rand.Int63n(maxNodeID + 1)
+	for i := int64(0); i <= maxNodeID; i++ {
+		id := (start + i) % (maxNodeID + 1)
+		lock, err := redislocks.AcquireLock(ctx, fmt.Sprintf("%s%d", keyPrefix, id), leaseTTL)
+		if err == redislocks.ErrNotAcquired {
+			continue
+		}
+		if err != nil {
+			return 0, nil, err
+		}
+		return id, lock, nil
+	}
+	return 0, nil, ErrNoFreeNodeID
+}
+
+// Renew the lease; once it is lost, or may have lapsed because renewals kept failing,
+// disable ID generation and keep trying to claim a node ID again
+func maintain(stop <-chan struct{}, done chan<- struct{}) {
+	defer close(done)
+
+	// Renewals run until Release, independent of the caller's context
+	ctx := context.Background()
+
+	ticker := time.NewTicker(renewInterval)
+	defer ticker.Stop()
+	defer health.Forget(workerName)
+	lastRenewed := time.Now()
+
+	for {
+		health.Beat(workerName, 3*renewInterval)
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		mu.Lock()
+		lock := current
+		mu.Unlock()
+
+		if lock != nil {
+			err := lock.Extend(ctx, leaseTTL)
+			if err == nil {
+				lastRenewed = time.Now()
+				continue
+			}
+			// Stop one renew interval before the lease could have expired
+			if !errors.Is(err, redislocks.ErrLockLost) && time.Since(lastRenewed) < leaseTTL-renewInterval {
+				log.Println("Failed to renew Snowflake node ID lease:", err)
+				continue
+			}
+
+			utils.DisableSnowflake()
+			mu.Lock()
+			current = nil
+			mu.Unlock()
+			log.Println("Lost Snowflake node ID lease, ID generation disabled:", err)
+		}
+
+		if !reclaim(ctx, stop) {
+			return
+		}
+		lastRenewed = time.Now()
+	}
+}
+
+// Keep claiming a node ID until one is held again, false if stopped first
+func reclaim(ctx context.Context, stop <-chan struct{}) bool {
+	for {
+		id, lock, err := claim(ctx)
+		if err == nil {
+			if err = utils.InitSnowflake(id); err == nil {
+				mu.Lock()
+				current, nodeID = lock, id
+				mu.Unlock()
+				log.Println("Re-leased Snowflake node ID", id)
+				return true
+			}
+			lock.Release(ctx)
+		}
+		log.Println("Failed to re-lease Snowflake node ID:", err)
+		health.Beat(workerName, 3*renewInterval)
+
+		select {
+		case <-stop:
+			return false
+		case <-time.After(retryInterval):
+		}
+	}
+}
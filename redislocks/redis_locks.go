@@ -2,23 +2,210 @@ package redislocks
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"log"
+	"strings"
+	"sync"
 	"time"
 
+	"cloudflaretinyurl/metrics"
+
 	"github.com/redis/go-redis/v9"
 )
 
 var rdb *redis.Client
 
+var (
+	ErrNotAcquired = errors.New("lock is held by another owner")
+	ErrLockLost    = errors.New("lock is no longer owned")
+)
+
+// Set the lock only if free, and hand out the next fencing token of its namespace
+var acquireScript = redis.NewScript(`
+if redis.call('SET', KEYS[1], ARGV[1], 'NX', 'PX', ARGV[2]) then
+	return redis.call('INCR', KEYS[2])
+end
+return 0
+`)
+
+// Delete the lock only if this owner still holds it
+var releaseScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('DEL', KEYS[1])
+end
+return 0
+`)
+
+// Extend the lock only if this owner still holds it
+var extendScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('PEXPIRE', KEYS[1], ARGV[2])
+end
+return 0
+`)
+
+// Lock is a held distributed lock, owned through a random token
+type Lock struct {
+	key     string
+	token   string
+	ttl     time.Duration
+	fencing int64
+
+	mu       sync.Mutex
+	stopCh   chan struct{}
+	lostCh   chan struct{}
+	lostOnce sync.Once
+}
+
 func InitRedisLocks(redisClient *redis.Client) {
 	rdb = redisClient
 }
 
-// Acquire a distributed lock with TTL
-func AcquireLock(key string, expiration int) bool {
-	return rdb.SetNX(context.Background(), key, "locked", time.Duration(expiration)*time.Second).Val()
+// Redis key holding the monotonically increasing fencing counter shared by every lock of a
+// namespace, so per-item locks such as lock:click:<id> leave no key behind once released
+func fenceKey(key string) string {
+	return lockName(key) + ":fence"
+}
+
+// Acquire a distributed lock with TTL, returns ErrNotAcquired if another owner holds it
+func AcquireLock(ctx context.Context, key string, ttl time.Duration) (*Lock, error) {
+	token, err := newToken()
+	if err != nil {
+		return nil, err
+	}
+
+	fencing, err := acquireScript.Run(ctx, rdb, []string{key, fenceKey(key)}, token, ttl.Milliseconds()).Int64()
+	if err != nil {
+		metrics.LockAcquisitions.WithLabelValues(lockName(key), "error").Inc()
+		return nil, err
+	}
+	if fencing == 0 {
+		metrics.LockAcquisitions.WithLabelValues(lockName(key), "contended").Inc()
+		return nil, ErrNotAcquired
+	}
+	metrics.LockAcquisitions.WithLabelValues(lockName(key), "acquired").Inc()
+
+	return &Lock{key: key, token: token, ttl: ttl, fencing: fencing, lostCh: make(chan struct{})}, nil
+}
+
+// FencingToken increases with every acquisition of a lock in the key's namespace, downstream
+// writes can reject tokens lower than the highest they have seen
+func (l *Lock) FencingToken() int64 {
+	return l.fencing
+}
+
+// Check fails with ErrLockLost once the lease lapsed or a newer owner has acquired the lock,
+// call it right before a write that must not race with the next holder
+func (l *Lock) Check(ctx context.Context) error {
+	owner, err := rdb.Get(ctx, l.key).Result()
+	if err != nil && err != redis.Nil {
+		return err
+	}
+	if owner != l.token {
+		return l.lost()
+	}
+	return nil
+}
+
+// Extend the lease by ttl from now, returns ErrLockLost if the lease already expired
+func (l *Lock) Extend(ctx context.Context, ttl time.Duration) error {
+	ok, err := extendScript.Run(ctx, rdb, []string{l.key}, l.token, ttl.Milliseconds()).Int64()
+	if err != nil {
+		return err
+	}
+	if ok == 0 {
+		return l.lost()
+	}
+	return nil
+}
+
+// Release the distributed lock if still owned, never touching another owner's lock
+func (l *Lock) Release(ctx context.Context) error {
+	l.stopAutoRenew()
+
+	ok, err := releaseScript.Run(ctx, rdb, []string{l.key}, l.token).Int64()
+	if err != nil {
+		return err
+	}
+	if ok == 0 {
+		return l.lost()
+	}
+	return nil
+}
+
+// AutoRenew extends the lease every third of its TTL until Release or ctx is done, for jobs
+// that may outlive a single lease. Lost is closed if a renewal finds the lock taken over.
+func (l *Lock) AutoRenew(ctx context.Context) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.stopCh != nil {
+		return
+	}
+	l.stopCh = make(chan struct{})
+	go l.renew(ctx, l.stopCh)
+}
+
+// Lost is closed once auto-renewal detects the lock is no longer owned
+func (l *Lock) Lost() <-chan struct{} {
+	return l.lostCh
+}
+
+func (l *Lock) renew(ctx context.Context, stop <-chan struct{}) {
+	ticker := time.NewTicker(l.ttl / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			err := l.Extend(ctx, l.ttl)
+			if errors.Is(err, ErrLockLost) {
+				log.Println("Lost lock during renewal:", l.key)
+				l.lostOnce.Do(func() { close(l.lostCh) })
+				return
+			}
+			if err != nil {
+				log.Println("Failed to renew lock:", l.key, err)
+			}
+		}
+	}
+}
+
+func (l *Lock) stopAutoRenew() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.stopCh != nil {
+		close(l.stopCh)
+		l.stopCh = nil
+	}
+}
+
+// Count a lock found taken over and return ErrLockLost
+func (l *Lock) lost() error {
+	metrics.LocksLost.WithLabelValues(lockName(l.key)).Inc()
+	return ErrLockLost
+}
+
+// Namespace of a lock key without its per-item suffix, e.g. lock:click for lock:click:abc:123
+// and snowflake_node for snowflake_node:7. Labels metrics and names the fence key.
+func lockName(key string) string {
+	parts := strings.SplitN(key, ":", 3)
+	if parts[0] == "lock" && len(parts) > 1 {
+		return parts[0] + ":" + parts[1]
+	}
+	return parts[0]
 }
 
-// Release the distributed lock
-func ReleaseLock(key string) {
-	rdb.Del(context.Background(), key)
+// Random owner token, so only the acquirer can release or extend the lock
+func newToken() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
 }
@@ -2,9 +2,12 @@ package redispubsub
 
 import (
 	"context"
+	"fmt"
 	"log"
 	"strings"
+	"time"
 
+	"cloudflaretinyurl/health"
 	"cloudflaretinyurl/redisqueue"
 
 	"github.com/redis/go-redis/v9"
@@ -12,24 +15,65 @@ import (
 
 var rdb *redis.Client
 
+const (
+	workerName        = "expired click listener"
+	heartbeatInterval = 10 * time.Second
+)
+
 // Initialize Redis Pub/Sub
 func InitRedisPubSub(redisClient *redis.Client) {
 	rdb = redisClient
 }
 
-// Listen for expired key events and push the full key (snowflake ID) to the queue
-func ListenForExpiredClicks() {
-	pubsub := rdb.PSubscribe(context.Background(), "__keyevent@0__:expired")
+// Keyevent channel of expired keys in the database the client uses
+func expiredChannel() string {
+	return fmt.Sprintf("__keyevent@%d__:expired", rdb.Options().DB)
+}
+
+// Listen for expired key events and push the full key (snowflake ID) to the queue until ctx is done
+func ListenForExpiredClicks(ctx context.Context) {
+	pubsub := rdb.PSubscribe(ctx, expiredChannel())
+	defer pubsub.Close()
+	defer health.Forget(workerName)
+
+	ticker := time.NewTicker(heartbeatInterval)
+	defer ticker.Stop()
+	health.Beat(workerName, 3*heartbeatInterval)
 
-	for msg := range pubsub.Channel() {
-		expiredKey := msg.Payload
+	messages := pubsub.Channel()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			health.Beat(workerName, 3*heartbeatInterval)
+		case msg, ok := <-messages:
+			if !ok {
+				return
+			}
+			expiredKey := msg.Payload
 
-		// Check if the expired key is a click event
-		if strings.Contains(expiredKey, "click:") {
-			log.Println("Detected expired click event for key:", expiredKey)
+			// Check if the expired key is a click event
+			if strings.Contains(expiredKey, "click:") {
+				log.Println("Detected expired click event for key:", expiredKey)
 
-			// Push the full key (including snowflake ID) to the processing queue
-			redisqueue.PushExpiredClick(expiredKey)
+				// Push the full key (including snowflake ID) to the processing queue
+				redisqueue.PushExpiredClick(ctx, expiredKey)
+			}
 		}
 	}
 }
+
+// CheckKeyspaceNotifications fails unless Redis publishes expired keyevents (notify-keyspace-events
+// with E and x, or A), without which expired clicks never leave the rolling counters
+func CheckKeyspaceNotifications(ctx context.Context) error {
+	values, err := rdb.ConfigGet(ctx, "notify-keyspace-events").Result()
+	if err != nil {
+		return fmt.Errorf("reading notify-keyspace-events: %w", err)
+	}
+	flags := values["notify-keyspace-events"]
+	if !strings.Contains(flags, "E") || !strings.ContainsAny(flags, "xA") {
+		return fmt.Errorf("notify-keyspace-events is %q, expired keyevents need E and x", flags)
+	}
+	return nil
+}
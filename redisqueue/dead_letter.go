@@ -0,0 +1,59 @@
+package redisqueue
+
+import (
+	"context"
+	"errors"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// ErrUnavailable is returned when the queue runs without Redis (in-memory backend)
+var ErrUnavailable = errors.New("expired click queue requires Redis")
+
+// Atomically move up to ARGV[1] dead letters (0 = all) back onto the queue with a fresh retry budget
+var replayScript = redis.NewScript(`
+local limit = tonumber(ARGV[1])
+local moved = 0
+while limit == 0 or moved < limit do
+	local item = redis.call('RPOP', KEYS[1])
+	if not item then break end
+	local ok, decoded = pcall(cjson.decode, item)
+	if ok and type(decoded) == 'table' then
+		decoded.attempts = 0
+		item = cjson.encode(decoded)
+	end
+	redis.call('LPUSH', KEYS[2], item)
+	moved = moved + 1
+end
+return moved
+`)
+
+// List dead-lettered expired click events, newest first
+func ListDeadLetters(ctx context.Context, limit int64) ([]QueueItem, int64, error) {
+	if rdb == nil {
+		return nil, 0, ErrUnavailable
+	}
+
+	total, err := rdb.LLen(ctx, deadLetterKey).Result()
+	if err != nil {
+		return nil, 0, err
+	}
+	raws, err := rdb.LRange(ctx, deadLetterKey, 0, limit-1).Result()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	items := make([]QueueItem, 0, len(raws))
+	for _, raw := range raws {
+		items = append(items, decodeItem(raw))
+	}
+	return items, total, nil
+}
+
+// Replay the oldest dead-lettered events (limit 0 = all), returning how many were requeued
+func ReplayDeadLetters(ctx context.Context, limit int64) (int64, error) {
+	if rdb == nil {
+		return 0, ErrUnavailable
+	}
+	return replayScript.Run(ctx, rdb, []string{deadLetterKey, queueKey}, limit).Int64()
+}
@@ -2,58 +2,347 @@ package redisqueue
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"log"
+	"os"
+	"sync"
+	"time"
 
+	"cloudflaretinyurl/config"
+	"cloudflaretinyurl/health"
+	"cloudflaretinyurl/metrics"
 	"cloudflaretinyurl/rediscounter"
 	"cloudflaretinyurl/redislocks"
+	"cloudflaretinyurl/tracing"
 
 	"github.com/redis/go-redis/v9"
+	"go.opentelemetry.io/otel/attribute"
 )
 
-var rdb *redis.Client
+var (
+	rdb *redis.Client
+	cfg = config.Default().Queue
+)
+
+const (
+	queueKey          = "expired_click_queue"           // Shared queue across instances
+	processingPrefix  = "expired_click_processing:"     // + consumer ID, items in flight on that consumer
+	consumersKey      = "expired_click_consumers"       // Consumer IDs that may own a processing list
+	heartbeatPrefix   = "expired_click_consumer_alive:" // + consumer ID, expires when the consumer dies
+	retryKey          = "expired_click_retry"           // Failed items scored by when they are due again
+	deadLetterKey     = "expired_click_dead_letter"     // Items that exhausted their retries
+	heartbeatTTL      = 30 * time.Second
+	heartbeatInterval = 10 * time.Second
+	reapInterval      = 30 * time.Second
+	promoteInterval   = time.Second
+	promoteBatchSize  = 100
+	popTimeout        = 5 * time.Second
+	baseBackoff       = time.Second
+	maxBackoff        = 5 * time.Minute
+	workerName        = "expired click queue"
+)
 
-const queueKey = "expired_click_queue" // Shared queue across instances
+// QueueItem is one expired click event on the queue, with its retry history
+type QueueItem struct {
+	Key       string     `json:"key"`
+	Attempts  int        `json:"attempts"`
+	LastError string     `json:"last_error,omitempty"`
+	FailedAt  *time.Time `json:"failed_at,omitempty"`
+}
+
+// Atomically move due retries back onto the queue
+var promoteScript = redis.NewScript(`
+local due = redis.call('ZRANGEBYSCORE', KEYS[1], '-inf', ARGV[1], 'LIMIT', 0, ARGV[2])
+for _, item in ipairs(due) do
+	redis.call('ZREM', KEYS[1], item)
+	redis.call('LPUSH', KEYS[2], item)
+end
+return #due
+`)
 
 // Initialize Redis Queue
-func InitRedisQueue(redisClient *redis.Client) {
+func InitRedisQueue(redisClient *redis.Client, queueConfig config.Queue) {
 	rdb = redisClient
+	cfg = queueConfig
+	metrics.SetQueueDepthFunc(Depths)
+}
+
+// Depths reports the length of the queue, of all in-flight lists together, of the
+// retry set and of the dead-letter list
+func Depths(ctx context.Context) (map[string]int64, error) {
+	consumers, err := rdb.SMembers(ctx, consumersKey).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	var queued, retrying, dead *redis.IntCmd
+	inFlight := make([]*redis.IntCmd, len(consumers))
+	_, err = rdb.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		queued = pipe.LLen(ctx, queueKey)
+		retrying = pipe.ZCard(ctx, retryKey)
+		dead = pipe.LLen(ctx, deadLetterKey)
+		for i, consumer := range consumers {
+			inFlight[i] = pipe.LLen(ctx, processingPrefix+consumer)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	depths := map[string]int64{
+		"queue":       queued.Val(),
+		"processing":  0,
+		"retry":       retrying.Val(),
+		"dead_letter": dead.Val(),
+	}
+	for _, cmd := range inFlight {
+		depths["processing"] += cmd.Val()
+	}
+	return depths, nil
 }
 
 // Push an expired click event to the shared queue
-func PushExpiredClick(fullKey string) {
-	err := rdb.LPush(context.Background(), queueKey, fullKey).Err()
+func PushExpiredClick(ctx context.Context, fullKey string) {
+	ctx, span := tracing.Start(ctx, "redisqueue.PushExpiredClick", attribute.String("click.key", fullKey))
+	err := rdb.LPush(ctx, queueKey, encodeItem(QueueItem{Key: fullKey})).Err()
+	tracing.End(span, err)
 	if err != nil {
 		log.Println("Failed to push to expired click queue:", err)
 	}
 }
 
-// Process expired click events and decrement counters
-func ProcessExpiredClicks() {
-	for {
-		// BRPOP ensures only one instance processes each message
-		result, err := rdb.BRPop(context.Background(), 0, queueKey).Result()
+// Process expired click events and decrement counters until ctx is done. Each event is moved
+// into this consumer's processing list while in flight, so a crash never loses it.
+func ProcessExpiredClicks(ctx context.Context) {
+	consumer := newConsumerID()
+	processingKey := processingPrefix + consumer
+
+	var wg sync.WaitGroup
+	for _, helper := range []func(context.Context){
+		func(ctx context.Context) { heartbeat(ctx, consumer) },
+		reapStaleInFlight,
+		promoteDueRetries,
+	} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			helper(ctx)
+		}()
+	}
+
+	defer health.Forget(workerName)
+	for ctx.Err() == nil {
+		health.Beat(workerName, heartbeatTTL)
+
+		// BLMOVE hands each message to exactly one consumer and keeps it until acknowledged
+		raw, err := rdb.BLMove(ctx, queueKey, processingKey, "RIGHT", "LEFT", popTimeout).Result()
+		if err == redis.Nil || ctx.Err() != nil {
+			continue
+		}
 		if err != nil {
 			log.Println("Error processing expired clicks:", err)
+			sleep(ctx, time.Second)
 			continue
 		}
 
-		fullKey := result[1]
-		log.Println("Processing expired click event for key:", fullKey)
+		handleItem(ctx, processingKey, raw)
+	}
 
-		// Acquire lock to prevent race conditions
-		lockKey := fmt.Sprintf("lock:%s", fullKey)
-		if redislocks.AcquireLock(lockKey, 2) {
-			// Decrement the counters safely inside the lock scope
-			err = rediscounter.DecrementGlobalCounter(fullKey)
-			if err != nil {
-				log.Println("Error decrementing counters for key:", fullKey, err)
-			}
+	wg.Wait()
+	deregister(consumer)
+}
+
+// Hand anything still in flight back to the queue and drop this consumer's registration
+func deregister(consumer string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	requeued := requeueInFlight(ctx, consumer)
+	rdb.Del(ctx, heartbeatPrefix+consumer)
+	rdb.SRem(ctx, consumersKey, consumer)
+	log.Printf("Expired click consumer %s stopped, requeued %d in-flight events", consumer, requeued)
+}
+
+// Wait for d or until ctx is done
+func sleep(ctx context.Context, d time.Duration) {
+	select {
+	case <-ctx.Done():
+	case <-time.After(d):
+	}
+}
+
+// Process one in-flight item, then acknowledge it, schedule a retry or dead-letter it
+func handleItem(ctx context.Context, processingKey, raw string) {
+	item := decodeItem(raw)
+	log.Println("Processing expired click event for key:", item.Key)
 
-			// Release lock after processing
-			redislocks.ReleaseLock(lockKey)
+	ctx, span := tracing.Start(ctx, "redisqueue.ProcessExpiredClick",
+		attribute.String("click.key", item.Key), attribute.Int("queue.attempts", item.Attempts))
+	err := processItem(ctx, item.Key)
+	defer tracing.End(span, err)
+	if err == nil {
+		rdb.LRem(ctx, processingKey, 1, raw)
+		return
+	}
+
+	now := time.Now()
+	item.Attempts++
+	item.LastError = err.Error()
+	item.FailedAt = &now
+
+	_, txErr := rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.LRem(ctx, processingKey, 1, raw)
+		if item.Attempts >= cfg.MaxAttempts {
+			pipe.LPush(ctx, deadLetterKey, encodeItem(item))
 		} else {
-			log.Println("Skipping processing for:", fullKey, "Another instance is handling it.")
+			due := now.Add(backoff(item.Attempts))
+			pipe.ZAdd(ctx, retryKey, redis.Z{Score: float64(due.UnixMilli()), Member: encodeItem(item)})
 		}
+		return nil
+	})
+	if txErr != nil {
+		// The item stays in the processing list and is requeued by the reaper
+		log.Println("Failed to reschedule expired click event:", item.Key, txErr)
+		return
+	}
+
+	if item.Attempts >= cfg.MaxAttempts {
+		log.Println("Dead-lettered expired click event after", item.Attempts, "attempts:", item.Key, err)
+	} else {
+		log.Println("Retrying expired click event later:", item.Key, err)
+	}
+}
+
+// Decrement the counters for one click inside its lock scope
+func processItem(ctx context.Context, fullKey string) error {
+	// Acquire lock to prevent race conditions
+	lock, err := redislocks.AcquireLock(ctx, fmt.Sprintf("lock:%s", fullKey), cfg.LockTTL)
+	if err != nil {
+		return err
+	}
+	defer lock.Release(ctx)
+
+	return rediscounter.DecrementGlobalCounter(ctx, fullKey)
+}
+
+// Exponential backoff for the given attempt, capped at maxBackoff
+func backoff(attempts int) time.Duration {
+	d := baseBackoff << (attempts - 1)
+	if d <= 0 || d > maxBackoff {
+		return maxBackoff
+	}
+	return d
+}
+
+// Keep this consumer registered and its heartbeat alive so reapers leave its processing list alone.
+// The heartbeat is written before registering so a reaper never sees a registered consumer without one.
+func heartbeat(ctx context.Context, consumer string) {
+	ticker := time.NewTicker(heartbeatInterval)
+	defer ticker.Stop()
+
+	for {
+		_, err := rdb.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Set(ctx, heartbeatPrefix+consumer, "", heartbeatTTL)
+			pipe.SAdd(ctx, consumersKey, consumer)
+			return nil
+		})
+		if err != nil && ctx.Err() == nil {
+			log.Println("Failed to refresh expired click consumer heartbeat:", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Requeue the in-flight items of consumers whose heartbeat has expired
+func reapStaleInFlight(ctx context.Context) {
+	ticker := time.NewTicker(reapInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		consumers, err := rdb.SMembers(ctx, consumersKey).Result()
+		if err != nil {
+			log.Println("Failed to list expired click consumers:", err)
+			continue
+		}
+
+		for _, consumer := range consumers {
+			alive, err := rdb.Exists(ctx, heartbeatPrefix+consumer).Result()
+			if err != nil || alive == 1 {
+				continue
+			}
+
+			requeued := requeueInFlight(ctx, consumer)
+			rdb.SRem(ctx, consumersKey, consumer)
+			if requeued > 0 {
+				log.Printf("Requeued %d stale in-flight expired click events from consumer %s", requeued, consumer)
+			}
+		}
+	}
+}
+
+// Move a consumer's in-flight items back onto the queue. LMOVE is atomic, so concurrent
+// reapers never requeue an item twice.
+func requeueInFlight(ctx context.Context, consumer string) int {
+	requeued := 0
+	for rdb.LMove(ctx, processingPrefix+consumer, queueKey, "RIGHT", "RIGHT").Err() == nil {
+		requeued++
+	}
+	return requeued
+}
+
+// Move retries whose backoff has elapsed back onto the queue
+func promoteDueRetries(ctx context.Context) {
+	ticker := time.NewTicker(promoteInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		now := fmt.Sprint(time.Now().UnixMilli())
+		err := promoteScript.Run(ctx, rdb, []string{retryKey, queueKey}, now, promoteBatchSize).Err()
+		if err != nil && ctx.Err() == nil {
+			log.Println("Failed to promote expired click retries:", err)
+		}
+	}
+}
+
+// Unique per process, so a restarted instance never adopts a dead consumer's list
+func newConsumerID() string {
+	host, _ := os.Hostname()
+	suffix := make([]byte, 4)
+	rand.Read(suffix)
+	return fmt.Sprintf("%s-%d-%s", host, os.Getpid(), hex.EncodeToString(suffix))
+}
+
+func encodeItem(item QueueItem) string {
+	data, _ := json.Marshal(item)
+	return string(data)
+}
+
+// Items pushed before retries were tracked are the bare click key
+func decodeItem(raw string) QueueItem {
+	var item QueueItem
+	if err := json.Unmarshal([]byte(raw), &item); err != nil || item.Key == "" {
+		return QueueItem{Key: raw}
 	}
+	return item
 }
@@ -1,7 +1,13 @@
 package routes
 
 import (
+	"net/http"
+
+	"cloudflaretinyurl/auth"
 	"cloudflaretinyurl/handlers"
+	"cloudflaretinyurl/metrics"
+	"cloudflaretinyurl/ratelimit"
+	"cloudflaretinyurl/tracing"
 
 	"github.com/gorilla/mux"
 )
@@ -9,10 +15,25 @@ import (
 // Initialize API Routes
 func InitRoutes() *mux.Router {
 	r := mux.NewRouter()
-	r.HandleFunc("/api/v1/create", handlers.CreateTinyURL).Methods("POST")
-	r.HandleFunc("/api/v1/{shortURL}", handlers.RedirectTinyURL).Methods("GET")
-	r.HandleFunc("/api/v1/{shortURL}", handlers.DeleteTinyURL).Methods("DELETE")
-	r.HandleFunc("/api/v1/clicks/{shortURL}", handlers.GetTinyURLCounts).Methods("GET")
-	r.HandleFunc("/api/v1/clicks_fallback/{shortURL}", handlers.GetClickCountsHandler).Methods("GET")
+	r.Use(tracing.Middleware, metrics.Middleware)
+	r.Handle("/metrics", metrics.Handler()).Methods("GET")
+	r.HandleFunc("/healthz", handlers.HealthzHandler).Methods("GET")
+	r.HandleFunc("/readyz", handlers.ReadyzHandler).Methods("GET")
+	r.Handle("/api/v1/create", ratelimit.PerIP(auth.Middleware(ratelimit.PerAPIKey(http.HandlerFunc(handlers.CreateTinyURL))))).Methods("POST")
+	r.Handle("/api/v1/keys", auth.RequireAdmin(http.HandlerFunc(handlers.CreateAPIKeyHandler))).Methods("POST")
+	r.Handle("/api/v1/keys", auth.Middleware(http.HandlerFunc(handlers.ListAPIKeysHandler))).Methods("GET")
+	r.Handle("/api/v1/keys/{id}/rotate", auth.Middleware(http.HandlerFunc(handlers.RotateAPIKeyHandler))).Methods("POST")
+	r.Handle("/api/v1/keys/{id}", auth.Middleware(http.HandlerFunc(handlers.RevokeAPIKeyHandler))).Methods("DELETE")
+	r.Handle("/api/v1/top", auth.RequireAdmin(http.HandlerFunc(handlers.TopURLsHandler))).Methods("GET")
+	r.Handle("/api/v1/{shortURL}", ratelimit.PerIP(ratelimit.PerShortCode(http.HandlerFunc(handlers.RedirectTinyURL)))).Methods("GET")
+	r.Handle("/api/v1/{shortURL}", auth.Middleware(http.HandlerFunc(handlers.DeleteTinyURL))).Methods("DELETE")
+	r.Handle("/api/v1/links/{shortURL}", auth.Middleware(http.HandlerFunc(handlers.UpdateLinkHandler))).Methods("PATCH")
+	r.Handle("/api/v1/links/{shortURL}/history", auth.Middleware(http.HandlerFunc(handlers.LinkHistoryHandler))).Methods("GET")
+	r.Handle("/api/v1/links/{shortURL}/breakdown", auth.Middleware(http.HandlerFunc(handlers.ClickBreakdownHandler))).Methods("GET")
+	r.Handle("/api/v1/links/{shortURL}/timeseries", auth.Middleware(http.HandlerFunc(handlers.ClickTimeseriesHandler))).Methods("GET")
+	r.Handle("/api/v1/clicks/{shortURL}", auth.Middleware(http.HandlerFunc(handlers.GetTinyURLCounts))).Methods("GET")
+	r.Handle("/api/v1/clicks_fallback/{shortURL}", auth.Middleware(http.HandlerFunc(handlers.GetClickCountsHandler))).Methods("GET")
+	r.Handle("/api/v1/admin/dead_letters", auth.RequireAdmin(http.HandlerFunc(handlers.ListDeadLettersHandler))).Methods("GET")
+	r.Handle("/api/v1/admin/dead_letters/replay", auth.RequireAdmin(http.HandlerFunc(handlers.ReplayDeadLettersHandler))).Methods("POST")
 	return r
 }
@@ -0,0 +1,177 @@
+package screening
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"cloudflaretinyurl/urlpolicy"
+
+	"golang.org/x/net/idna"
+)
+
+// List files by extension, other files in lists_dir are ignored
+var kindByExtension = map[string]string{
+	".domains": KindDomain,
+	".urls":    KindURL,
+	".regex":   KindRegex,
+	".hashes":  KindHash,
+}
+
+// Safe Browsing hash prefixes are 4 to 32 bytes of a SHA-256 hash
+const (
+	minPrefixBytes = 4
+	maxPrefixBytes = 32
+)
+
+type regexRule struct {
+	list    string
+	pattern *regexp.Regexp
+}
+
+// lists is one immutable snapshot of every loaded rule, each mapped to the file it came from
+type lists struct {
+	domains    map[string]string
+	urls       map[string]string
+	regexes    []regexRule
+	prefixes   map[string]string // Hex hash prefix
+	prefixLens []int             // Distinct prefix lengths in hex characters
+}
+
+func (l *lists) String() string {
+	return fmt.Sprintf("%d domains, %d URLs, %d regexes, %d hash prefixes", len(l.domains), len(l.urls), len(l.regexes), len(l.prefixes))
+}
+
+func (l *lists) match(longURL string, u *url.URL) (Match, bool) {
+	host := strings.ToLower(u.Hostname())
+	for _, domain := range parentDomains(host) {
+		if list, ok := l.domains[domain]; ok {
+			return Match{List: list, Kind: KindDomain, Rule: domain}, true
+		}
+	}
+	if list, ok := l.urls[longURL]; ok {
+		return Match{List: list, Kind: KindURL, Rule: longURL}, true
+	}
+	for _, rule := range l.regexes {
+		if rule.pattern.MatchString(longURL) {
+			return Match{List: rule.list, Kind: KindRegex, Rule: rule.pattern.String()}, true
+		}
+	}
+	if len(l.prefixes) > 0 {
+		for _, hash := range expressionHashes(u) {
+			for _, n := range l.prefixLens {
+				if list, ok := l.prefixes[hash[:n]]; ok {
+					return Match{List: list, Kind: KindHash, Rule: hash[:n]}, true
+				}
+			}
+		}
+	}
+	return Match{}, false
+}
+
+// Names, sizes and modification times of the list files, changing whenever a list does
+func dirSignature(dir string) (string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return "", err
+	}
+	var sig strings.Builder
+	for _, entry := range entries {
+		if _, ok := kindByExtension[filepath.Ext(entry.Name())]; !ok || entry.IsDir() {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(&sig, "%s:%d:%d;", entry.Name(), info.Size(), info.ModTime().UnixNano())
+	}
+	return sig.String(), nil
+}
+
+// Load every list file in dir. Invalid lines are logged and skipped, so one typo does not
+// disable a whole list, but an unreadable file fails the load.
+func loadLists(dir string) (*lists, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &lists{domains: map[string]string{}, urls: map[string]string{}, prefixes: map[string]string{}}
+	prefixLens := map[int]bool{}
+	for _, entry := range entries {
+		kind, ok := kindByExtension[filepath.Ext(entry.Name())]
+		if !ok || entry.IsDir() {
+			continue
+		}
+
+		name := entry.Name()
+		err := readRules(filepath.Join(dir, name), func(rule string) error {
+			switch kind {
+			case KindDomain:
+				domain, err := idna.Lookup.ToASCII(strings.TrimPrefix(strings.TrimPrefix(strings.ToLower(rule), "*"), "."))
+				if err != nil {
+					return err
+				}
+				l.domains[strings.TrimSuffix(domain, ".")] = name
+			case KindURL:
+				normalized, err := urlpolicy.Normalize(rule)
+				if err != nil {
+					return err
+				}
+				l.urls[normalized] = name
+			case KindRegex:
+				pattern, err := regexp.Compile(rule)
+				if err != nil {
+					return err
+				}
+				l.regexes = append(l.regexes, regexRule{list: name, pattern: pattern})
+			case KindHash:
+				prefix := strings.ToLower(rule)
+				if _, err := hex.DecodeString(prefix); err != nil || len(prefix) < 2*minPrefixBytes || len(prefix) > 2*maxPrefixBytes {
+					return fmt.Errorf("not a hex hash prefix of %d to %d bytes", minPrefixBytes, maxPrefixBytes)
+				}
+				l.prefixes[prefix] = name
+				prefixLens[len(prefix)] = true
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for n := range prefixLens {
+		l.prefixLens = append(l.prefixLens, n)
+	}
+	sort.Ints(l.prefixLens)
+	return l, nil
+}
+
+// Call add for each rule in a list file: one per line, blank lines and # comments ignored
+func readRules(path string, add func(rule string) error) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		rule := strings.TrimSpace(scanner.Text())
+		if rule == "" || strings.HasPrefix(rule, "#") {
+			continue
+		}
+		if err := add(rule); err != nil {
+			log.Printf("Skipping invalid rule %s:%d: %v", filepath.Base(path), line, err)
+		}
+	}
+	return scanner.Err()
+}
@@ -0,0 +1,78 @@
+package screening
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net"
+	"net/url"
+	"strings"
+)
+
+// Safe Browsing looks a URL up by up to 5 host suffixes and 6 path prefixes
+const (
+	maxHostComponents = 5
+	maxPathPrefixes   = 4
+)
+
+// Hex SHA-256 hashes of the Safe Browsing suffix/prefix expressions of u
+func expressionHashes(u *url.URL) []string {
+	var hashes []string
+	for _, expression := range expressions(u) {
+		sum := sha256.Sum256([]byte(expression))
+		hashes = append(hashes, hex.EncodeToString(sum[:]))
+	}
+	return hashes
+}
+
+// Host suffix / path prefix combinations of u, e.g. for https://a.b.c/1/2.html?param=1:
+// a.b.c/1/2.html?param=1, a.b.c/1/2.html, a.b.c/, a.b.c/1/, b.c/1/2.html?param=1, ... b.c/1/
+func expressions(u *url.URL) []string {
+	host := strings.TrimSuffix(strings.ToLower(u.Hostname()), ".")
+	hosts := []string{host}
+	if net.ParseIP(host) == nil {
+		// The last 5 components and shorter suffixes, but not the top-level domain alone
+		parts := strings.Split(host, ".")
+		for i := max(len(parts)-maxHostComponents, 1); i <= len(parts)-2; i++ {
+			hosts = append(hosts, strings.Join(parts[i:], "."))
+		}
+	}
+
+	path := u.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	var paths []string
+	if u.RawQuery != "" {
+		paths = append(paths, path+"?"+u.RawQuery)
+	}
+	paths = append(paths, path)
+
+	// Directory prefixes from the root, the last segment is a directory only with a trailing slash
+	segments := strings.Split(strings.Trim(path, "/"), "/")
+	if !strings.HasSuffix(path, "/") {
+		segments = segments[:len(segments)-1]
+	}
+	prefix := "/"
+	for i, added := 0, 0; added < maxPathPrefixes; i++ {
+		if prefix != path {
+			paths = append(paths, prefix)
+			added++
+		}
+		if i >= len(segments) || segments[i] == "" {
+			break
+		}
+		prefix += segments[i] + "/"
+	}
+
+	seen := map[string]bool{}
+	var out []string
+	for _, h := range hosts {
+		for _, p := range paths {
+			if expression := h + p; !seen[expression] {
+				seen[expression] = true
+				out = append(out, expression)
+			}
+		}
+	}
+	return out
+}
@@ -0,0 +1,195 @@
+package screening
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"cloudflaretinyurl/config"
+	"cloudflaretinyurl/health"
+	"cloudflaretinyurl/urlpolicy"
+)
+
+// Actions for links matching a list on redirect
+const (
+	ActionFlag    = "flag"    // Warn on an interstitial page, users may continue
+	ActionDisable = "disable" // Show the interstitial without a way to continue
+)
+
+// Rule kinds, one per list format
+const (
+	KindDomain = "domain"
+	KindURL    = "url"
+	KindRegex  = "regex"
+	KindHash   = "hash_prefix"
+)
+
+// Validation error code of long URLs rejected on create
+const CodeBlocked = "blocked"
+
+const workerName = "blocklist reloader"
+
+// Verdicts remembered per short URL before the cache starts over
+const maxVerdicts = 100000
+
+// Match describes the list rule a URL matched
+type Match struct {
+	List string // File name of the list
+	Kind string
+	Rule string
+}
+
+// Reason a link matching m is flagged, stored with the link and shown on its warning page
+func (m Match) Reason() string {
+	return fmt.Sprintf("listed in %s (%s %s)", m.List, m.Kind, m.Rule)
+}
+
+// verdicts caches the screening result of each short URL for one set of lists,
+// replaced as a whole once the lists are
+type verdicts struct {
+	lists *lists
+
+	mu      sync.Mutex
+	entries map[string]verdict
+}
+
+type verdict struct {
+	longURL string // Screened long URL, the link may have been updated since
+	match   Match
+	listed  bool
+}
+
+var (
+	cfg       = config.Default().Screening
+	current   atomic.Pointer[lists]
+	cached    atomic.Pointer[verdicts]
+	signature string // Of the files current was loaded from, only touched by Init and the reloader
+)
+
+// Initialize screening and load the lists, an empty lists_dir disables screening
+func InitScreening(screeningConfig config.Screening) error {
+	cfg = screeningConfig
+	current.Store(nil)
+	cached.Store(nil)
+	signature = ""
+	if cfg.ListsDir == "" {
+		return nil
+	}
+	_, err := Reload()
+	return err
+}
+
+// Action taken for links matching a list on redirect
+func Action() string {
+	return cfg.Action
+}
+
+// Check screens a long URL against the loaded lists
+func Check(longURL string) (Match, bool) {
+	l := current.Load()
+	if l == nil {
+		return Match{}, false
+	}
+
+	// Links stored before URL normalization are screened in normalized form too
+	if normalized, err := urlpolicy.Normalize(longURL); err == nil {
+		longURL = normalized
+	}
+	u, err := url.Parse(longURL)
+	if err != nil {
+		return Match{}, false
+	}
+	return l.match(longURL, u)
+}
+
+// CheckLink screens the long URL of a short URL like Check, remembering the verdict until the
+// lists are replaced or the link points elsewhere. screened is false for remembered verdicts.
+func CheckLink(shortURL, longURL string) (match Match, listed, screened bool) {
+	l := current.Load()
+	if l == nil {
+		return Match{}, false, false
+	}
+	c := cached.Load()
+	if c == nil || c.lists != l {
+		fresh := &verdicts{lists: l, entries: map[string]verdict{}}
+		if !cached.CompareAndSwap(c, fresh) {
+			fresh = cached.Load() // Replaced concurrently, possibly for newer lists than l
+		}
+		c = fresh
+	}
+
+	c.mu.Lock()
+	v, ok := c.entries[shortURL]
+	c.mu.Unlock()
+	if ok && v.longURL == longURL && c.lists == l {
+		return v.match, v.listed, false
+	}
+
+	match, listed = Check(longURL)
+	c.mu.Lock()
+	if len(c.entries) >= maxVerdicts {
+		c.entries = map[string]verdict{}
+	}
+	c.entries[shortURL] = verdict{longURL: longURL, match: match, listed: listed}
+	c.mu.Unlock()
+	return match, listed, true
+}
+
+// Reload the lists if any file in lists_dir changed, reporting whether they were replaced.
+// On error the previous lists stay in effect.
+func Reload() (bool, error) {
+	sig, err := dirSignature(cfg.ListsDir)
+	if err != nil {
+		return false, err
+	}
+	if sig == signature && current.Load() != nil {
+		return false, nil
+	}
+
+	loaded, err := loadLists(cfg.ListsDir)
+	if err != nil {
+		return false, err
+	}
+	current.Store(loaded)
+	signature = sig
+	log.Printf("Loaded screening lists from %s: %s", cfg.ListsDir, loaded)
+	return true, nil
+}
+
+// Poll lists_dir for changed lists until ctx is done
+func WatchLists(ctx context.Context) {
+	ticker := time.NewTicker(cfg.ReloadInterval)
+	defer ticker.Stop()
+	defer health.Forget(workerName)
+
+	for {
+		health.Beat(workerName, 3*cfg.ReloadInterval)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if _, err := Reload(); err != nil {
+			log.Println("Failed to reload screening lists, keeping the previous ones:", err)
+		}
+	}
+}
+
+// Host and its parent domains, most specific first: a.b.c, b.c, c
+func parentDomains(host string) []string {
+	var domains []string
+	for {
+		domains = append(domains, host)
+		dot := strings.IndexByte(host, '.')
+		if dot < 0 {
+			return domains
+		}
+		host = host[dot+1:]
+	}
+}
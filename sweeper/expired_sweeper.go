@@ -0,0 +1,99 @@
+package sweeper
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"cloudflaretinyurl/config"
+	"cloudflaretinyurl/database"
+	"cloudflaretinyurl/health"
+	"cloudflaretinyurl/redislocks"
+)
+
+// Shared across instances, only the holder sweeps. Renewed while sweeping, so only a crashed holder lets it lapse.
+const lockKey = "lock:expired_url_sweeper"
+
+const workerName = "expired URL sweeper"
+
+var cfg = config.Default().Sweeper
+
+// Initialize the sweeper's interval, batch size and lock TTL
+func InitSweeper(sweeperConfig config.Sweeper) {
+	cfg = sweeperConfig
+}
+
+// Result reports how many rows one sweep moved into the archive tables
+type Result struct {
+	URLs   int
+	Clicks int64
+}
+
+// Periodically archive expired URLs until ctx is done, coordinated across instances by a Redis lock
+func StartExpiredURLSweeper(ctx context.Context) {
+	ticker := time.NewTicker(cfg.Interval)
+	defer ticker.Stop()
+	defer health.Forget(workerName)
+
+	for {
+		health.Beat(workerName, 3*cfg.Interval)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		lock, err := redislocks.AcquireLock(ctx, lockKey, cfg.LockTTL)
+		if err == redislocks.ErrNotAcquired {
+			continue // Another instance is sweeping
+		}
+		if err != nil {
+			log.Println("Error acquiring sweeper lock:", err)
+			continue
+		}
+
+		lock.AutoRenew(ctx)
+		result, err := SweepExpiredURLs(ctx, lock)
+		lock.Release(context.WithoutCancel(ctx)) // Release even when stopped mid-sweep
+
+		if err != nil {
+			log.Println("Error sweeping expired URLs:", err)
+		}
+		if result.URLs > 0 {
+			log.Printf("Archived %d expired URLs and %d clicks", result.URLs, result.Clicks)
+		}
+	}
+}
+
+// Archive all expired URLs batch by batch and purge them from the cache.
+// With a lock, each batch first checks that no newer holder has taken over.
+func SweepExpiredURLs(ctx context.Context, lock *redislocks.Lock) (Result, error) {
+	var total Result
+	for {
+		if err := ctx.Err(); err != nil {
+			return total, err
+		}
+		if lock != nil {
+			if err := lock.Check(ctx); err != nil {
+				return total, err
+			}
+		}
+
+		batch, err := database.URLs.ArchiveExpiredURLs(ctx, cfg.BatchSize)
+		if err != nil {
+			return total, err
+		}
+
+		// Drop the cached mapping and count:* keys of every archived URL
+		for _, shortURL := range batch.ShortURLs {
+			database.URLCache.PurgeURL(ctx, shortURL)
+		}
+
+		total.URLs += len(batch.ShortURLs)
+		total.Clicks += batch.Clicks
+
+		if len(batch.ShortURLs) < cfg.BatchSize {
+			return total, nil
+		}
+	}
+}
@@ -0,0 +1,162 @@
+package e2etest
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"cloudflaretinyurl/config"
+	"cloudflaretinyurl/database"
+	"cloudflaretinyurl/handlers"
+
+	"github.com/mattheath/base62"
+	"github.com/stretchr/testify/assert"
+)
+
+type ClickBreakdown struct {
+	By     string                    `json:"by"`
+	From   *time.Time                `json:"from"`
+	Total  int                       `json:"total"`
+	Other  int                       `json:"other"`
+	Values []handlers.BreakdownValue `json:"values"`
+}
+
+func getBreakdown(t *testing.T, serverURL, shortCode, query string) (int, ClickBreakdown) {
+	resp, err := apiClient.Get(serverURL + "/api/v1/links/" + shortCode + "/breakdown?" + query)
+	assert.NoError(t, err)
+	defer resp.Body.Close()
+	var breakdown ClickBreakdown
+	if resp.StatusCode == http.StatusOK {
+		assert.NoError(t, json.NewDecoder(resp.Body).Decode(&breakdown))
+	}
+	return resp.StatusCode, breakdown
+}
+
+func TestClickBreakdownInMemory(t *testing.T) {
+	server := newMemoryAPI(t)
+	shortCode := createShortCode(t, server, URLRequest{LongURL: "https://example.com/shared"})
+
+	record := func(at, referrer, device, browser, os string, bot bool) {
+		accessedAt, err := time.Parse(time.RFC3339, at)
+		assert.NoError(t, err)
+		assert.NoError(t, database.Clicks.RecordClick(context.Background(), database.Click{
+			ShortURL: shortCode, AccessedAt: accessedAt, ReferrerHost: referrer,
+			DeviceType: device, BrowserFamily: browser, OSFamily: os, Bot: bot,
+		}))
+	}
+	record("2025-05-01T09:00:00Z", "news.ycombinator.com", "desktop", "Firefox", "Linux", false)
+	record("2025-05-01T10:00:00Z", "news.ycombinator.com", "mobile", "Safari", "iOS", false)
+	record("2025-05-02T10:00:00Z", "t.co", "mobile", "Chrome", "Android", false)
+	record("2025-05-03T10:00:00Z", "", "desktop", "Firefox", "Windows", false)
+	record("2025-05-03T11:00:00Z", "t.co", "bot", "Twitterbot", "Other", true)
+
+	status, breakdown := getBreakdown(t, server.URL, shortCode, "by=referrer")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Nil(t, breakdown.From) // Since the first click
+	assert.Equal(t, 4, breakdown.Total)
+	assert.Equal(t, []handlers.BreakdownValue{
+		{Value: "news.ycombinator.com", Clicks: 2, Percent: 50},
+		{Value: "", Clicks: 1, Percent: 25},
+		{Value: "t.co", Clicks: 1, Percent: 25},
+	}, breakdown.Values)
+
+	// The limit keeps the most common values, the rest is summed up as other
+	_, breakdown = getBreakdown(t, server.URL, shortCode, "by=browser&limit=1&include_bots=true")
+	assert.Equal(t, 5, breakdown.Total)
+	assert.Equal(t, 3, breakdown.Other)
+	assert.Equal(t, []handlers.BreakdownValue{{Value: "Firefox", Clicks: 2, Percent: 40}}, breakdown.Values)
+
+	// Time range, dates start at midnight in tz and to is exclusive
+	_, breakdown = getBreakdown(t, server.URL, shortCode, "by=device&from=2025-05-01T09:30:00Z&to=2025-05-03")
+	assert.Equal(t, 2, breakdown.Total)
+	assert.Equal(t, []handlers.BreakdownValue{{Value: "mobile", Clicks: 2, Percent: 100}}, breakdown.Values)
+	_, breakdown = getBreakdown(t, server.URL, shortCode, "by=os&from=2025-05-03&to=2025-05-04&tz=America/New_York")
+	assert.Equal(t, []handlers.BreakdownValue{{Value: "Windows", Clicks: 1, Percent: 100}}, breakdown.Values)
+
+	_, breakdown = getBreakdown(t, server.URL, shortCode, "by=os&from=2024-01-01&to=2024-02-01")
+	assert.Equal(t, 0, breakdown.Total)
+	assert.Empty(t, breakdown.Values)
+
+	for _, query := range []string{"", "by=user_agent", "by=os&limit=0", "by=os&limit=101", "by=os&limit=ten", "by=os&from=2025-05-04&to=2025-05-01", "by=os&tz=Nowhere"} {
+		status, _ := getBreakdown(t, server.URL, shortCode, query)
+		assert.Equal(t, http.StatusBadRequest, status, query)
+	}
+}
+
+func TestTopURLsInMemory(t *testing.T) {
+	server := newMemoryAPI(t)
+	popular := createShortCode(t, server, URLRequest{LongURL: "https://example.com/popular"})
+	steady := createShortCode(t, server, URLRequest{LongURL: "https://example.com/steady"})
+	crawled := createShortCode(t, server, URLRequest{LongURL: "https://example.com/crawled-only"})
+
+	click := func(shortCode, userAgent string, times int) {
+		for i := 0; i < times; i++ {
+			req, _ := http.NewRequest("GET", server.URL+"/api/v1/"+shortCode, nil)
+			req.Header.Set("User-Agent", userAgent)
+			resp, err := noRedirectClient.Do(req)
+			assert.NoError(t, err)
+			resp.Body.Close()
+		}
+	}
+	click(popular, testUserAgent, 3)
+	click(steady, testUserAgent, 2)
+	click(crawled, "Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)", 5)
+
+	top := func(query string) (int, []handlers.TopURL) {
+		resp, err := apiClient.Get(server.URL + "/api/v1/top?" + query)
+		assert.NoError(t, err)
+		defer resp.Body.Close()
+		var body struct {
+			Window string            `json:"window"`
+			URLs   []handlers.TopURL `json:"urls"`
+		}
+		if resp.StatusCode == http.StatusOK {
+			assert.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+			assert.NotEmpty(t, body.Window)
+		}
+		return resp.StatusCode, body.URLs
+	}
+
+	baseURL := config.Default().Server.BaseURL
+	status, ranked := top("")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, []handlers.TopURL{{ShortURL: baseURL + popular, Clicks: 3}, {ShortURL: baseURL + steady, Clicks: 2}}, ranked) // Bots are not ranked
+	_, ranked = top("window=7d&limit=1")
+	assert.Equal(t, []handlers.TopURL{{ShortURL: baseURL + popular, Clicks: 3}}, ranked)
+
+	// Deleted links leave the ranking
+	resp := doWithKey(t, "DELETE", server.URL+"/api/v1/"+popular, testAPIKey, nil)
+	resp.Body.Close()
+	_, ranked = top("window=1h")
+	assert.Equal(t, []handlers.TopURL{{ShortURL: baseURL + steady, Clicks: 2}}, ranked)
+
+	for _, query := range []string{"window=0h", "window=90m", "window=8d", "window=soon", "limit=0"} {
+		status, _ := top(query)
+		assert.Equal(t, http.StatusBadRequest, status, query)
+	}
+
+	// The ranking spans every owner's links
+	alice := createKey(t, server.URL+"/api/v1", "alice")
+	resp = doWithKey(t, "GET", server.URL+"/api/v1/top", alice.Key, nil)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+}
+
+func TestGeneratedShortURLSkipsRoutesInMemory(t *testing.T) {
+	server := newMemoryAPI(t)
+
+	// The next generated code would be "top", which GET /api/v1/top shadows
+	ids := config.Default().IDs
+	ids.CounterOffset = base62.DecodeToInt64("top") - 1
+	handlers.InitHandlers(config.Default().Server, ids, config.Default().Dedup)
+	t.Cleanup(func() { handlers.InitHandlers(config.Default().Server, config.Default().IDs, config.Default().Dedup) })
+
+	shortCode := createShortCode(t, server, URLRequest{LongURL: "https://example.com/not-top"})
+	assert.NotEqual(t, "top", shortCode)
+	_, location := redirectOf(t, server.URL+"/api/v1", shortCode)
+	assert.Equal(t, "https://example.com/not-top", location)
+
+	assert.Equal(t, http.StatusBadRequest, createStatus(t, server, URLRequest{LongURL: "https://example.com/b", CustomAlias: "top"}))
+}
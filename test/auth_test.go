@@ -0,0 +1,148 @@
+package e2etest
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+
+	"cloudflaretinyurl/config"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Admin key used by every test, matching ADMIN_API_KEY of the service under test
+var testAPIKey = func() string {
+	if key := os.Getenv("ADMIN_API_KEY"); key != "" {
+		return key
+	}
+	return "tk_local_admin_key_change_me"
+}()
+
+// Browser user agent sent by default, Go's own is classified as a bot whose clicks are not counted
+const testUserAgent = "Mozilla/5.0 (X11; Linux x86_64; rv:127.0) Gecko/20100101 Firefox/127.0"
+
+// authTransport sends testAPIKey and testUserAgent with requests that do not carry their own
+type authTransport struct{}
+
+func (authTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Header.Get("Authorization") == "" || req.Header.Get("User-Agent") == "" {
+		req = req.Clone(req.Context())
+		if req.Header.Get("Authorization") == "" {
+			req.Header.Set("Authorization", "Bearer "+testAPIKey)
+		}
+		if req.Header.Get("User-Agent") == "" {
+			req.Header.Set("User-Agent", testUserAgent)
+		}
+	}
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+// apiClient authenticates as the admin, http.DefaultClient is left without credentials
+var apiClient = &http.Client{Transport: authTransport{}}
+
+type keyResponse struct {
+	Key    string `json:"key"`
+	APIKey struct {
+		ID    int64  `json:"id"`
+		Owner string `json:"owner"`
+		Admin bool   `json:"admin"`
+	} `json:"api_key"`
+}
+
+// Send a request with the given API key, an empty key sends none
+func doWithKey(t *testing.T, method, url, key string, body interface{}) *http.Response {
+	var payload bytes.Buffer
+	if body != nil {
+		assert.NoError(t, json.NewEncoder(&payload).Encode(body))
+	}
+	req, err := http.NewRequest(method, url, &payload)
+	assert.NoError(t, err)
+	req.Header.Set("Authorization", "Bearer "+key)
+	if key == "" {
+		req.Header.Set("Authorization", "none") // Keeps authTransport from adding testAPIKey
+	}
+	resp, err := apiClient.Do(req)
+	assert.NoError(t, err)
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+func createKey(t *testing.T, apiURL, owner string) keyResponse {
+	resp := doWithKey(t, "POST", apiURL+"/keys", testAPIKey, map[string]string{"owner": owner})
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+	var created keyResponse
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&created))
+	return created
+}
+
+func TestAPIKeyOwnershipInMemory(t *testing.T) {
+	server := newMemoryAPI(t)
+	apiURL := server.URL + "/api/v1"
+
+	alice := createKey(t, apiURL, "alice")
+	bob := createKey(t, apiURL, "bob")
+	assert.Equal(t, "alice", alice.APIKey.Owner)
+	assert.False(t, alice.APIKey.Admin)
+
+	// Creating links requires a valid key
+	link := URLRequest{LongURL: "https://example.com/owned"}
+	assert.Equal(t, http.StatusUnauthorized, doWithKey(t, "POST", apiURL+"/create", "", link).StatusCode)
+	assert.Equal(t, http.StatusUnauthorized, doWithKey(t, "POST", apiURL+"/create", "tk_unknown", link).StatusCode)
+
+	resp := doWithKey(t, "POST", apiURL+"/create", alice.Key, link)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	var created URLResponse
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&created))
+	shortCode := strings.TrimPrefix(created.ShortURL, config.Default().Server.BaseURL)
+
+	// Only the owner and admins manage the link, redirects stay public
+	redirect, err := (&http.Client{CheckRedirect: noRedirectClient.CheckRedirect}).Get(apiURL + "/" + shortCode)
+	assert.NoError(t, err)
+	redirect.Body.Close()
+	assert.Equal(t, http.StatusFound, redirect.StatusCode)
+	assert.Equal(t, http.StatusForbidden, doWithKey(t, "GET", apiURL+"/clicks/"+shortCode, bob.Key, nil).StatusCode)
+	assert.Equal(t, http.StatusForbidden, doWithKey(t, "DELETE", apiURL+"/"+shortCode, bob.Key, nil).StatusCode)
+	assert.Equal(t, http.StatusOK, doWithKey(t, "GET", apiURL+"/clicks/"+shortCode, alice.Key, nil).StatusCode)
+	assert.Equal(t, http.StatusForbidden, doWithKey(t, "GET", apiURL+"/admin/dead_letters", alice.Key, nil).StatusCode)
+	assert.Equal(t, http.StatusForbidden, doWithKey(t, "POST", apiURL+"/keys", alice.Key, map[string]string{"owner": "alice"}).StatusCode)
+	assert.Equal(t, http.StatusNoContent, doWithKey(t, "DELETE", apiURL+"/"+shortCode, alice.Key, nil).StatusCode)
+}
+
+func TestAPIKeyRotationAndRevocationInMemory(t *testing.T) {
+	server := newMemoryAPI(t)
+	apiURL := server.URL + "/api/v1"
+	old := createKey(t, apiURL, "carol")
+	other := createKey(t, apiURL, "dave")
+	link := URLRequest{LongURL: "https://example.com/rotated"}
+
+	// Keys of other owners are invisible
+	assert.Equal(t, http.StatusNotFound, doWithKey(t, "POST", fmt.Sprintf("%s/keys/%d/rotate", apiURL, old.APIKey.ID), other.Key, nil).StatusCode)
+
+	// During the grace period both keys work
+	resp := doWithKey(t, "POST", fmt.Sprintf("%s/keys/%d/rotate?grace=1h", apiURL, old.APIKey.ID), old.Key, nil)
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+	var rotated keyResponse
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&rotated))
+	assert.Equal(t, "carol", rotated.APIKey.Owner)
+	assert.NotEqual(t, old.Key, rotated.Key)
+	assert.Equal(t, http.StatusOK, doWithKey(t, "POST", apiURL+"/create", old.Key, link).StatusCode)
+	assert.Equal(t, http.StatusOK, doWithKey(t, "POST", apiURL+"/create", rotated.Key, link).StatusCode)
+
+	var listed struct {
+		Keys []struct {
+			ID int64 `json:"id"`
+		} `json:"keys"`
+	}
+	resp = doWithKey(t, "GET", apiURL+"/keys", rotated.Key, nil)
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&listed))
+	assert.Len(t, listed.Keys, 2)
+
+	// Revocation takes effect immediately, cutting the grace period short
+	assert.Equal(t, http.StatusNoContent, doWithKey(t, "DELETE", fmt.Sprintf("%s/keys/%d", apiURL, old.APIKey.ID), rotated.Key, nil).StatusCode)
+	assert.Equal(t, http.StatusUnauthorized, doWithKey(t, "POST", apiURL+"/create", old.Key, link).StatusCode)
+	assert.Equal(t, http.StatusOK, doWithKey(t, "POST", apiURL+"/create", rotated.Key, link).StatusCode)
+}
@@ -0,0 +1,98 @@
+package e2etest
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"cloudflaretinyurl/clientip"
+	"cloudflaretinyurl/config"
+	"cloudflaretinyurl/ratelimit"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func requestFrom(remoteAddr string, forwardedFor ...string) *http.Request {
+	r := httptest.NewRequest("GET", "/api/v1/abc", nil)
+	r.RemoteAddr = remoteAddr
+	for _, header := range forwardedFor {
+		r.Header.Add("X-Forwarded-For", header)
+	}
+	return r
+}
+
+func TestClientIPFromTrustedProxies(t *testing.T) {
+	t.Cleanup(func() { clientip.InitClientIP(config.Default().ClientIP) })
+
+	// Without trusted proxies the header is ignored
+	clientip.InitClientIP(config.ClientIP{Privacy: "full"})
+	assert.Equal(t, "203.0.113.7", clientip.FromRequest(requestFrom("203.0.113.7:4000", "198.51.100.1")))
+
+	clientip.InitClientIP(config.ClientIP{TrustedProxies: "10.0.0.0/8, 192.0.2.1", Privacy: "full"})
+	for _, tc := range []struct {
+		name         string
+		remoteAddr   string
+		forwardedFor []string
+		want         string
+	}{
+		{"untrusted peer", "203.0.113.7:4000", []string{"198.51.100.1"}, "203.0.113.7"},
+		{"one proxy", "10.1.2.3:4000", []string{"198.51.100.1"}, "198.51.100.1"},
+		{"spoofed hop left of the client", "10.1.2.3:4000", []string{"6.6.6.6, 198.51.100.1"}, "198.51.100.1"},
+		{"proxy chain", "10.1.2.3:4000", []string{"198.51.100.1, 192.0.2.1", "10.9.9.9"}, "198.51.100.1"},
+		{"hop with port", "192.0.2.1:4000", []string{"198.51.100.1:5555"}, "198.51.100.1"},
+		{"garbage stops the walk", "10.1.2.3:4000", []string{"198.51.100.1, junk, 10.2.2.2"}, "10.2.2.2"},
+		{"no header", "10.1.2.3:4000", nil, "10.1.2.3"},
+		{"ipv6", "[2001:db8::1]:4000", nil, "2001:db8::1"},
+	} {
+		assert.Equal(t, tc.want, clientip.FromRequest(requestFrom(tc.remoteAddr, tc.forwardedFor...)), tc.name)
+	}
+}
+
+func TestClientIPAnonymization(t *testing.T) {
+	t.Cleanup(func() { clientip.InitClientIP(config.Default().ClientIP) })
+
+	clientip.InitClientIP(config.ClientIP{Privacy: "truncate"})
+	assert.Equal(t, "198.51.100.0", clientip.Anonymize("198.51.100.77"))
+	assert.Equal(t, "2001:db8:abcd::", clientip.Anonymize("2001:db8:abcd:12::1"))
+	assert.Equal(t, "", clientip.Anonymize("not an ip"))
+
+	clientip.InitClientIP(config.ClientIP{Privacy: "hash", HashKey: "0123456789abcdef"})
+	hashed := clientip.Anonymize("198.51.100.77")
+	assert.Len(t, hashed, 32)
+	assert.Equal(t, hashed, clientip.Anonymize("198.51.100.77"))
+	assert.NotEqual(t, hashed, clientip.Anonymize("198.51.100.78"))
+
+	clientip.InitClientIP(config.ClientIP{Privacy: "none"})
+	assert.Equal(t, "", clientip.Anonymize("198.51.100.77"))
+
+	clientip.InitClientIP(config.ClientIP{Privacy: "full"})
+	assert.Equal(t, "198.51.100.77", clientip.Anonymize("198.51.100.77"))
+
+	_, err := config.Load([]string{"-ip-privacy", "hash", "-trusted-proxies", "10.0.0.0/33", "-storage-backend", "memory"})
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "client_ip.hash_key")
+		assert.Contains(t, err.Error(), "client_ip.trusted_proxies")
+	}
+}
+
+func TestRateLimitPerForwardedClientInMemory(t *testing.T) {
+	server := newMemoryAPI(t)
+	shortCode := createShortCode(t, server, URLRequest{LongURL: "https://example.com/proxied"})
+	clientip.InitClientIP(config.ClientIP{TrustedProxies: "127.0.0.1", Privacy: "truncate"})
+	t.Cleanup(func() { clientip.InitClientIP(config.Default().ClientIP) })
+	ratelimit.InitRateLimit(config.RateLimit{Enabled: true, IPRate: 0.5, IPBurst: 1}, nil)
+
+	redirect := func(client string) int {
+		req, _ := http.NewRequest("GET", server.URL+"/api/v1/"+shortCode, nil)
+		req.Header.Set("X-Forwarded-For", client)
+		resp, err := noRedirectClient.Do(req)
+		assert.NoError(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	// Clients behind the same proxy have separate budgets
+	assert.Equal(t, http.StatusFound, redirect("198.51.100.1"))
+	assert.Equal(t, http.StatusTooManyRequests, redirect("198.51.100.1"))
+	assert.Equal(t, http.StatusFound, redirect("198.51.100.2"))
+}
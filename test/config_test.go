@@ -0,0 +1,76 @@
+package e2etest
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"cloudflaretinyurl/config"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func writeConfigFile(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	assert.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+	return path
+}
+
+func TestConfigPrecedence(t *testing.T) {
+	path := writeConfigFile(t, `
+server:
+  addr: ":9000"
+  base_url: "https://sho.rt/"
+storage:
+  backend: memory
+cache:
+  max_ttl: 1h
+ids:
+  counter_offset: 5
+`)
+	t.Setenv("CACHE_MAX_TTL", "2h")
+	t.Setenv("COUNTER_OFFSET", "7")
+
+	cfg, err := config.Load([]string{"-config", path, "-counter-offset", "9"})
+	assert.NoError(t, err)
+
+	assert.Equal(t, ":9000", cfg.Server.Addr)                                // file over default
+	assert.Equal(t, "https://sho.rt/", cfg.Server.BaseURL)                   // file over default
+	assert.Equal(t, 2*time.Hour, cfg.Cache.MaxTTL)                           // env over file
+	assert.Equal(t, int64(9), cfg.IDs.CounterOffset)                         // flag over env
+	assert.Equal(t, config.Default().Clicks.FlushSize, cfg.Clicks.FlushSize) // default when unset
+}
+
+func TestConfigValidation(t *testing.T) {
+	t.Setenv("STORAGE_BACKEND", "postgres")
+	t.Setenv("DATABASE_URL", "")
+
+	_, err := config.Load([]string{"-click-workers", "0", "-base-url", "ftp://example.com"})
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "postgres.url must be set")
+		assert.Contains(t, err.Error(), "clicks.workers must be positive")
+		assert.Contains(t, err.Error(), "server.base_url")
+	}
+
+	_, err = config.Load([]string{"-click-workers", "many"})
+	assert.ErrorContains(t, err, "-click-workers")
+
+	_, err = config.Load([]string{"-config", writeConfigFile(t, "server:\n  adr: \":1\"\n")})
+	assert.ErrorContains(t, err, "adr")
+}
+
+func TestConfigRedactsSecrets(t *testing.T) {
+	t.Setenv("DATABASE_URL", "postgres://user:hunter2@db:5432/app")
+	t.Setenv("REDIS_PASSWORD", "s3cret")
+
+	cfg, err := config.Load(nil)
+	assert.NoError(t, err)
+
+	printed := cfg.String()
+	assert.NotContains(t, printed, "hunter2")
+	assert.NotContains(t, printed, "s3cret")
+	assert.Contains(t, printed, "postgres.url = postgres://user:xxxxx@db:5432/app")
+	assert.Contains(t, printed, "redis.password = [REDACTED]")
+	assert.Contains(t, printed, "server.addr = :8080")
+}
@@ -0,0 +1,84 @@
+package e2etest
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"cloudflaretinyurl/config"
+	"cloudflaretinyurl/handlers"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func useDedupScope(scope string) {
+	handlers.InitHandlers(config.Default().Server, config.Default().IDs, config.Dedup{Scope: scope})
+}
+
+func TestExpiredAndDeletedLinksDoNotBlockRecreationInMemory(t *testing.T) {
+	server := newMemoryAPI(t)
+
+	expiresAt := time.Now().Add(200 * time.Millisecond)
+	expired := createShortCode(t, server, URLRequest{LongURL: "https://example.com/again", ExpiresAt: &expiresAt})
+	time.Sleep(300 * time.Millisecond)
+	recreated := createShortCode(t, server, URLRequest{LongURL: "https://example.com/again"})
+	assert.NotEqual(t, expired, recreated)
+	assert.Equal(t, recreated, createShortCode(t, server, URLRequest{LongURL: "https://example.com/again"}))
+
+	req, _ := http.NewRequest("DELETE", server.URL+"/api/v1/"+recreated, nil)
+	resp, err := apiClient.Do(req)
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	assert.NotEqual(t, recreated, createShortCode(t, server, URLRequest{LongURL: "https://example.com/again"}))
+}
+
+func TestDedupScopesInMemory(t *testing.T) {
+	server := newMemoryAPI(t)
+	apiURL := server.URL + "/api/v1"
+	alice := createKey(t, apiURL, "alice")
+	bob := createKey(t, apiURL, "bob")
+	link := URLRequest{LongURL: "https://example.com/shared"}
+
+	create := func(key string) string {
+		resp := doWithKey(t, "POST", apiURL+"/create", key, link)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		var created URLResponse
+		assert.NoError(t, json.NewDecoder(resp.Body).Decode(&created))
+		return created.ShortURL
+	}
+
+	global := create(alice.Key)
+	assert.Equal(t, global, create(bob.Key))
+
+	useDedupScope("owner")
+	t.Cleanup(func() { useDedupScope("global") })
+	aliceURL := create(alice.Key)
+	assert.NotEqual(t, global, aliceURL) // The global link has no owner key
+	assert.Equal(t, aliceURL, create(alice.Key))
+	assert.NotEqual(t, aliceURL, create(bob.Key))
+
+	useDedupScope("off")
+	assert.NotEqual(t, create(alice.Key), create(alice.Key))
+}
+
+func TestConcurrentCreatesShareOneShortURLInMemory(t *testing.T) {
+	server := newMemoryAPI(t)
+
+	codes := make([]string, 20)
+	var wg sync.WaitGroup
+	for i := range codes {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			codes[i] = createShortCode(t, server, URLRequest{LongURL: "https://example.com/contended"})
+		}()
+	}
+	wg.Wait()
+
+	for _, code := range codes {
+		assert.Equal(t, codes[0], code)
+	}
+}
@@ -16,8 +16,9 @@ import (
 
 // Struct for API request & response
 type URLRequest struct {
-	LongURL   string     `json:"long_url"`
-	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	LongURL     string     `json:"long_url"`
+	CustomAlias string     `json:"custom_alias,omitempty"`
+	ExpiresAt   *time.Time `json:"expires_at,omitempty"`
 }
 
 type URLResponse struct {
@@ -58,7 +59,7 @@ func TestCreateUniqueShortURLsE2E(t *testing.T) {
 		jsonData, err := json.Marshal(requestBody)
 		assert.NoError(t, err)
 
-		resp, err := http.Post(baseAPI+"/create", "application/json", bytes.NewBuffer(jsonData))
+		resp, err := apiClient.Post(baseAPI+"/create", "application/json", bytes.NewBuffer(jsonData))
 		assert.NoError(t, err)
 		assert.Equal(t, http.StatusOK, resp.StatusCode)
 
@@ -85,7 +86,7 @@ func TestCreateUniqueShortURLsE2E(t *testing.T) {
 func isRedirectSuccessful(shortURL string) bool {
 	fmt.Println("Redirecting to:", shortURL)
 
-	resp, err := http.Get(shortURL)
+	resp, err := apiClient.Get(shortURL)
 	if err != nil {
 		fmt.Println("Error during redirect:", err)
 		return false
@@ -127,7 +128,7 @@ func TestShortURLClickTrackingE2E(t *testing.T) {
 	jsonData, err := json.Marshal(requestBody)
 	assert.NoError(t, err)
 
-	resp, err := http.Post(baseAPI+"/create", "application/json", bytes.NewBuffer(jsonData))
+	resp, err := apiClient.Post(baseAPI+"/create", "application/json", bytes.NewBuffer(jsonData))
 	assert.NoError(t, err)
 	assert.Equal(t, http.StatusOK, resp.StatusCode)
 
@@ -165,7 +166,7 @@ func TestShortURLClickTrackingE2E(t *testing.T) {
 	assert.Equal(t, 0, clicks.Last1Min)
 
 	// Step 5: Redirect once & validate last_1min count is 1
-	http.Get(testShortURL)
+	apiClient.Get(testShortURL)
 	time.Sleep(2 * time.Second)
 	clicks = getClickCounts(t, testShortURL)
 	assert.Equal(t, 1, clicks.Last1Min)
@@ -189,9 +190,9 @@ func getClickCounts(t *testing.T, shortURL string) ClickCounts {
 	// Extract the short code from the URL path
 	shortCode := strings.TrimPrefix(parsedURL.Path, "/api/v1/")
 
-	// Construct the API request URL
-	clicksAPIURL := fmt.Sprintf("%s/clicks/%s", baseAPI, shortCode)
-	resp, err := http.Get(clicksAPIURL)
+	// Construct the API request URL, the redirect clients send Go's user agent and count as bots
+	clicksAPIURL := fmt.Sprintf("%s/clicks/%s?include_bots=true", baseAPI, shortCode)
+	resp, err := apiClient.Get(clicksAPIURL)
 
 	// Handle HTTP request errors
 	assert.NoError(t, err, " Error making request to clicks API")
@@ -219,7 +220,7 @@ func TestCreateRedirectDeleteURLsE2E(t *testing.T) {
 		jsonData, err := json.Marshal(requestBody)
 		assert.NoError(t, err)
 
-		resp, err := http.Post(baseAPI+"/create", "application/json", bytes.NewBuffer(jsonData))
+		resp, err := apiClient.Post(baseAPI+"/create", "application/json", bytes.NewBuffer(jsonData))
 		assert.NoError(t, err)
 		assert.Equal(t, http.StatusOK, resp.StatusCode)
 
@@ -234,10 +235,9 @@ func TestCreateRedirectDeleteURLsE2E(t *testing.T) {
 
 	// Step 3: Delete URLs & Confirm Deletion
 	for shortURL := range testURLs {
-		client := &http.Client{}
 		log.Println("Deleting url:", shortURL)
 		req, _ := http.NewRequest("DELETE", shortURL, nil)
-		resp, _ := client.Do(req)
+		resp, _ := apiClient.Do(req)
 		assert.Equal(t, http.StatusNoContent, resp.StatusCode)
 	}
 }
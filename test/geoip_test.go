@@ -0,0 +1,122 @@
+package e2etest
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"cloudflaretinyurl/clientip"
+	"cloudflaretinyurl/config"
+	"cloudflaretinyurl/database"
+	"cloudflaretinyurl/geoip"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Fixture databases covering the documentation ranges 198.51.100.0/24, 203.0.113.0/24,
+// 192.0.2.0/24 (country only) and 2001:db8::/32 (no ASN)
+var testGeoIP = config.GeoIP{
+	Database:    "testdata/test-city.mmdb",
+	ASNDatabase: "testdata/test-asn.mmdb",
+	CacheSize:   2,
+}
+
+func TestGeoIPLookup(t *testing.T) {
+	t.Cleanup(func() { geoip.InitGeoIP(config.Default().GeoIP) })
+
+	assert.False(t, geoip.Enabled())
+	assert.Equal(t, geoip.Location{}, geoip.Lookup("198.51.100.7"))
+
+	assert.NoError(t, geoip.InitGeoIP(testGeoIP))
+	assert.True(t, geoip.Enabled())
+	for _, tc := range []struct {
+		ip   string
+		want geoip.Location
+	}{
+		{"198.51.100.7", geoip.Location{Country: "US", Region: "California", City: "San Francisco", ASN: 64496}},
+		{"203.0.113.200", geoip.Location{Country: "DE", Region: "Berlin", City: "Berlin", ASN: 64497}},
+		{"192.0.2.1", geoip.Location{Country: "FR"}},
+		{"2001:db8::1", geoip.Location{Country: "JP", Region: "Tokyo", City: "Tokyo"}},
+		{"10.0.0.1", geoip.Location{}},
+		{"not an ip", geoip.Location{}},
+		{"198.51.100.7", geoip.Location{Country: "US", Region: "California", City: "San Francisco", ASN: 64496}}, // Cached
+	} {
+		assert.Equal(t, tc.want, geoip.Lookup(tc.ip), tc.ip)
+	}
+
+	// Missing databases fail the startup
+	assert.Error(t, geoip.InitGeoIP(config.GeoIP{Database: "testdata/missing.mmdb", CacheSize: 1}))
+	_, err := config.Load([]string{"-geoip-cache-size", "0", "-storage-backend", "memory"})
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "geoip.cache_size")
+	}
+}
+
+func TestGeoIPReloadKeepsDatabaseOnError(t *testing.T) {
+	t.Cleanup(func() { geoip.InitGeoIP(config.Default().GeoIP) })
+
+	// An ASN-only setup, replaced by a city database on reload
+	path := filepath.Join(t.TempDir(), "geo.mmdb")
+	copyFile(t, "testdata/test-asn.mmdb", path)
+	assert.NoError(t, geoip.InitGeoIP(config.GeoIP{Database: path, CacheSize: 10}))
+	assert.Equal(t, geoip.Location{}, geoip.Lookup("198.51.100.7"))
+
+	copyFile(t, "testdata/test-city.mmdb", path)
+	assert.NoError(t, geoip.Reload())
+	assert.Equal(t, "US", geoip.Lookup("198.51.100.7").Country) // Not served from the previous cache
+
+	assert.NoError(t, os.WriteFile(path, []byte("not a database"), 0o644))
+	assert.Error(t, geoip.Reload())
+	assert.Equal(t, "DE", geoip.Lookup("203.0.113.1").Country)
+}
+
+func copyFile(t *testing.T, from, to string) {
+	data, err := os.ReadFile(from)
+	assert.NoError(t, err)
+	assert.NoError(t, os.WriteFile(to, data, 0o644))
+}
+
+func TestGeoBreakdownInMemory(t *testing.T) {
+	server := newMemoryAPI(t)
+	shortCode := createShortCode(t, server, URLRequest{LongURL: "https://example.com/around-the-world"})
+	assert.NoError(t, geoip.InitGeoIP(testGeoIP))
+	t.Cleanup(func() { geoip.InitGeoIP(config.Default().GeoIP) })
+
+	// Geolocation uses the client IP before it is anonymized, even when none is stored
+	clientip.InitClientIP(config.ClientIP{TrustedProxies: "127.0.0.1", Privacy: "none"})
+	t.Cleanup(func() { clientip.InitClientIP(config.Default().ClientIP) })
+
+	for _, client := range []string{"198.51.100.7", "198.51.100.8", "203.0.113.9", "10.1.1.1"} {
+		req, _ := http.NewRequest("GET", server.URL+"/api/v1/"+shortCode, nil)
+		req.Header.Set("X-Forwarded-For", client)
+		resp, err := noRedirectClient.Do(req)
+		assert.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusFound, resp.StatusCode)
+	}
+
+	breakdown := func(by string) []database.BreakdownRow {
+		resp, err := apiClient.Get(server.URL + "/api/v1/links/" + shortCode + "/breakdown?by=" + by)
+		assert.NoError(t, err)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		var body struct {
+			By     string                  `json:"by"`
+			Values []database.BreakdownRow `json:"values"`
+		}
+		assert.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+		assert.Equal(t, by, body.By)
+		return body.Values
+	}
+	assert.Equal(t, []database.BreakdownRow{{Value: "US", Clicks: 2}, {Value: "", Clicks: 1}, {Value: "DE", Clicks: 1}}, breakdown("country"))
+	assert.Equal(t, []database.BreakdownRow{{Value: "California", Clicks: 2}, {Value: "", Clicks: 1}, {Value: "Berlin", Clicks: 1}}, breakdown("region"))
+	assert.Equal(t, []database.BreakdownRow{{Value: "San Francisco", Clicks: 2}, {Value: "", Clicks: 1}, {Value: "Berlin", Clicks: 1}}, breakdown("city"))
+	assert.Equal(t, []database.BreakdownRow{{Value: "64496", Clicks: 2}, {Value: "", Clicks: 1}, {Value: "64497", Clicks: 1}}, breakdown("asn"))
+
+	resp, err := apiClient.Get(server.URL + "/api/v1/links/" + shortCode + "/breakdown?by=planet")
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
@@ -0,0 +1,71 @@
+package e2etest
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"cloudflaretinyurl/config"
+	"cloudflaretinyurl/health"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func getHealthReport(t *testing.T, url string) (int, health.Report) {
+	resp, err := http.Get(url)
+	assert.NoError(t, err)
+	defer resp.Body.Close()
+
+	var report health.Report
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&report))
+	return resp.StatusCode, report
+}
+
+func TestHealthAndReadinessInMemory(t *testing.T) {
+	server := newMemoryAPI(t)
+	health.Reset()
+	t.Cleanup(health.Reset)
+
+	healthConfig := config.Default().Health
+	healthConfig.CheckTimeout = 100 * time.Millisecond
+	health.InitHealth(healthConfig)
+	t.Cleanup(func() { health.InitHealth(config.Default().Health) })
+
+	health.Beat("test worker", time.Minute)
+	status, report := getHealthReport(t, server.URL+"/readyz")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, health.StatusOK, report.Status)
+	assert.Equal(t, health.StatusOK, report.Checks["worker:test worker"].Status)
+
+	// Failing non-critical checks degrade readiness without failing it
+	health.AddCheck(health.Check{Name: "optional", Run: func(ctx context.Context) error { return errors.New("down") }})
+	status, report = getHealthReport(t, server.URL+"/readyz")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, health.StatusDegraded, report.Status)
+	assert.Equal(t, "down", report.Checks["optional"].Error)
+
+	// A critical check that hangs is cut off by the check timeout
+	health.AddCheck(health.Check{Name: "database", Critical: true, Run: func(ctx context.Context) error {
+		time.Sleep(time.Second)
+		return nil
+	}})
+	start := time.Now()
+	status, report = getHealthReport(t, server.URL+"/readyz")
+	assert.Less(t, time.Since(start), 500*time.Millisecond)
+	assert.Equal(t, http.StatusServiceUnavailable, status)
+	assert.Equal(t, health.StatusUnavailable, report.Status)
+	assert.Contains(t, report.Checks["database"].Error, "timed out")
+
+	// Liveness ignores dependencies and only fails on stale workers
+	status, report = getHealthReport(t, server.URL+"/healthz")
+	assert.Equal(t, http.StatusOK, status)
+	assert.NotContains(t, report.Checks, "database")
+
+	health.Beat("stuck worker", -time.Second)
+	status, report = getHealthReport(t, server.URL+"/healthz")
+	assert.Equal(t, http.StatusServiceUnavailable, status)
+	assert.Equal(t, health.StatusUnavailable, report.Checks["worker:stuck worker"].Status)
+}
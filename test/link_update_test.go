@@ -0,0 +1,168 @@
+package e2etest
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"cloudflaretinyurl/config"
+	"cloudflaretinyurl/database"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type linkResponse struct {
+	ShortURL  string     `json:"short_url"`
+	LongURL   string     `json:"long_url"`
+	ExpiresAt *time.Time `json:"expires_at"`
+	Enabled   bool       `json:"enabled"`
+	Revision  int        `json:"revision"`
+}
+
+type linkHistory struct {
+	Revisions []struct {
+		Revision   int        `json:"revision"`
+		LongURL    string     `json:"long_url"`
+		ExpiresAt  *time.Time `json:"expires_at"`
+		Enabled    bool       `json:"enabled"`
+		Flagged    bool       `json:"flagged"`
+		FlagReason string     `json:"flag_reason"`
+		ChangedBy  string     `json:"changed_by"`
+	} `json:"revisions"`
+}
+
+func patchLink(t *testing.T, apiURL, shortCode string, patch map[string]any) (int, linkResponse) {
+	resp := doWithKey(t, "PATCH", apiURL+"/links/"+shortCode, testAPIKey, patch)
+	defer resp.Body.Close()
+	var updated linkResponse
+	if resp.StatusCode == http.StatusOK {
+		assert.NoError(t, json.NewDecoder(resp.Body).Decode(&updated))
+	}
+	return resp.StatusCode, updated
+}
+
+func redirectOf(t *testing.T, apiURL, shortCode string) (int, string) {
+	resp, err := noRedirectClient.Get(apiURL + "/" + shortCode)
+	assert.NoError(t, err)
+	resp.Body.Close()
+	return resp.StatusCode, resp.Header.Get("Location")
+}
+
+func TestUpdateLinkInMemory(t *testing.T) {
+	server := newMemoryAPI(t)
+	apiURL := server.URL + "/api/v1"
+	shortCode := createShortCode(t, server, URLRequest{LongURL: "https://example.com/before"})
+
+	// Redirect once so the old mapping is cached
+	status, location := redirectOf(t, apiURL, shortCode)
+	assert.Equal(t, http.StatusFound, status)
+	assert.Equal(t, "https://example.com/before", location)
+
+	status, updated := patchLink(t, apiURL, shortCode, map[string]any{"long_url": "HTTPS://Example.com/after"})
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, linkResponse{ShortURL: config.Default().Server.BaseURL + shortCode, LongURL: "https://example.com/after", Enabled: true, Revision: 2}, updated)
+	_, location = redirectOf(t, apiURL, shortCode)
+	assert.Equal(t, "https://example.com/after", location)
+
+	expiresAt := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+	status, updated = patchLink(t, apiURL, shortCode, map[string]any{"expires_at": expiresAt})
+	assert.Equal(t, http.StatusOK, status)
+	assert.True(t, expiresAt.Equal(*updated.ExpiresAt))
+	status, updated = patchLink(t, apiURL, shortCode, map[string]any{"expires_at": nil})
+	assert.Equal(t, http.StatusOK, status)
+	assert.Nil(t, updated.ExpiresAt)
+
+	status, _ = patchLink(t, apiURL, shortCode, map[string]any{"enabled": false})
+	assert.Equal(t, http.StatusOK, status)
+	status, _ = redirectOf(t, apiURL, shortCode)
+	assert.Equal(t, http.StatusGone, status)
+	status, updated = patchLink(t, apiURL, shortCode, map[string]any{"enabled": true})
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, 6, updated.Revision)
+	status, _ = redirectOf(t, apiURL, shortCode)
+	assert.Equal(t, http.StatusFound, status)
+
+	resp := doWithKey(t, "GET", apiURL+"/links/"+shortCode+"/history", testAPIKey, nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	var history linkHistory
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&history))
+	resp.Body.Close()
+	assert.Len(t, history.Revisions, 6)
+	for i, revision := range history.Revisions {
+		assert.Equal(t, i+1, revision.Revision)
+	}
+	assert.Equal(t, "https://example.com/before", history.Revisions[0].LongURL)
+	assert.Equal(t, "https://example.com/after", history.Revisions[1].LongURL)
+	assert.False(t, history.Revisions[4].Enabled)
+}
+
+// A redirect that read a link before an update caches it after the update committed
+func TestStaleCacheFillAfterUpdateInMemory(t *testing.T) {
+	server := newMemoryAPI(t)
+	apiURL := server.URL + "/api/v1"
+	shortCode := createShortCode(t, server, URLRequest{LongURL: "https://example.com/before"})
+	ctx := context.Background()
+
+	stale, err := database.URLs.GetURL(ctx, shortCode)
+	assert.NoError(t, err)
+	status, _ := patchLink(t, apiURL, shortCode, map[string]any{"long_url": "https://example.com/after"})
+	assert.Equal(t, http.StatusOK, status)
+	database.URLCache.CacheURL(ctx, shortCode, stale)
+	_, location := redirectOf(t, apiURL, shortCode)
+	assert.Equal(t, "https://example.com/after", location)
+
+	stale, err = database.URLs.GetURL(ctx, shortCode)
+	assert.NoError(t, err)
+	status, _ = patchLink(t, apiURL, shortCode, map[string]any{"enabled": false})
+	assert.Equal(t, http.StatusOK, status)
+	database.URLCache.CacheURL(ctx, shortCode, stale)
+	status, _ = redirectOf(t, apiURL, shortCode)
+	assert.Equal(t, http.StatusGone, status)
+
+	// Deleted links leave a tombstone the stale mapping cannot replace
+	resp := doWithKey(t, "DELETE", apiURL+"/"+shortCode, testAPIKey, nil)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	database.URLCache.CacheURL(ctx, shortCode, stale)
+	_, err = database.URLCache.GetCachedURL(ctx, shortCode)
+	assert.ErrorIs(t, err, database.ErrCacheMiss)
+	status, _ = redirectOf(t, apiURL, shortCode)
+	assert.Equal(t, http.StatusNotFound, status)
+}
+
+func TestUpdateLinkRejectionsInMemory(t *testing.T) {
+	server := newMemoryAPI(t)
+	apiURL := server.URL + "/api/v1"
+	shortCode := createShortCode(t, server, URLRequest{LongURL: "https://example.com/mine"})
+	createShortCode(t, server, URLRequest{LongURL: "https://example.com/taken"})
+
+	for _, patch := range []map[string]any{
+		{},
+		{"long_url": "ftp://example.com/file"},
+		{"expires_at": time.Now().Add(-time.Hour)},
+		{"unknown": true},
+	} {
+		status, _ := patchLink(t, apiURL, shortCode, patch)
+		assert.Equal(t, http.StatusBadRequest, status, "%v", patch)
+	}
+
+	// The long URL is already shortened by another live link
+	status, _ := patchLink(t, apiURL, shortCode, map[string]any{"long_url": "https://example.com/taken"})
+	assert.Equal(t, http.StatusConflict, status)
+
+	status, _ = patchLink(t, apiURL, "missing", map[string]any{"enabled": false})
+	assert.Equal(t, http.StatusNotFound, status)
+
+	other := createKey(t, apiURL, "mallory")
+	resp := doWithKey(t, "PATCH", apiURL+"/links/"+shortCode, other.Key, map[string]any{"enabled": false})
+	resp.Body.Close()
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	resp = doWithKey(t, "GET", apiURL+"/links/"+shortCode+"/history", other.Key, nil)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	_, location := redirectOf(t, apiURL, shortCode)
+	assert.Equal(t, "https://example.com/mine", location)
+}
@@ -0,0 +1,309 @@
+package e2etest
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"cloudflaretinyurl/auth"
+	"cloudflaretinyurl/clickingest"
+	"cloudflaretinyurl/clientip"
+	"cloudflaretinyurl/config"
+	"cloudflaretinyurl/database"
+	"cloudflaretinyurl/geoip"
+	"cloudflaretinyurl/handlers"
+	"cloudflaretinyurl/ratelimit"
+	"cloudflaretinyurl/routes"
+	"cloudflaretinyurl/screening"
+	"cloudflaretinyurl/sweeper"
+	"cloudflaretinyurl/urlpolicy"
+	"cloudflaretinyurl/utils"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+)
+
+// Start the API against the in-memory backend, no PostgreSQL or Redis required
+func newMemoryAPI(t *testing.T) *httptest.Server {
+	database.InitMemory(config.Default().Cache)
+	handlers.InitHandlers(config.Default().Server, config.Default().IDs, config.Default().Dedup)
+	assert.NoError(t, utils.InitSnowflake(1))
+	auth.InitAuth(config.Auth{Enabled: true, AdminKey: testAPIKey})
+	assert.NoError(t, auth.EnsureAdminKey(context.Background()))
+	clientip.InitClientIP(config.Default().ClientIP)
+	assert.NoError(t, geoip.InitGeoIP(config.Default().GeoIP))
+	ratelimit.InitRateLimit(config.Default().RateLimit, nil)
+	urlpolicy.InitURLPolicy(config.Default().URLPolicy, config.Default().Server.BaseURL)
+	assert.NoError(t, screening.InitScreening(config.Default().Screening))
+
+	server := httptest.NewServer(routes.InitRoutes())
+	t.Cleanup(server.Close)
+	return server
+}
+
+// Create a short URL on the given server and return its short code
+func createShortCode(t *testing.T, server *httptest.Server, body URLRequest) string {
+	jsonData, err := json.Marshal(body)
+	assert.NoError(t, err)
+
+	resp, err := apiClient.Post(server.URL+"/api/v1/create", "application/json", bytes.NewBuffer(jsonData))
+	assert.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var response URLResponse
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&response))
+
+	parsedURL, err := url.Parse(response.ShortURL)
+	assert.NoError(t, err)
+	return strings.TrimPrefix(parsedURL.Path, "/api/v1/")
+}
+
+var noRedirectClient = &http.Client{
+	Transport: authTransport{},
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+func TestCreateRedirectCountDeleteInMemory(t *testing.T) {
+	server := newMemoryAPI(t)
+
+	shortCode := createShortCode(t, server, URLRequest{LongURL: "https://example.com/memory"})
+	assert.NotEmpty(t, shortCode)
+
+	// Creating the same long URL again returns the existing short URL
+	assert.Equal(t, shortCode, createShortCode(t, server, URLRequest{LongURL: "https://example.com/memory"}))
+
+	for i := 0; i < 3; i++ {
+		resp, err := noRedirectClient.Get(server.URL + "/api/v1/" + shortCode)
+		assert.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusFound, resp.StatusCode)
+		assert.Equal(t, "https://example.com/memory", resp.Header.Get("Location"))
+	}
+
+	resp, err := apiClient.Get(server.URL + "/api/v1/clicks/" + shortCode)
+	assert.NoError(t, err)
+	var counts ClickCounts
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&counts))
+	resp.Body.Close()
+	assert.Equal(t, ClickCounts{AllTime: 3, Last1Min: 3, Last24Hours: 3, LastWeek: 3}, counts)
+
+	req, _ := http.NewRequest("DELETE", server.URL+"/api/v1/"+shortCode, nil)
+	resp, err = apiClient.Do(req)
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+
+	resp, err = noRedirectClient.Get(server.URL + "/api/v1/" + shortCode)
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestExpiredLinkReturnsGoneInMemory(t *testing.T) {
+	server := newMemoryAPI(t)
+
+	expiresAt := time.Now().Add(200 * time.Millisecond)
+	shortCode := createShortCode(t, server, URLRequest{LongURL: "https://example.com/expiring", ExpiresAt: &expiresAt})
+
+	// Before expiry the link redirects (and is cached)
+	resp, err := noRedirectClient.Get(server.URL + "/api/v1/" + shortCode)
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusFound, resp.StatusCode)
+
+	// After expiry neither the cache nor the store may serve it
+	time.Sleep(300 * time.Millisecond)
+	resp, err = noRedirectClient.Get(server.URL + "/api/v1/" + shortCode)
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusGone, resp.StatusCode)
+
+	// Links cannot be created already expired
+	past := time.Now().Add(-time.Hour)
+	jsonData, _ := json.Marshal(URLRequest{LongURL: "https://example.com/past", ExpiresAt: &past})
+	resp, err = apiClient.Post(server.URL+"/api/v1/create", "application/json", bytes.NewBuffer(jsonData))
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
+
+// POST a create request and return only the status code
+func createStatus(t *testing.T, server *httptest.Server, body URLRequest) int {
+	jsonData, err := json.Marshal(body)
+	assert.NoError(t, err)
+
+	resp, err := apiClient.Post(server.URL+"/api/v1/create", "application/json", bytes.NewBuffer(jsonData))
+	assert.NoError(t, err)
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestCustomAliasInMemory(t *testing.T) {
+	server := newMemoryAPI(t)
+
+	// Claim the code the first counter value encodes to, generated codes must skip it
+	assert.Equal(t, "2bJ", createShortCode(t, server, URLRequest{LongURL: "https://example.com/vanity", CustomAlias: "2bJ"}))
+	generated := createShortCode(t, server, URLRequest{LongURL: "https://example.com/generated"})
+	assert.NotEqual(t, "2bJ", generated)
+
+	resp, err := noRedirectClient.Get(server.URL + "/api/v1/2bJ")
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, "https://example.com/vanity", resp.Header.Get("Location"))
+
+	// Collisions with existing codes and conflicting long URLs are rejected
+	assert.Equal(t, http.StatusConflict, createStatus(t, server, URLRequest{LongURL: "https://example.com/other", CustomAlias: "2bJ"}))
+	assert.Equal(t, http.StatusConflict, createStatus(t, server, URLRequest{LongURL: "https://example.com/other", CustomAlias: generated}))
+	assert.Equal(t, http.StatusConflict, createStatus(t, server, URLRequest{LongURL: "https://example.com/vanity", CustomAlias: "another"}))
+
+	// Reserved words and invalid aliases are rejected
+	assert.Equal(t, http.StatusBadRequest, createStatus(t, server, URLRequest{LongURL: "https://example.com/a", CustomAlias: "Clicks"}))
+	assert.Equal(t, http.StatusBadRequest, createStatus(t, server, URLRequest{LongURL: "https://example.com/a", CustomAlias: "no/slash"}))
+	assert.Equal(t, http.StatusBadRequest, createStatus(t, server, URLRequest{LongURL: "https://example.com/a", CustomAlias: "ab"}))
+}
+
+// failingCounter is a URL store whose global counter is unreachable
+type failingCounter struct {
+	database.URLStore
+}
+
+func (failingCounter) IncrementGlobalCounter(ctx context.Context) (int64, error) {
+	return 0, errors.New("connection refused")
+}
+
+// A counter failure fails the create with 503 instead of stopping the service
+func TestCreateWithoutCounterInMemory(t *testing.T) {
+	server := newMemoryAPI(t)
+	database.URLs = failingCounter{database.URLs}
+
+	assert.Equal(t, http.StatusServiceUnavailable, createStatus(t, server, URLRequest{LongURL: "https://example.com/no-counter"}))
+	assert.Equal(t, http.StatusOK, createStatus(t, server, URLRequest{LongURL: "https://example.com/alias", CustomAlias: "no-counter"}))
+}
+
+// flakyClicks is a click store whose batch inserts fail until failures runs out
+type flakyClicks struct {
+	database.ClickStore
+	failures atomic.Int32
+}
+
+func (c *flakyClicks) RecordClicks(ctx context.Context, clicks []database.Click) error {
+	if c.failures.Add(-1) >= 0 {
+		return errors.New("connection refused")
+	}
+	return c.ClickStore.RecordClicks(ctx, clicks)
+}
+
+// A batch whose inserts keep failing stays buffered and is inserted once the store recovers
+func TestFailedClickBatchesAreRetriedInMemory(t *testing.T) {
+	server := newMemoryAPI(t)
+	shortCode := createShortCode(t, server, URLRequest{LongURL: "https://example.com/flaky"})
+
+	clicks := &flakyClicks{ClickStore: database.Clicks}
+	clicks.failures.Store(3)
+	database.Clicks = clicks
+
+	cfg := config.Default().Clicks
+	cfg.FlushInterval = time.Hour
+	cfg.Workers = 1
+	assert.NoError(t, clickingest.Start(cfg))
+	for i := 0; i < 10; i++ {
+		resp, err := noRedirectClient.Get(server.URL + "/api/v1/" + shortCode)
+		assert.NoError(t, err)
+		resp.Body.Close()
+	}
+
+	assert.NoError(t, clickingest.Stop(context.Background()))
+	assert.Less(t, clicks.failures.Load(), int32(0))
+	allTime, _, _, err := database.Clicks.GetClickCounts(context.Background(), shortCode, false)
+	assert.NoError(t, err)
+	assert.Equal(t, 10, allTime)
+}
+
+// Every fixed path segment under /api/v1/ is a reserved alias, so no alias shadows a route
+func TestReservedAliasesCoverRoutes(t *testing.T) {
+	err := routes.InitRoutes().Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+		template, err := route.GetPathTemplate()
+		if err != nil || !strings.HasPrefix(template, "/api/v1/") {
+			return nil
+		}
+		segment := strings.SplitN(strings.TrimPrefix(template, "/api/v1/"), "/", 2)[0]
+		if !strings.HasPrefix(segment, "{") {
+			assert.True(t, utils.IsReserved(segment), template)
+		}
+		return nil
+	})
+	assert.NoError(t, err)
+}
+
+func TestSweepExpiredURLsInMemory(t *testing.T) {
+	server := newMemoryAPI(t)
+
+	expiresAt := time.Now().Add(200 * time.Millisecond)
+	expiring := createShortCode(t, server, URLRequest{LongURL: "https://example.com/sweep", ExpiresAt: &expiresAt})
+	permanent := createShortCode(t, server, URLRequest{LongURL: "https://example.com/keep"})
+
+	resp, err := noRedirectClient.Get(server.URL + "/api/v1/" + expiring)
+	assert.NoError(t, err)
+	resp.Body.Close()
+
+	time.Sleep(300 * time.Millisecond)
+	result, err := sweeper.SweepExpiredURLs(context.Background(), nil)
+	assert.NoError(t, err)
+	assert.Equal(t, sweeper.Result{URLs: 1, Clicks: 1}, result)
+
+	// Archived links are gone, the long URL can be shortened again
+	resp, err = noRedirectClient.Get(server.URL + "/api/v1/" + expiring)
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	assert.NotEqual(t, expiring, createShortCode(t, server, URLRequest{LongURL: "https://example.com/sweep"}))
+
+	resp, err = noRedirectClient.Get(server.URL + "/api/v1/" + permanent)
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusFound, resp.StatusCode)
+}
+
+func TestBatchedClickIngestionDrainsInMemory(t *testing.T) {
+	server := newMemoryAPI(t)
+	shortCode := createShortCode(t, server, URLRequest{LongURL: "https://example.com/batched"})
+
+	// A long interval and large batch keep every click buffered until Stop drains it
+	cfg := config.Default().Clicks
+	cfg.FlushInterval = time.Hour
+	cfg.Workers = 2
+	assert.NoError(t, clickingest.Start(cfg))
+
+	for i := 0; i < 25; i++ {
+		resp, err := noRedirectClient.Get(server.URL + "/api/v1/" + shortCode)
+		assert.NoError(t, err)
+		resp.Body.Close()
+	}
+
+	allTime, _, _, err := database.Clicks.GetClickCounts(context.Background(), shortCode, false)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, allTime)
+
+	assert.NoError(t, clickingest.Stop(context.Background()))
+	allTime, last24h, lastWeek, err := database.Clicks.GetClickCounts(context.Background(), shortCode, false)
+	assert.NoError(t, err)
+	assert.Equal(t, []int{25, 25, 25}, []int{allTime, last24h, lastWeek})
+
+	// After Stop clicks are stored synchronously
+	resp, err := noRedirectClient.Get(server.URL + "/api/v1/" + shortCode)
+	assert.NoError(t, err)
+	resp.Body.Close()
+	allTime, _, _, _ = database.Clicks.GetClickCounts(context.Background(), shortCode, false)
+	assert.Equal(t, 26, allTime)
+}
@@ -0,0 +1,47 @@
+package e2etest
+
+import (
+	"io"
+	"net/http"
+	"testing"
+
+	"cloudflaretinyurl/metrics"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetricsInMemory(t *testing.T) {
+	server := newMemoryAPI(t)
+	shortCode := createShortCode(t, server, URLRequest{LongURL: "https://example.com/metrics"})
+
+	hits := testutil.ToFloat64(metrics.CacheLookups.WithLabelValues(metrics.CacheHit))
+	misses := testutil.ToFloat64(metrics.CacheLookups.WithLabelValues(metrics.CacheMiss))
+	redirects := testutil.ToFloat64(metrics.HTTPRequests.WithLabelValues("/api/v1/{shortURL}", "GET", "302"))
+
+	// Creation caches the link, so both redirects hit the cache
+	for i := 0; i < 2; i++ {
+		resp, err := noRedirectClient.Get(server.URL + "/api/v1/" + shortCode)
+		assert.NoError(t, err)
+		resp.Body.Close()
+	}
+	resp, err := noRedirectClient.Get(server.URL + "/api/v1/missing-code")
+	assert.NoError(t, err)
+	resp.Body.Close()
+
+	assert.Equal(t, hits+2, testutil.ToFloat64(metrics.CacheLookups.WithLabelValues(metrics.CacheHit)))
+	assert.Equal(t, misses+1, testutil.ToFloat64(metrics.CacheLookups.WithLabelValues(metrics.CacheMiss)))
+	assert.Equal(t, redirects+2, testutil.ToFloat64(metrics.HTTPRequests.WithLabelValues("/api/v1/{shortURL}", "GET", "302")))
+
+	resp, err = http.Get(server.URL + "/metrics")
+	assert.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// Requests are labelled by route template, never by short code
+	assert.Contains(t, string(body), `tinyurl_http_requests_total{code="404",method="GET",route="/api/v1/{shortURL}"}`)
+	assert.Contains(t, string(body), `tinyurl_http_request_duration_seconds_bucket{method="POST",route="/api/v1/create"`)
+	assert.NotContains(t, string(body), `route="/api/v1/`+shortCode)
+}
@@ -0,0 +1,82 @@
+package e2etest
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"testing"
+
+	"cloudflaretinyurl/config"
+	"cloudflaretinyurl/ratelimit"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRedirectRateLimitInMemory(t *testing.T) {
+	server := newMemoryAPI(t)
+	shortCode := createShortCode(t, server, URLRequest{LongURL: "https://example.com/limited"})
+	ratelimit.InitRateLimit(config.RateLimit{Enabled: true, IPRate: 0.5, IPBurst: 2}, nil)
+
+	for i := 0; i < 2; i++ {
+		resp, err := noRedirectClient.Get(server.URL + "/api/v1/" + shortCode)
+		assert.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusFound, resp.StatusCode)
+		assert.Equal(t, "2", resp.Header.Get("X-RateLimit-Limit"))
+	}
+
+	resp, err := noRedirectClient.Get(server.URL + "/api/v1/" + shortCode)
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	assert.Equal(t, "2", resp.Header.Get("Retry-After"))
+	assert.Equal(t, "0", resp.Header.Get("X-RateLimit-Remaining"))
+	assert.Equal(t, "4", resp.Header.Get("X-RateLimit-Reset"))
+}
+
+func TestCreateRateLimitPerAPIKeyInMemory(t *testing.T) {
+	server := newMemoryAPI(t)
+	apiURL := server.URL + "/api/v1"
+	other := createKey(t, apiURL, "erin")
+	ratelimit.InitRateLimit(config.RateLimit{Enabled: true, APIKeyRate: 1, APIKeyBurst: 1}, nil)
+
+	first := doWithKey(t, "POST", apiURL+"/create", testAPIKey, URLRequest{LongURL: "https://example.com/first"})
+	assert.Equal(t, http.StatusOK, first.StatusCode)
+	assert.Equal(t, "0", first.Header.Get("X-RateLimit-Remaining"))
+
+	// Rejected before a short code is generated
+	second := doWithKey(t, "POST", apiURL+"/create", testAPIKey, URLRequest{LongURL: "https://example.com/second"})
+	assert.Equal(t, http.StatusTooManyRequests, second.StatusCode)
+	assert.Equal(t, "1", second.Header.Get("Retry-After"))
+
+	// Every key has its own budget
+	assert.Equal(t, http.StatusOK, doWithKey(t, "POST", apiURL+"/create", other.Key, URLRequest{LongURL: "https://example.com/second"}).StatusCode)
+}
+
+// Only Redis failures switch to the in-memory limiter for a while, not canceled requests
+func TestRateLimitFallbackIgnoresCanceledRequests(t *testing.T) {
+	var dials atomic.Int32
+	rdb := redis.NewClient(&redis.Options{
+		Dialer: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			dials.Add(1)
+			return nil, errors.New("connection refused")
+		},
+		MaxRetries: -1,
+	})
+	defer rdb.Close()
+	ratelimit.InitRateLimit(config.RateLimit{Enabled: true, IPRate: 1, IPBurst: 5}, rdb)
+	policy := ratelimit.Policy{Name: ratelimit.PolicyIP, Rate: 1, Burst: 5}
+
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.True(t, ratelimit.Allow(canceled, policy, "198.51.100.1").Allowed)
+	assert.True(t, ratelimit.Allow(context.Background(), policy, "198.51.100.1").Allowed)
+	assert.Equal(t, int32(1), dials.Load())
+
+	// Redis is skipped until the retry interval passed
+	assert.True(t, ratelimit.Allow(context.Background(), policy, "198.51.100.1").Allowed)
+	assert.Equal(t, int32(1), dials.Load())
+}
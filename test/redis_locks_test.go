@@ -0,0 +1,52 @@
+package e2etest
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"cloudflaretinyurl/redislocks"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+)
+
+// Redis of the docker compose setup, the same one the service uses
+func redisAddr() string {
+	if addr := os.Getenv("REDIS_URL"); addr != "" {
+		return addr
+	}
+	return "cloudflaretinyurl_redis:6379"
+}
+
+// Per-item locks share their namespace's fence counter, so acquiring and releasing
+// any number of them leaves a single key behind
+func TestLockKeysE2E(t *testing.T) {
+	ctx := context.Background()
+	client := redis.NewClient(&redis.Options{Addr: redisAddr()})
+	defer client.Close()
+	redislocks.InitRedisLocks(client)
+
+	namespace := fmt.Sprintf("lock:e2e_%d", time.Now().UnixNano())
+	defer client.Del(ctx, namespace+":fence")
+
+	var fencing int64
+	for i := 0; i < 50; i++ {
+		lock, err := redislocks.AcquireLock(ctx, fmt.Sprintf("%s:%d", namespace, i), 2*time.Second)
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.Greater(t, lock.FencingToken(), fencing)
+		fencing = lock.FencingToken()
+
+		assert.NoError(t, lock.Check(ctx))
+		assert.NoError(t, lock.Release(ctx))
+		assert.ErrorIs(t, lock.Check(ctx), redislocks.ErrLockLost)
+	}
+
+	keys, err := client.Keys(ctx, namespace+"*").Result()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{namespace + ":fence"}, keys)
+}
@@ -0,0 +1,202 @@
+package e2etest
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"cloudflaretinyurl/config"
+	"cloudflaretinyurl/screening"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Body of a 400 response for a rejected field
+type ValidationError struct {
+	Field string `json:"field"`
+	Code  string `json:"code"`
+}
+
+func writeList(t *testing.T, dir, name, content string) {
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644))
+}
+
+func TestScreeningOnCreateInMemory(t *testing.T) {
+	server := newMemoryAPI(t)
+	dir := t.TempDir()
+	hash := sha256.Sum256([]byte("hashed.example/"))
+	writeList(t, dir, "phishing.domains", "# Comment\nevil.example\n*.bad.example\n")
+	writeList(t, dir, "reported.urls", "HTTPS://Example.com:443/reported\n")
+	writeList(t, dir, "patterns.regex", `^https://[^/]+/wp-login\.php`+"\n(unclosed\n")
+	writeList(t, dir, "safe_browsing.hashes", hex.EncodeToString(hash[:4])+"\n")
+	assert.NoError(t, screening.InitScreening(config.Screening{ListsDir: dir, ReloadInterval: time.Minute, Action: screening.ActionFlag}))
+
+	for _, longURL := range []string{
+		"https://evil.example/",
+		"https://login.evil.example/account",
+		"https://x.bad.example/",
+		"https://example.com/reported",
+		"https://shop.example/wp-login.php",
+		"http://www.hashed.example/some/page.html?id=1",
+	} {
+		resp := doWithKey(t, "POST", server.URL+"/api/v1/create", testAPIKey, URLRequest{LongURL: longURL})
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode, longURL)
+		var body struct {
+			Error ValidationError `json:"error"`
+		}
+		assert.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+		assert.Equal(t, screening.CodeBlocked, body.Error.Code, longURL)
+	}
+
+	assert.Equal(t, http.StatusOK, createStatus(t, server, URLRequest{LongURL: "https://notevil.example/"}))
+}
+
+func getHistory(t *testing.T, apiURL, shortCode string) linkHistory {
+	resp := doWithKey(t, "GET", apiURL+"/links/"+shortCode+"/history", testAPIKey, nil)
+	var history linkHistory
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&history))
+	return history
+}
+
+func TestScreeningOnRedirectAfterReloadInMemory(t *testing.T) {
+	server := newMemoryAPI(t)
+	dir := t.TempDir()
+	writeList(t, dir, "phishing.domains", "evil.example\n")
+	assert.NoError(t, screening.InitScreening(config.Screening{ListsDir: dir, ReloadInterval: time.Minute, Action: screening.ActionFlag}))
+	shortCode := createShortCode(t, server, URLRequest{LongURL: "https://later.example/page"})
+
+	// Listed after the link was created, picked up without a restart
+	writeList(t, dir, "phishing.domains", "evil.example\nlater.example\n")
+	reloaded, err := screening.Reload()
+	assert.NoError(t, err)
+	assert.True(t, reloaded)
+
+	resp, err := noRedirectClient.Get(server.URL + "/api/v1/" + shortCode)
+	assert.NoError(t, err)
+	page, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Contains(t, string(page), "https://later.example/page")
+	assert.Contains(t, string(page), `href="/api/v1/`+shortCode+`?confirm=1"`)
+
+	resp, err = noRedirectClient.Get(server.URL + "/api/v1/" + shortCode + "?confirm=1")
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusFound, resp.StatusCode)
+
+	// The link is flagged once, as a revision by screening
+	history := getHistory(t, server.URL+"/api/v1", shortCode)
+	if assert.Len(t, history.Revisions, 2) {
+		assert.True(t, history.Revisions[1].Flagged)
+		assert.True(t, history.Revisions[1].Enabled)
+		assert.Equal(t, "screening", history.Revisions[1].ChangedBy)
+	}
+
+	// Disabled links cannot be followed at all, and stay disabled in storage
+	assert.NoError(t, screening.InitScreening(config.Screening{ListsDir: dir, ReloadInterval: time.Minute, Action: screening.ActionDisable}))
+	resp, err = noRedirectClient.Get(server.URL + "/api/v1/" + shortCode + "?confirm=1")
+	assert.NoError(t, err)
+	page, _ = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	assert.NotContains(t, string(page), "Continue anyway")
+
+	// Later redirects show the blocked page with the stored reason, not a bare 410
+	resp, err = noRedirectClient.Get(server.URL + "/api/v1/" + shortCode)
+	assert.NoError(t, err)
+	page, _ = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	assert.Contains(t, string(page), "listed in phishing.domains (domain later.example)")
+	history = getHistory(t, server.URL+"/api/v1", shortCode)
+	if assert.Len(t, history.Revisions, 3) {
+		assert.False(t, history.Revisions[2].Enabled)
+		assert.True(t, history.Revisions[2].Flagged)
+		assert.Equal(t, "listed in phishing.domains (domain later.example)", history.Revisions[2].FlagReason)
+	}
+
+	// The owner cannot enable it again while its long URL is listed
+	resp = doWithKey(t, "PATCH", server.URL+"/api/v1/links/"+shortCode, testAPIKey, map[string]any{"enabled": true})
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	var rejected struct {
+		Error ValidationError `json:"error"`
+	}
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&rejected))
+	assert.Equal(t, ValidationError{Field: "enabled", Code: screening.CodeBlocked}, rejected.Error)
+
+	// A clean long URL clears the flag
+	resp = doWithKey(t, "PATCH", server.URL+"/api/v1/links/"+shortCode, testAPIKey, map[string]any{"long_url": "https://fixed.example/page", "enabled": true})
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	var link struct {
+		Enabled bool `json:"enabled"`
+		Flagged bool `json:"flagged"`
+	}
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&link))
+	assert.True(t, link.Enabled)
+	assert.False(t, link.Flagged)
+	status, _ := redirectOf(t, server.URL+"/api/v1", shortCode)
+	assert.Equal(t, http.StatusFound, status)
+}
+
+// A link disabled by screening is enabled again once its long URL is no longer listed
+func TestEnableDelistedLinkInMemory(t *testing.T) {
+	server := newMemoryAPI(t)
+	dir := t.TempDir()
+	writeList(t, dir, "phishing.domains", "listed.example\n")
+	assert.NoError(t, screening.InitScreening(config.Screening{ListsDir: dir, ReloadInterval: time.Minute, Action: screening.ActionDisable}))
+	shortCode := createShortCode(t, server, URLRequest{LongURL: "https://delisted.example/"})
+
+	writeList(t, dir, "phishing.domains", "listed.example\ndelisted.example\n")
+	_, err := screening.Reload()
+	assert.NoError(t, err)
+	status, _ := redirectOf(t, server.URL+"/api/v1", shortCode)
+	assert.Equal(t, http.StatusForbidden, status)
+
+	writeList(t, dir, "phishing.domains", "listed.example\n")
+	_, err = screening.Reload()
+	assert.NoError(t, err)
+	status, link := patchLink(t, server.URL+"/api/v1", shortCode, map[string]any{"enabled": true})
+	assert.Equal(t, http.StatusOK, status)
+	assert.True(t, link.Enabled)
+	status, _ = redirectOf(t, server.URL+"/api/v1", shortCode)
+	assert.Equal(t, http.StatusFound, status)
+
+	history := getHistory(t, server.URL+"/api/v1", shortCode)
+	if assert.Len(t, history.Revisions, 3) {
+		assert.False(t, history.Revisions[2].Flagged)
+		assert.Empty(t, history.Revisions[2].FlagReason)
+	}
+}
+
+func TestScreeningVerdictIsCachedPerListGeneration(t *testing.T) {
+	dir := t.TempDir()
+	writeList(t, dir, "phishing.domains", "evil.example\n")
+	assert.NoError(t, screening.InitScreening(config.Screening{ListsDir: dir, ReloadInterval: time.Minute, Action: screening.ActionFlag}))
+	t.Cleanup(func() { screening.InitScreening(config.Default().Screening) })
+
+	_, listed, screened := screening.CheckLink("abc", "https://evil.example/")
+	assert.True(t, listed)
+	assert.True(t, screened)
+	_, listed, screened = screening.CheckLink("abc", "https://evil.example/")
+	assert.True(t, listed)
+	assert.False(t, screened)
+
+	// Screened again once the link points elsewhere
+	_, listed, screened = screening.CheckLink("abc", "https://fine.example/")
+	assert.False(t, listed)
+	assert.True(t, screened)
+
+	// and once the lists are replaced
+	writeList(t, dir, "phishing.domains", "evil.example\nfine.example\n")
+	_, err := screening.Reload()
+	assert.NoError(t, err)
+	_, listed, screened = screening.CheckLink("abc", "https://fine.example/")
+	assert.True(t, listed)
+	assert.True(t, screened)
+}
@@ -0,0 +1,105 @@
+package e2etest
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"cloudflaretinyurl/database"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type ClickSeries struct {
+	Interval string    `json:"interval"`
+	TZ       string    `json:"tz"`
+	From     time.Time `json:"from"`
+	To       time.Time `json:"to"`
+	Total    int       `json:"total"`
+	Buckets  []struct {
+		Start  time.Time `json:"start"`
+		Clicks int       `json:"clicks"`
+	} `json:"buckets"`
+}
+
+func getSeries(t *testing.T, serverURL, shortCode, query string) (int, ClickSeries) {
+	resp, err := apiClient.Get(serverURL + "/api/v1/links/" + shortCode + "/timeseries?" + query)
+	assert.NoError(t, err)
+	defer resp.Body.Close()
+	var series ClickSeries
+	if resp.StatusCode == http.StatusOK {
+		assert.NoError(t, json.NewDecoder(resp.Body).Decode(&series))
+	}
+	return resp.StatusCode, series
+}
+
+// Record clicks at the given times, bypassing the redirect path which stamps the current time
+func recordClicksAt(t *testing.T, shortCode string, bot bool, times ...string) {
+	for _, at := range times {
+		accessedAt, err := time.Parse(time.RFC3339, at)
+		assert.NoError(t, err)
+		assert.NoError(t, database.Clicks.RecordClick(context.Background(), database.Click{ShortURL: shortCode, AccessedAt: accessedAt, Bot: bot}))
+	}
+}
+
+func TestClickTimeseriesInMemory(t *testing.T) {
+	server := newMemoryAPI(t)
+	shortCode := createShortCode(t, server, URLRequest{LongURL: "https://example.com/charted"})
+	recordClicksAt(t, shortCode, false, "2025-03-29T10:15:00Z", "2025-03-29T10:45:00Z", "2025-03-29T12:00:00Z", "2025-03-30T21:30:00Z")
+	recordClicksAt(t, shortCode, true, "2025-03-29T10:20:00Z")
+
+	// Hours without clicks are zero-filled, to is exclusive
+	status, series := getSeries(t, server.URL, shortCode, "from=2025-03-29T10:00:00Z&to=2025-03-29T13:00:00Z&interval=hour")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "UTC", series.TZ)
+	assert.Equal(t, 3, series.Total)
+	if assert.Len(t, series.Buckets, 3) {
+		assert.Equal(t, []int{2, 0, 1}, []int{series.Buckets[0].Clicks, series.Buckets[1].Clicks, series.Buckets[2].Clicks})
+		assert.True(t, series.Buckets[1].Start.Equal(time.Date(2025, 3, 29, 11, 0, 0, 0, time.UTC)))
+	}
+	_, series = getSeries(t, server.URL, shortCode, "from=2025-03-29T10:00:00Z&to=2025-03-29T13:00:00Z&include_bots=true")
+	assert.Equal(t, 4, series.Total)
+
+	// Berlin days across the switch to summer time: the 30th is 23 hours long and holds 21:30 UTC
+	_, series = getSeries(t, server.URL, shortCode, "from=2025-03-29&to=2025-04-01&interval=day&tz=Europe/Berlin")
+	assert.Equal(t, "Europe/Berlin", series.TZ)
+	if assert.Len(t, series.Buckets, 3) {
+		assert.Equal(t, "2025-03-29T00:00:00+01:00", series.Buckets[0].Start.Format(time.RFC3339))
+		assert.Equal(t, "2025-03-30T00:00:00+01:00", series.Buckets[1].Start.Format(time.RFC3339))
+		assert.Equal(t, "2025-03-31T00:00:00+02:00", series.Buckets[2].Start.Format(time.RFC3339))
+		assert.Equal(t, []int{3, 1, 0}, []int{series.Buckets[0].Clicks, series.Buckets[1].Clicks, series.Buckets[2].Clicks})
+	}
+
+	// Hours of a zone offset by a half hour, from is widened to the start of its bucket
+	_, series = getSeries(t, server.URL, shortCode, "from=2025-03-29T10:10:00Z&to=2025-03-29T11:00:00Z&tz=Asia/Kolkata")
+	if assert.Len(t, series.Buckets, 2) {
+		assert.Equal(t, "2025-03-29T15:00:00+05:30", series.Buckets[0].Start.Format(time.RFC3339))
+		assert.Equal(t, []int{1, 1}, []int{series.Buckets[0].Clicks, series.Buckets[1].Clicks})
+	}
+
+	// Weeks start on Monday, the 30th is a Sunday
+	_, series = getSeries(t, server.URL, shortCode, "from=2025-03-29T00:00:00Z&to=2025-04-01T00:00:00Z&interval=week")
+	if assert.Len(t, series.Buckets, 2) {
+		assert.Equal(t, "2025-03-24T00:00:00Z", series.Buckets[0].Start.Format(time.RFC3339))
+		assert.Equal(t, "2025-03-31T00:00:00Z", series.Buckets[1].Start.Format(time.RFC3339))
+		assert.Equal(t, []int{4, 0}, []int{series.Buckets[0].Clicks, series.Buckets[1].Clicks})
+	}
+
+	_, series = getSeries(t, server.URL, shortCode, "from=2025-03-29T10:14:00Z&to=2025-03-29T10:17:00Z&interval=minute")
+	assert.Len(t, series.Buckets, 3)
+	assert.Equal(t, 1, series.Total)
+
+	for _, query := range []string{
+		"interval=second",
+		"tz=Mars/Olympus_Mons",
+		"from=yesterday",
+		"from=2025-03-30&to=2025-03-29",
+		"from=2000-01-01&to=2025-01-01&interval=minute",
+		"include_bots=sometimes",
+	} {
+		status, _ := getSeries(t, server.URL, shortCode, query)
+		assert.Equal(t, http.StatusBadRequest, status, query)
+	}
+}
@@ -0,0 +1,51 @@
+package e2etest
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"cloudflaretinyurl/config"
+	"cloudflaretinyurl/tracing"
+
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+func TestTraceparentIsHonoredInMemory(t *testing.T) {
+	traceFile := filepath.Join(t.TempDir(), "traces.jsonl")
+	tracingConfig := config.Default().Tracing
+	tracingConfig.Exporter = "file"
+	tracingConfig.File = traceFile
+	tracingConfig.SampleRatio = 0 // Only the incoming sampled flag can get the request recorded
+
+	shutdown, err := tracing.Init(context.Background(), tracingConfig)
+	assert.NoError(t, err)
+	t.Cleanup(func() { otel.SetTracerProvider(noop.NewTracerProvider()) })
+
+	server := newMemoryAPI(t)
+	shortCode := createShortCode(t, server, URLRequest{LongURL: "https://example.com/traced"})
+
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	req, _ := http.NewRequest("GET", server.URL+"/api/v1/"+shortCode, nil)
+	req.Header.Set("traceparent", "00-"+traceID+"-00f067aa0ba902b7-01")
+	resp, err := noRedirectClient.Do(req)
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusFound, resp.StatusCode)
+
+	// The response carries the same trace, with the server span as parent
+	assert.True(t, strings.HasPrefix(resp.Header.Get("traceparent"), "00-"+traceID+"-"))
+	assert.NotContains(t, resp.Header.Get("traceparent"), "00f067aa0ba902b7")
+
+	assert.NoError(t, shutdown(context.Background()))
+	spans, err := os.ReadFile(traceFile)
+	assert.NoError(t, err)
+	assert.Contains(t, string(spans), `"Name":"GET /api/v1/{shortURL}"`)
+	assert.Contains(t, string(spans), traceID)
+	assert.NotContains(t, string(spans), "/api/v1/create") // Unsampled without a traceparent
+}
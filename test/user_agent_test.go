@@ -0,0 +1,98 @@
+package e2etest
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"cloudflaretinyurl/useragent"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUserAgentClassification(t *testing.T) {
+	for _, tc := range []struct {
+		userAgent string
+		want      useragent.Info
+	}{
+		{
+			"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/126.0.0.0 Safari/537.36 Edg/126.0.2592.87",
+			useragent.Info{DeviceType: "desktop", OSFamily: "Windows", OSVersion: "10", BrowserFamily: "Edge", BrowserVersion: "126.0"},
+		},
+		{
+			"Mozilla/5.0 (iPhone; CPU iPhone OS 17_5_1 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.5 Mobile/15E148 Safari/604.1",
+			useragent.Info{DeviceType: "mobile", OSFamily: "iOS", OSVersion: "17.5", BrowserFamily: "Safari", BrowserVersion: "17.5"},
+		},
+		{
+			"Mozilla/5.0 (iPad; CPU OS 16_6 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/16.6 Mobile/15E148 Safari/604.1",
+			useragent.Info{DeviceType: "tablet", OSFamily: "iOS", OSVersion: "16.6", BrowserFamily: "Safari", BrowserVersion: "16.6"},
+		},
+		{
+			"Mozilla/5.0 (Linux; Android 14; Pixel 8) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/126.0.6478.122 Mobile Safari/537.36",
+			useragent.Info{DeviceType: "mobile", OSFamily: "Android", OSVersion: "14", BrowserFamily: "Chrome", BrowserVersion: "126.0"},
+		},
+		{
+			"Mozilla/5.0 (Linux; Android 13; SM-X710) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/126.0.0.0 Safari/537.36",
+			useragent.Info{DeviceType: "tablet", OSFamily: "Android", OSVersion: "13", BrowserFamily: "Chrome", BrowserVersion: "126.0"},
+		},
+		{
+			"Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.4 Safari/605.1.15",
+			useragent.Info{DeviceType: "desktop", OSFamily: "macOS", OSVersion: "10.15", BrowserFamily: "Safari", BrowserVersion: "17.4"},
+		},
+		{
+			"Mozilla/5.0 (Windows NT 6.1; Trident/7.0; rv:11.0) like Gecko",
+			useragent.Info{DeviceType: "desktop", OSFamily: "Windows", OSVersion: "7", BrowserFamily: "Internet Explorer", BrowserVersion: "11.0"},
+		},
+		{
+			"Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)",
+			useragent.Info{DeviceType: "bot", OSFamily: "Other", BrowserFamily: "Googlebot", Bot: true},
+		},
+		{
+			"Slackbot-LinkExpanding 1.0 (+https://api.slack.com/robots)",
+			useragent.Info{DeviceType: "bot", OSFamily: "Other", BrowserFamily: "Slackbot", Bot: true},
+		},
+		{"curl/8.4.0", useragent.Info{DeviceType: "bot", OSFamily: "Other", BrowserFamily: "curl", Bot: true}},
+		{"Go-http-client/1.1", useragent.Info{DeviceType: "bot", OSFamily: "Other", BrowserFamily: "Go", Bot: true}},
+		{"", useragent.Info{DeviceType: "bot", OSFamily: "Other", BrowserFamily: "Other", Bot: true}},
+		{"SomethingNew/1.0", useragent.Info{DeviceType: "other", OSFamily: "Other", BrowserFamily: "Other"}},
+	} {
+		assert.Equal(t, tc.want, useragent.Parse(tc.userAgent), tc.userAgent)
+	}
+}
+
+func TestBotClicksNotCountedByDefaultInMemory(t *testing.T) {
+	server := newMemoryAPI(t)
+	shortCode := createShortCode(t, server, URLRequest{LongURL: "https://example.com/crawled"})
+
+	for _, userAgent := range []string{testUserAgent, "Mozilla/5.0 (compatible; bingbot/2.0; +http://www.bing.com/bingbot.htm)", "curl/8.4.0"} {
+		req, _ := http.NewRequest("GET", server.URL+"/api/v1/"+shortCode, nil)
+		req.Header.Set("User-Agent", userAgent)
+		resp, err := noRedirectClient.Do(req)
+		assert.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusFound, resp.StatusCode) // Bots are redirected like everyone else
+	}
+
+	counts := func(path string) map[string]int {
+		resp, err := apiClient.Get(server.URL + "/api/v1/" + path)
+		assert.NoError(t, err)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		var counts map[string]int
+		assert.NoError(t, json.NewDecoder(resp.Body).Decode(&counts))
+		return counts
+	}
+	assert.Equal(t, 1, counts("clicks/" + shortCode)["all_time"])
+	assert.Equal(t, 1, counts("clicks/" + shortCode)["last_1min"])
+	assert.Equal(t, 3, counts("clicks/" + shortCode + "?include_bots=true")["all_time"])
+	assert.Equal(t, 3, counts("clicks/" + shortCode + "?include_bots=true")["last_1min"])
+
+	// Every click is stored, synchronously without the ingestion pipeline
+	assert.Equal(t, 1, counts("clicks_fallback/" + shortCode)["all_time"])
+	assert.Equal(t, 3, counts("clicks_fallback/" + shortCode + "?include_bots=1")["all_time"])
+
+	resp, err := apiClient.Get(server.URL + "/api/v1/clicks/" + shortCode + "?include_bots=maybe")
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
@@ -0,0 +1,155 @@
+package urlpolicy
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+
+	"cloudflaretinyurl/config"
+
+	"golang.org/x/net/idna"
+)
+
+// Error codes returned to API clients
+const (
+	CodeEmpty            = "empty"
+	CodeTooLong          = "too_long"
+	CodeInvalid          = "invalid"
+	CodeRelative         = "relative"
+	CodeSchemeNotAllowed = "scheme_not_allowed"
+	CodeMissingHost      = "missing_host"
+	CodeInvalidHost      = "invalid_host"
+	CodeCredentials      = "credentials_not_allowed"
+	CodeSelfReferential  = "self_referential"
+)
+
+// Error is a long URL rejected by the policy
+type Error struct {
+	Code    string
+	Message string
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+func reject(code, format string, args ...any) *Error {
+	return &Error{Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+// Ports implied by a scheme, dropped from normalized URLs
+var defaultPorts = map[string]string{"http": "80", "https": "443"}
+
+var (
+	cfg       = config.Default().URLPolicy
+	schemes   = parseSchemes(cfg.AllowedSchemes)
+	shortHost = hostOf(config.Default().Server.BaseURL)
+)
+
+// Initialize the URL policy. Links to the host of baseURL are rejected, they would redirect to ourselves.
+func InitURLPolicy(policyConfig config.URLPolicy, baseURL string) {
+	cfg = policyConfig
+	schemes = parseSchemes(cfg.AllowedSchemes)
+	shortHost = hostOf(baseURL)
+}
+
+func parseSchemes(list string) map[string]bool {
+	allowed := map[string]bool{}
+	for _, scheme := range strings.Split(list, ",") {
+		if scheme = strings.ToLower(strings.TrimSpace(scheme)); scheme != "" {
+			allowed[scheme] = true
+		}
+	}
+	return allowed
+}
+
+// Normalized host[:port] of a URL, empty if it has none
+func hostOf(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return ""
+	}
+	host, err := normalizeHost(u)
+	if err != nil {
+		return ""
+	}
+	return host
+}
+
+// Normalize validates a long URL and returns the canonical form it is stored and deduplicated under:
+// lowercased scheme and host, IDNA host in punycode, no default port, "/" for an empty path, and
+// the fragment dropped if configured. Rejections are returned as *Error.
+func Normalize(rawURL string) (string, error) {
+	rawURL = strings.TrimSpace(rawURL)
+	if rawURL == "" {
+		return "", reject(CodeEmpty, "long_url is required")
+	}
+	if len(rawURL) > cfg.MaxLength {
+		return "", reject(CodeTooLong, "long_url is longer than %d characters", cfg.MaxLength)
+	}
+
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", reject(CodeInvalid, "long_url is not a valid URL")
+	}
+	if u.Scheme == "" {
+		return "", reject(CodeRelative, "long_url must be an absolute URL with a scheme")
+	}
+	u.Scheme = strings.ToLower(u.Scheme)
+	if !schemes[u.Scheme] {
+		return "", reject(CodeSchemeNotAllowed, "scheme %q is not allowed, use one of: %s", u.Scheme, cfg.AllowedSchemes)
+	}
+
+	if _, web := defaultPorts[u.Scheme]; web {
+		if u.Opaque != "" || u.Host == "" {
+			return "", reject(CodeMissingHost, "long_url must include a host")
+		}
+		if u.User != nil {
+			return "", reject(CodeCredentials, "long_url must not include credentials")
+		}
+		if u.Host, err = normalizeHost(u); err != nil {
+			return "", reject(CodeInvalidHost, "long_url host is invalid")
+		}
+		if u.Host == shortHost {
+			return "", reject(CodeSelfReferential, "long_url must not point at this URL shortener")
+		}
+		if u.Path == "" {
+			u.Path = "/"
+		}
+	}
+
+	if cfg.StripFragment {
+		u.Fragment, u.RawFragment = "", ""
+	}
+	u.ForceQuery = false // A trailing "?" carries no query
+
+	normalized := u.String()
+	if len(normalized) > cfg.MaxLength {
+		return "", reject(CodeTooLong, "long_url is longer than %d characters", cfg.MaxLength)
+	}
+	return normalized, nil
+}
+
+// Lowercased punycode host, with the port unless it is the scheme's default
+func normalizeHost(u *url.URL) (string, error) {
+	host := strings.TrimSuffix(strings.ToLower(u.Hostname()), ".")
+	if host == "" {
+		return "", fmt.Errorf("empty host")
+	}
+	if net.ParseIP(host) == nil {
+		var err error
+		if host, err = idna.Lookup.ToASCII(host); err != nil {
+			return "", err
+		}
+	}
+
+	port := u.Port()
+	if port == "" || port == defaultPorts[strings.ToLower(u.Scheme)] {
+		if strings.Contains(host, ":") {
+			return "[" + host + "]", nil // IPv6 literal
+		}
+		return host, nil
+	}
+	return net.JoinHostPort(host, port), nil
+}
@@ -0,0 +1,159 @@
+package useragent
+
+import (
+	_ "embed"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Device types
+const (
+	DeviceDesktop = "desktop"
+	DeviceMobile  = "mobile"
+	DeviceTablet  = "tablet"
+	DeviceTV      = "tv"
+	DeviceConsole = "console"
+	DeviceBot     = "bot"
+	DeviceOther   = "other"
+)
+
+// Family of user agents no rule matched
+const Other = "Other"
+
+// Longest version kept, matching the url_clicks columns
+const maxVersionLength = 16
+
+// Parsed user agents kept for reuse, the cache is emptied whenever it fills up
+const maxCached = 10000
+
+// Info is the classification of one user agent
+type Info struct {
+	DeviceType     string
+	OSFamily       string
+	OSVersion      string
+	BrowserFamily  string // Name of the bot for bots
+	BrowserVersion string
+	Bot            bool
+}
+
+//go:embed rules.yaml
+var bundledRules []byte
+
+type rule struct {
+	Name     string            `yaml:"name"`
+	Pattern  string            `yaml:"pattern"`
+	Exclude  string            `yaml:"exclude"`  // User agents also matching this do not match the rule
+	Versions map[string]string `yaml:"versions"` // Display names of versions
+
+	pattern *regexp.Regexp
+	exclude *regexp.Regexp
+}
+
+type ruleSet struct {
+	Bots     []*rule `yaml:"bots"`
+	Browsers []*rule `yaml:"browsers"`
+	OS       []*rule `yaml:"os"`
+	Devices  []*rule `yaml:"devices"`
+}
+
+var (
+	rules = mustLoadRules(bundledRules)
+
+	mu    sync.RWMutex
+	cache = map[string]Info{}
+)
+
+func mustLoadRules(data []byte) *ruleSet {
+	var set ruleSet
+	if err := yaml.Unmarshal(data, &set); err != nil {
+		panic(fmt.Sprintf("invalid user agent rules: %v", err))
+	}
+	for _, section := range [][]*rule{set.Bots, set.Browsers, set.OS, set.Devices} {
+		for _, r := range section {
+			r.pattern = regexp.MustCompile(r.Pattern)
+			if r.Exclude != "" {
+				r.exclude = regexp.MustCompile(r.Exclude)
+			}
+		}
+	}
+	return &set
+}
+
+// Parse classifies a user agent with the bundled rules. Empty user agents, sent by scripts
+// but never by browsers, are classified as bots.
+func Parse(userAgent string) Info {
+	mu.RLock()
+	info, ok := cache[userAgent]
+	mu.RUnlock()
+	if ok {
+		return info
+	}
+
+	info = parse(userAgent)
+	mu.Lock()
+	if len(cache) >= maxCached {
+		cache = map[string]Info{}
+	}
+	cache[userAgent] = info
+	mu.Unlock()
+	return info
+}
+
+func parse(userAgent string) Info {
+	if strings.TrimSpace(userAgent) == "" {
+		return Info{DeviceType: DeviceBot, OSFamily: Other, BrowserFamily: Other, Bot: true}
+	}
+
+	info := Info{DeviceType: DeviceOther, OSFamily: Other, BrowserFamily: Other}
+	if r, groups := match(rules.OS, userAgent); r != nil {
+		info.OSFamily = r.Name
+		info.OSVersion = version(r, groups)
+	}
+	if r, _ := match(rules.Bots, userAgent); r != nil {
+		info.DeviceType, info.BrowserFamily, info.Bot = DeviceBot, r.Name, true
+		return info
+	}
+	if r, groups := match(rules.Browsers, userAgent); r != nil {
+		info.BrowserFamily = r.Name
+		info.BrowserVersion = version(r, groups)
+	}
+	if r, _ := match(rules.Devices, userAgent); r != nil {
+		info.DeviceType = r.Name
+	}
+	return info
+}
+
+// First rule of a section matching the user agent, with its submatches
+func match(section []*rule, userAgent string) (*rule, []string) {
+	for _, r := range section {
+		if r.exclude != nil && r.exclude.MatchString(userAgent) {
+			continue
+		}
+		if groups := r.pattern.FindStringSubmatch(userAgent); groups != nil {
+			return r, groups
+		}
+	}
+	return nil, nil
+}
+
+// Version a matched rule captured: its first non-empty group, dotted and renamed by the rule
+func version(r *rule, groups []string) string {
+	for _, group := range groups[1:] {
+		if group == "" {
+			continue
+		}
+		group = strings.ReplaceAll(group, "_", ".")
+		if name, ok := r.Versions[group]; ok {
+			group = name
+		}
+		if len(group) > maxVersionLength {
+			group = group[:maxVersionLength]
+		}
+		return group
+	}
+	return ""
+}
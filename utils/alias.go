@@ -0,0 +1,45 @@
+package utils
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+const (
+	MinAliasLength = 3
+	MaxAliasLength = 32
+)
+
+// Custom aliases may only use URL-safe characters
+var aliasPattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// Path segments used by API routes that can never be claimed as a custom alias
+var reservedAliases = map[string]bool{
+	"create":          true,
+	"clicks":          true,
+	"clicks_fallback": true,
+	"admin":           true,
+	"keys":            true,
+	"links":           true,
+	"top":             true,
+}
+
+// Validates a custom alias (vanity short code) requested by the client
+func ValidateAlias(alias string) error {
+	if len(alias) < MinAliasLength || len(alias) > MaxAliasLength {
+		return fmt.Errorf("custom alias must be between %d and %d characters", MinAliasLength, MaxAliasLength)
+	}
+	if !aliasPattern.MatchString(alias) {
+		return fmt.Errorf("custom alias may only contain letters, digits, '-' and '_'")
+	}
+	if IsReserved(alias) {
+		return fmt.Errorf("custom alias %q is reserved", alias)
+	}
+	return nil
+}
+
+// IsReserved reports whether a short code is a path segment of an API route
+func IsReserved(code string) bool {
+	return reservedAliases[strings.ToLower(code)]
+}
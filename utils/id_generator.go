@@ -1,6 +1,7 @@
 package utils
 
 import (
+	"errors"
 	"fmt"
 	"strings"
 	"sync"
@@ -13,23 +14,44 @@ var (
 	lock sync.Mutex
 )
 
+// ErrSnowflakeDisabled is returned while this instance holds no Snowflake node ID
+var ErrSnowflakeDisabled = errors.New("snowflake ID generation is disabled, no node ID held")
+
 // Initializes the Snowflake node
 func InitSnowflake(machineID int64) error {
-	var err error
-	node, err = snowflake.NewNode(machineID)
-	return err
+	newNode, err := snowflake.NewNode(machineID)
+	if err != nil {
+		return err
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	node = newNode
+	return nil
+}
+
+// Stops ID generation until InitSnowflake is called again, used when the node ID lease is lost
+func DisableSnowflake() {
+	lock.Lock()
+	defer lock.Unlock()
+	node = nil
 }
 
 // Generates a Snowflake ID for a click event
-func GenerateSnowflakeID(shortURL string) string {
+func GenerateSnowflakeID(shortURL string) (string, error) {
 	lock.Lock()
 	defer lock.Unlock()
 
+	// Another instance may own our old node ID, generating now could collide
+	if node == nil {
+		return "", ErrSnowflakeDisabled
+	}
+
 	// Generate a unique Snowflake ID
 	snowflakeID := node.Generate().Int64()
 
 	// Format the key as click:shortURL:snowflakeID
-	return fmt.Sprintf("click:%s:%d", shortURL, snowflakeID)
+	return fmt.Sprintf("click:%s:%d", shortURL, snowflakeID), nil
 }
 
 // Extracts the Snowflake ID from a click key
@@ -42,3 +64,17 @@ func DecodeShortURLFromSnowflakeID(clickKey string) (string, error) {
 
 	return parts[1], nil // Extract the shortURL
 }
+
+// Extracts the Snowflake ID and its timestamp (milliseconds since Unix epoch) from a click key
+func DecodeSnowflakeFromClickKey(clickKey string) (int64, int64, error) {
+	parts := strings.Split(clickKey, ":")
+	if len(parts) != 3 {
+		return 0, 0, fmt.Errorf("invalid click key format")
+	}
+
+	id, err := snowflake.ParseString(parts[2])
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid snowflake ID in click key: %w", err)
+	}
+	return id.Int64(), id.Time(), nil
+}